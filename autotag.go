@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/crimro-se/imagedb/embedder"
+	"github.com/crimro-se/imagedb/pkg/vecmath"
+)
+
+// images scored per transaction while auto tagging
+const AUTOTAGPAGESIZE = 1000
+
+// CLIP's learned temperature, which turns cosine similarities into zero-shot classification logits
+const clipLogitScale = 100
+
+type AutoTagOptions struct {
+	Prompt    string  // template each label is embedded in, {} is replaced by the label. eg "a photo of {}"
+	Threshold float64 // minimum confidence (0-1) for a label to be tagged
+	MaxTags   int     // most labels tagged per image
+}
+
+// reads the labels to tag images with: one per line, ignoring blank lines and # comments.
+func LoadVocabulary(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	labels := normalizeTags(lines)
+	if len(labels) == 0 {
+		return nil, fmt.Errorf("no labels in %s", path)
+	}
+	return labels, nil
+}
+
+// the text embedded for a label
+func (opts AutoTagOptions) prompt(label string) string {
+	if !strings.Contains(opts.Prompt, "{}") {
+		return label
+	}
+	return strings.ReplaceAll(opts.Prompt, "{}", label)
+}
+
+// tags every image embedded by emb's model with the labels it most resembles, replacing their previous auto tags.
+// labels are embedded once per model and cached, so only new labels need the embedding server.
+// progress (optional) is told how many of the images have been tagged so far.
+// returns the number of tags written.
+func AutoTag(ctx context.Context, db *Database, emb embedder.Embedder, labels []string, opts AutoTagOptions,
+	progress func(done, total int64)) (int64, error) {
+	model, ok, err := db.GetModel(emb.ModelID())
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("no images have been embedded with %s, index them first", emb.ModelID())
+	}
+	labelVecs, err := labelEmbeddings(ctx, db, emb, model, labels, opts)
+	if err != nil {
+		return 0, err
+	}
+	total, err := db.CountEmbeddings(model)
+	if err != nil {
+		return 0, err
+	}
+
+	var done, tagged int64
+	var lastID int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return tagged, err
+		}
+		page, err := db.ReadEmbeddingsPage(model, lastID, AUTOTAGPAGESIZE)
+		if err != nil {
+			return tagged, err
+		}
+		if len(page) == 0 {
+			return tagged, nil
+		}
+		ids := make([]int64, len(page))
+		tags := make([]Tag, 0)
+		for i, e := range page {
+			ids[i] = e.ImageID
+			tags = append(tags, zeroShotTags(e.ImageID, vecmath.DecodeFloat32(e.Embedding), labels, labelVecs, opts)...)
+		}
+		if err := db.ReplaceAutoTags(ids, tags); err != nil {
+			return tagged, err
+		}
+		lastID = page[len(page)-1].ImageID
+		done += int64(len(page))
+		tagged += int64(len(tags))
+		if progress != nil {
+			progress(done, total)
+		}
+	}
+}
+
+// the model's embedding of each label's prompt, from the cache or else the embedder, in the order of labels.
+func labelEmbeddings(ctx context.Context, db *Database, emb embedder.Embedder, model Model,
+	labels []string, opts AutoTagOptions) ([][]float32, error) {
+	prompts := make([]string, len(labels))
+	for i, label := range labels {
+		prompts[i] = opts.prompt(label)
+	}
+	cached, err := db.ReadTextEmbeddings(model, prompts)
+	if err != nil {
+		return nil, err
+	}
+	vecs := make([][]float32, len(labels))
+	for i, prompt := range prompts {
+		vec, ok := cached[prompt]
+		if !ok {
+			vec, err = emb.EmbedText(ctx, prompt)
+			if err != nil {
+				return nil, fmt.Errorf("failed to embed label %q: %w", labels[i], err)
+			}
+			if len(vec) != model.Dimension {
+				return nil, fmt.Errorf("label %q has dimension %d, but model %s has %d",
+					labels[i], len(vec), model.ModelID, model.Dimension)
+			}
+			vec = vecmath.Normalize(vec)
+			if err := db.SaveTextEmbedding(model, prompt, vec); err != nil {
+				return nil, err
+			}
+		}
+		vecs[i] = vec
+	}
+	return vecs, nil
+}
+
+// CLIP style zero-shot classification of one image: a softmax over the labels' similarities to it.
+// the most probable labels over the threshold become its tags, with their probability as the confidence.
+func zeroShotTags(imgID int64, vec []float32, labels []string, labelVecs [][]float32, opts AutoTagOptions) []Tag {
+	type score struct {
+		label int
+		p     float64
+	}
+	scores := make([]score, len(labels))
+	maxLogit := math.Inf(-1)
+	for i, labelVec := range labelVecs {
+		// vectors are normalised, so the dot product is the cosine similarity
+		scores[i] = score{i, clipLogitScale * float64(vecmath.Dot(vec, labelVec))}
+		maxLogit = max(maxLogit, scores[i].p)
+	}
+	var sum float64
+	for i := range scores {
+		scores[i].p = math.Exp(scores[i].p - maxLogit)
+		sum += scores[i].p
+	}
+	sort.Slice(scores, func(i, j int) bool { return scores[i].p > scores[j].p })
+	tags := make([]Tag, 0, opts.MaxTags)
+	for _, s := range scores[:min(opts.MaxTags, len(scores))] {
+		p := s.p / sum
+		if p < opts.Threshold {
+			break
+		}
+		tags = append(tags, Tag{ImageID: imgID, Tag: labels[s.label], Source: TagSourceAuto,
+			Confidence: sql.NullFloat64{Float64: p, Valid: true}})
+	}
+	return tags
+}
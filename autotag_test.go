@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/crimro-se/imagedb/embedder"
+	"github.com/crimro-se/imagedb/pkg/vecmath"
+)
+
+// embeds text from a fixed table, counting requests
+type fakeEmbedder struct {
+	texts map[string][]float32
+	calls int
+}
+
+func (f *fakeEmbedder) EmbedImage(ctx context.Context, imageData []byte) (embedder.ImageEmbedding, error) {
+	return embedder.ImageEmbedding{}, nil
+}
+
+func (f *fakeEmbedder) EmbedText(ctx context.Context, text string) ([]float32, error) {
+	f.calls++
+	return f.texts[text], nil
+}
+
+func (f *fakeEmbedder) Dimension() int  { return 3 }
+func (f *fakeEmbedder) ModelID() string { return "fake" }
+func (f *fakeEmbedder) Close() error    { return nil }
+
+func TestAutoTag(t *testing.T) {
+	db, err := NewDatabase(":memory:", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CreateBasedir("/"); err != nil {
+		t.Fatal(err)
+	}
+	model, err := db.EnsureModel("fake", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emb := &fakeEmbedder{texts: map[string][]float32{
+		"a photo of cat": {1, 0, 0},
+		"a photo of dog": {0, 1, 0},
+		"a photo of car": {0, 0, 1},
+	}}
+	// a cat, a dog, and a cat in a car
+	for i, vec := range [][]float32{{1, 0, 0}, {0.1, 1, 0}, vecmath.Normalize([]float32{1, 0, 1})} {
+		id, err := db.CreateUpdateImage(&Image{BasedirID: 1, Path: "dir", SubPath: string(rune('a' + i)), Width: 1, Height: 1, FileSize: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CreateUpdateEmbedding(model, id, vecmath.Normalize(vec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.AddTags([]Tag{{ImageID: 2, Tag: "puppy", Source: TagSourceManual}}); err != nil {
+		t.Fatal(err)
+	}
+	opts := AutoTagOptions{Prompt: "a photo of {}", Threshold: 0.1, MaxTags: 3}
+	tagsOf := func(id int64) []string {
+		t.Helper()
+		tags, err := db.ReadTags(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tagNames(tags)
+	}
+
+	var progress int64
+	tagged, err := AutoTag(context.Background(), db, emb, []string{"cat", "dog", "car"}, opts, func(done, total int64) {
+		progress = done
+		if total != 3 {
+			t.Errorf("expected 3 images to tag, got %d", total)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tagged != 4 || progress != 3 || emb.calls != 3 {
+		t.Errorf("tagged %d, progress %d, %d labels embedded", tagged, progress, emb.calls)
+	}
+	for id, want := range map[int64][]string{1: {"cat"}, 2: {"dog", "puppy"}, 3: {"car", "cat"}} {
+		if got := tagsOf(id); !slices.Equal(got, want) {
+			t.Errorf("image %d: expected tags %v, got %v", id, want, got)
+		}
+	}
+	tags, _ := db.ReadTags(1)
+	if tags[0].Source != TagSourceAuto || tags[0].Confidence.Float64 < 0.99 {
+		t.Errorf("unexpected auto tag %+v", tags[0])
+	}
+
+	// without cat in the vocabulary, its tags go. the other labels' embeddings are reused.
+	_, err = AutoTag(context.Background(), db, emb, []string{"dog", "car"}, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emb.calls != 3 {
+		t.Errorf("cached labels embedded again, %d calls", emb.calls)
+	}
+	for id := int64(1); id <= 3; id++ {
+		if got := tagsOf(id); slices.Contains(got, "cat") {
+			t.Errorf("image %d still tagged cat: %v", id, got)
+		}
+	}
+	if got := tagsOf(2); !slices.Contains(got, "puppy") {
+		t.Errorf("manual tag lost: %v", got)
+	}
+
+	emb.texts["a photo of cat"] = []float32{1, 0}
+	db.wcon.Exec(`DELETE FROM text_embeddings`)
+	if _, err := AutoTag(context.Background(), db, emb, []string{"cat"}, opts, nil); err == nil {
+		t.Error("expected an error for a label of the wrong dimension")
+	}
+}
+
+func TestLoadVocabulary(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tags.txt")
+	err := os.WriteFile(file, []byte("# animals\nCat\n\n  dog \ncat\n  # more\nblack  and white\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels, err := LoadVocabulary(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"cat", "dog", "black and white"}; !slices.Equal(labels, want) {
+		t.Errorf("expected %v, got %v", want, labels)
+	}
+	os.WriteFile(file, []byte("# nothing\n"), 0o644)
+	if _, err := LoadVocabulary(file); err == nil {
+		t.Error("expected an error for an empty vocabulary")
+	}
+}
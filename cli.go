@@ -0,0 +1,684 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crimro-se/imagedb/embedder"
+)
+
+// the command line runs imagedb without its GUI, eg to index on a headless server.
+// results are written to stdout as JSON, while progress and errors go to stderr.
+
+const cliUsage = `usage: imagedb [-db file] [-config file] [command]
+without a command, the GUI is started.
+
+  -db file           the database, by default db.sqlite in the working directory if there is one,
+                     otherwise $XDG_DATA_HOME/imagedb/db.sqlite
+  -config file       the configuration, by default config.ini in the working directory if there is one,
+                     otherwise $XDG_CONFIG_HOME/imagedb/config.ini
+
+commands:
+  basedir add <directory>          add a directory of images
+  basedir list                     list the directories, with how many images each has
+  basedir remove <id|directory>    remove a directory and its images
+  index [flags] [id|directory...]  queue the directories, or every directory, and index until the queue is empty
+  search text [flags] <query>      search by description, in the search box's query language
+  search image [flags] <file> [terms]
+                                   search for images like the file, filtered by the terms
+  search similar [flags] <id> [terms]
+                                   search for images like the image with the id
+  stats                            summarise the database
+  export [flags] [terms]           write every image matching the terms as a line of JSON
+  serve [flags]                    serve a web page and JSON API for searching, see server.go
+
+search and export flags:
+  -basedir ids       comma separated ids of the directories to search, all by default
+search flags:
+  -limit n           most images to return, QUERY_RESULTS by default
+  -offset n          images to skip, for paging
+  -diversity 0-1     how much to avoid near duplicates
+export flags:
+  -embeddings        include each image's embedding from the active model
+index flags:
+  -jobs n            directories indexed at once, INDEX_JOBS by default
+  -queued            only run jobs already queued, eg left by an interrupted run or the GUI
+  -list              list the queued and past jobs rather than indexing
+  -clear             forget the finished jobs, then list the rest
+serve flags:
+  -addr host:port    where to listen, SERVE_ADDRESS by default
+  -read-only         refuse changes, as SERVE_READ_ONLY does
+
+exit codes: 0 success, 1 failure, 2 invalid arguments, 3 indexing finished but some files failed
+`
+
+// exit codes
+const (
+	exitOK      = 0
+	exitError   = 1 // the command failed
+	exitUsage   = 2 // the command line was invalid
+	exitPartial = 3 // indexing finished, but some files couldn't be indexed
+)
+
+// images read per query when exporting
+const exportPageSize = 500
+
+// a mistake in the command line
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func usagef(format string, args ...any) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// returned by commands that finished, but with errors they've already reported
+var errPartial = errors.New("finished with errors")
+
+type cli struct {
+	ctx    context.Context
+	db     *Database
+	dbFile string
+	conf   *Config
+	emb    embedder.Embedder // for searches, created on first use
+	stdout io.Writer
+	stderr io.Writer
+	errMu  sync.Mutex // stderr is written to by indexing's threads
+}
+
+var cliCommands = map[string]func(*cli, []string) error{
+	"basedir": (*cli).basedir,
+	"index":   (*cli).index,
+	"search":  (*cli).search,
+	"stats":   (*cli).stats,
+	"export":  (*cli).export,
+	"serve":   (*cli).serve,
+}
+
+// runs the command line args (without the program name) against the database file, returning the exit code.
+// cancelling ctx interrupts the command.
+func runCLI(ctx context.Context, args []string, dbFile string, conf *Config, stdout, stderr io.Writer) int {
+	if len(args) == 0 || slices.Contains([]string{"help", "-h", "-help", "--help"}, args[0]) {
+		fmt.Fprint(stdout, cliUsage)
+		return exitOK
+	}
+	command, ok := cliCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "imagedb: unknown command %q, see imagedb help\n", args[0])
+		return exitUsage
+	}
+	db, err := NewDatabase(dbFile, true)
+	if err != nil {
+		fmt.Fprintln(stderr, "imagedb:", err)
+		return exitError
+	}
+	defer db.Close()
+	db.UseANN(conf.HNSW_EF_SEARCH)
+
+	c := &cli{ctx: ctx, db: db, dbFile: dbFile, conf: conf, stdout: stdout, stderr: stderr}
+	defer func() {
+		if c.emb != nil {
+			c.emb.Close()
+		}
+	}()
+	err = command(c, args[1:])
+	var usageErr *usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errPartial):
+		return exitPartial
+	case errors.As(err, &usageErr):
+		fmt.Fprintf(stderr, "imagedb %s: %v, see imagedb help\n", args[0], err)
+		return exitUsage
+	default:
+		fmt.Fprintf(stderr, "imagedb %s: %v\n", args[0], err)
+		return exitError
+	}
+}
+
+func (c *cli) writeJSON(v any) error {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (c *cli) logf(format string, args ...any) {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	fmt.Fprintf(c.stderr, format+"\n", args...)
+}
+
+// the embedder used for searches, created on first use
+func (c *cli) embedder() (embedder.Embedder, error) {
+	if c.emb == nil {
+		emb, err := embedder.New(c.ctx, c.conf.EmbedderOptions())
+		if err != nil {
+			return nil, err
+		}
+		c.emb = emb
+	}
+	return c.emb, nil
+}
+
+// a command's flags, whose errors runCLI reports
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard) // errors are reported by runCLI
+	return flags
+}
+
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return usagef("%v", err)
+	}
+	return nil
+}
+
+// the basedir given by id or directory
+func (c *cli) findBasedir(arg string) (Basedir, error) {
+	basedirs, err := c.db.GetAllBasedir()
+	if err != nil {
+		return Basedir{}, err
+	}
+	id, idErr := strconv.ParseInt(arg, 10, 64)
+	dir, _ := filepath.Abs(arg)
+	for _, bd := range basedirs {
+		if (idErr == nil && bd.ID == id) || filepath.Clean(bd.Directory) == dir {
+			return bd, nil
+		}
+	}
+	return Basedir{}, fmt.Errorf("no basedir %s, see imagedb basedir list", arg)
+}
+
+// the ids of the basedirs in a comma separated list, or of every basedir if it's empty
+func (c *cli) basedirIDs(list string) ([]int64, error) {
+	if len(list) == 0 {
+		basedirs, err := c.db.GetAllBasedir()
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]int64, len(basedirs))
+		for i, bd := range basedirs {
+			ids[i] = bd.ID
+		}
+		return ids, nil
+	}
+	ids := make([]int64, 0)
+	for _, arg := range strings.Split(list, ",") {
+		bd, err := c.findBasedir(strings.TrimSpace(arg))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, bd.ID)
+	}
+	return ids, nil
+}
+
+func (c *cli) basedir(args []string) error {
+	if len(args) == 0 {
+		return usagef("expected add, list or remove")
+	}
+	switch args[0] {
+	case "add":
+		if len(args) != 2 {
+			return usagef("expected the directory to add")
+		}
+		dir, err := filepath.Abs(args[1])
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s isn't a directory", dir)
+		}
+		if bd, err := c.findBasedir(dir); err == nil {
+			return fmt.Errorf("%s was already added, as basedir %d", dir, bd.ID)
+		}
+		if err := c.db.CreateBasedir(dir); err != nil {
+			return err
+		}
+		bd, err := c.findBasedir(dir)
+		if err != nil {
+			return err
+		}
+		return c.writeJSON(bd)
+	case "list":
+		if len(args) != 1 {
+			return usagef("list takes no arguments")
+		}
+		stats, err := c.db.Stats()
+		if err != nil {
+			return err
+		}
+		return c.writeJSON(stats.Basedirs)
+	case "remove":
+		if len(args) != 2 {
+			return usagef("expected the id or directory of the basedir to remove")
+		}
+		bd, err := c.findBasedir(args[1])
+		if err != nil {
+			return err
+		}
+		if err := c.db.DeleteBasedir(bd.ID); err != nil {
+			return err
+		}
+		return c.writeJSON(bd)
+	}
+	return usagef("unknown basedir command %q, expected add, list or remove", args[0])
+}
+
+func (c *cli) index(args []string) error {
+	flags := newFlagSet("index")
+	jobs := flags.Int("jobs", c.conf.INDEX_JOBS, "")
+	queued := flags.Bool("queued", false, "")
+	list := flags.Bool("list", false, "")
+	clear := flags.Bool("clear", false, "")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if *jobs < 1 {
+		return usagef("-jobs must be at least 1")
+	}
+	c.conf.INDEX_JOBS = *jobs
+	if *clear {
+		if err := c.db.ClearFinishedIndexJobs(); err != nil {
+			return err
+		}
+	}
+	if *list || *clear {
+		jobs, err := c.db.ReadIndexJobs()
+		if err != nil {
+			return err
+		}
+		return c.writeJSON(jobs)
+	}
+
+	queue, err := NewIndexQueue(c.db, c.dbFile, c.conf)
+	if err != nil {
+		return err
+	}
+	queue.OnUpdate = c.logIndexJob
+	queue.OnLog = func(job IndexJob, msg string) { c.logf("%s", msg) }
+	if !*queued {
+		basedirs, err := c.db.GetAllBasedir()
+		if err != nil {
+			return err
+		}
+		if flags.NArg() > 0 {
+			basedirs = make([]Basedir, 0, flags.NArg())
+			for _, arg := range flags.Args() {
+				bd, err := c.findBasedir(arg)
+				if err != nil {
+					return err
+				}
+				basedirs = append(basedirs, bd)
+			}
+		}
+		if len(basedirs) == 0 {
+			return errors.New("there are no basedirs to index, add one with imagedb basedir add")
+		}
+		if _, err := queue.Add(basedirs...); err != nil {
+			return err
+		}
+	}
+
+	// nb: jobs queued by earlier, interrupted, runs are run too
+	all, err := c.db.ReadIndexJobs()
+	if err != nil {
+		return err
+	}
+	ids := make([]int64, 0, len(all))
+	for _, job := range all {
+		if job.Active() {
+			ids = append(ids, job.ID)
+		}
+	}
+	if err := queue.Run(c.ctx, true); err != nil && c.ctx.Err() == nil {
+		return err
+	}
+
+	ran := make([]IndexJob, 0, len(ids))
+	var errs []error
+	partial := false
+	for _, id := range ids {
+		job, err := c.db.ReadIndexJob(id)
+		if err != nil {
+			return err
+		}
+		ran = append(ran, job)
+		partial = partial || job.Errors > 0
+		if job.Status == JobFailed {
+			errs = append(errs, fmt.Errorf("indexing %s failed: %s", job.Directory, job.Error))
+		}
+	}
+	if err := c.writeJSON(ran); err != nil {
+		return err
+	}
+	if c.ctx.Err() != nil {
+		errs = append(errs, errors.New("indexing was interrupted, the unfinished directories are indexed by the next imagedb index"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if partial {
+		return errPartial
+	}
+	return nil
+}
+
+// reports an indexing job's progress on stderr
+func (c *cli) logIndexJob(job IndexJob) {
+	switch job.Status {
+	case JobQueued:
+		c.logf("queued %s", job.Directory)
+	case JobRunning:
+		if job.Progress == nil {
+			c.logf("indexing %s", job.Directory)
+			return
+		}
+		c.logf("indexing %s: %d files, %d errors, %s", job.Directory, job.Files, job.Errors, describeProgress(*job.Progress))
+	case JobDone:
+		c.logf("indexed %s: %d files, %d errors", job.Directory, job.Files, job.Errors)
+	case JobFailed:
+		c.logf("indexing %s failed: %s", job.Directory, job.Error)
+	case JobCancelled:
+		c.logf("cancelled indexing %s", job.Directory)
+	}
+}
+
+// an image as the command line and HTTP API output it
+type ImageJSON struct {
+	ID        int64     `json:"id"`
+	BasedirID int64     `json:"basedir"`
+	Path      string    `json:"path"` // of the file, through the archive it's in if it's in one
+	Width     int64     `json:"width"`
+	Height    int64     `json:"height"`
+	FileSize  int64     `json:"filesize"`
+	Aesthetic *float64  `json:"aesthetic,omitempty"`
+	ModTime   *int64    `json:"mtime,omitempty"`    // unix time
+	Distance  *float64  `json:"distance,omitempty"` // similarity searches only
+	Tags      []string  `json:"tags,omitempty"`
+	Embedding []float32 `json:"embedding,omitempty"`
+}
+
+// img's BasedirPath needs to be set
+func newImageJSON(img Image) ImageJSON {
+	out := ImageJSON{ID: img.ID, BasedirID: img.BasedirID, Path: filepath.Clean(img.GetRealPath()),
+		Width: img.Width, Height: img.Height, FileSize: img.FileSize}
+	if img.Aesthetic.Valid {
+		out.Aesthetic = &img.Aesthetic.Float64
+	}
+	if img.ModTime.Valid {
+		out.ModTime = &img.ModTime.Int64
+	}
+	if img.Distance.Valid {
+		out.Distance = &img.Distance.Float64
+	}
+	return out
+}
+
+func imagesJSON(db *Database, imgs []Image) ([]ImageJSON, error) {
+	imgs, err := db.AugmentImages(imgs)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]ImageJSON, len(imgs))
+	for i, img := range imgs {
+		out[i] = newImageJSON(img)
+	}
+	return out, nil
+}
+
+func (c *cli) search(args []string) error {
+	if len(args) == 0 {
+		return usagef("expected text, image or similar")
+	}
+	kind := args[0]
+	if kind != "text" && kind != "image" && kind != "similar" {
+		return usagef("unknown search %q, expected text, image or similar", kind)
+	}
+	flags := newFlagSet("search " + kind)
+	limit := flags.Int("limit", c.conf.QUERY_RESULTS, "")
+	offset := flags.Int("offset", 0, "")
+	basedirs := flags.String("basedir", "", "")
+	diversity := flags.Float64("diversity", 0, "")
+	if err := parseFlags(flags, args[1:]); err != nil {
+		return err
+	}
+	if *limit <= 0 || *offset < 0 || *diversity < 0 || *diversity > 1 {
+		return usagef("-limit must be positive, -offset can't be negative and -diversity must be 0-1")
+	}
+	qf := QueryFilter{Limit: *limit, Offset: *offset, Weights: c.conf.RankWeights(), Diversity: *diversity}
+	var err error
+	qf.BaseDirs, err = c.basedirIDs(*basedirs)
+	if err != nil {
+		return err
+	}
+	if len(qf.BaseDirs) == 0 {
+		return errors.New("there are no basedirs to search, add one with imagedb basedir add")
+	}
+	rest := flags.Args()
+	if len(rest) == 0 {
+		return usagef("expected a query, file or image id to search for")
+	}
+
+	var imgs []Image
+	switch kind {
+	case "text":
+		q, err := ParseSearchQuery(strings.Join(rest, " "), qf)
+		if err != nil {
+			return usagef("%v", err)
+		}
+		imgs, err = q.Run(c.db, func(text string) ([]byte, error) {
+			emb, err := c.embedder()
+			if err != nil {
+				return nil, err
+			}
+			return embedSearchText(c.ctx, c.db, emb, text)
+		})
+		if err != nil {
+			return err
+		}
+	case "similar":
+		id, err := strconv.ParseInt(rest[0], 10, 64)
+		if err != nil || id <= 0 {
+			return usagef("expected an image id, not %q", rest[0])
+		}
+		q, err := c.parseTerms(rest[1:], qf)
+		if err != nil {
+			return err
+		}
+		q.SimilarTo = id
+		imgs, err = q.Run(c.db, nil)
+		if err != nil {
+			return err
+		}
+	case "image":
+		q, err := c.parseTerms(rest[1:], qf)
+		if err != nil {
+			return err
+		}
+		embedding, err := c.imageEmbedding(rest[0])
+		if err != nil {
+			return err
+		}
+		imgs, err = q.Match(c.db, embedding)
+		if err != nil {
+			return err
+		}
+	}
+	out, err := imagesJSON(c.db, imgs)
+	if err != nil {
+		return err
+	}
+	return c.writeJSON(out)
+}
+
+// parses the terms narrowing a search for images like another, which can't have a description
+func (c *cli) parseTerms(terms []string, qf QueryFilter) (SearchQuery, error) {
+	q, err := parseSearchQuery(strings.Join(terms, " "), qf, true)
+	if err != nil {
+		return q, usagef("%v", err)
+	}
+	if len(q.Text) > 0 || q.SimilarTo != 0 {
+		return q, usagef("only terms can follow the image searched for, not %q", q.Text)
+	}
+	return q, nil
+}
+
+func (c *cli) imageEmbedding(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading image file: %s: %w", file, err)
+	}
+	emb, err := c.embedder()
+	if err != nil {
+		return nil, err
+	}
+	return embedSearchImage(c.ctx, c.db, emb, img)
+}
+
+func (c *cli) stats(args []string) error {
+	if len(args) > 0 {
+		return usagef("stats takes no arguments")
+	}
+	stats, err := c.db.Stats()
+	if err != nil {
+		return err
+	}
+	return c.writeJSON(stats)
+}
+
+// writes the images as JSON lines, in path order, with their tags
+func (c *cli) export(args []string) error {
+	flags := newFlagSet("export")
+	basedirs := flags.String("basedir", "", "")
+	embeddings := flags.Bool("embeddings", false, "")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	qf := QueryFilter{Limit: exportPageSize}
+	var err error
+	qf.BaseDirs, err = c.basedirIDs(*basedirs)
+	if err != nil || len(qf.BaseDirs) == 0 {
+		return err
+	}
+	q, err := ParseSearchQuery(strings.Join(flags.Args(), " "), qf)
+	if err != nil {
+		return usagef("%v", err)
+	}
+	if len(q.Text) > 0 || q.SimilarTo != 0 {
+		return usagef("export only takes terms, not a description or similar:")
+	}
+
+	enc := json.NewEncoder(c.stdout)
+	for {
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+		imgs, err := c.db.ReadImages(q.Filter, OrderByPathAsc)
+		if err != nil {
+			return err
+		}
+		out, err := imagesJSON(c.db, imgs)
+		if err != nil {
+			return err
+		}
+		var vecs map[int64][]float32
+		if *embeddings {
+			ids := make([]int64, len(imgs))
+			for i, img := range imgs {
+				ids[i] = img.ID
+			}
+			if vecs, err = c.db.readActiveEmbeddings(ids); err != nil {
+				return err
+			}
+		}
+		for _, img := range out {
+			tags, err := c.db.ReadTags(img.ID)
+			if err != nil {
+				return err
+			}
+			img.Tags, img.Embedding = tagNames(tags), vecs[img.ID]
+			if err := enc.Encode(img); err != nil {
+				return err
+			}
+		}
+		if len(imgs) < q.Filter.Limit {
+			return nil
+		}
+		q.Filter.Offset += len(imgs)
+	}
+}
+
+// serves the HTTP API until interrupted
+func (c *cli) serve(args []string) error {
+	flags := newFlagSet("serve")
+	addr := flags.String("addr", c.conf.SERVE_ADDRESS, "")
+	readOnly := flags.Bool("read-only", c.conf.SERVE_READ_ONLY, "")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usagef("serve takes no arguments, only flags")
+	}
+	server := NewServer(c.db, c.conf, *readOnly)
+	server.OnLog = func(msg string) { c.logf("%s", msg) }
+	defer server.Close()
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	c.logf("serving http://%s", listener.Addr())
+	if host, _, _ := net.SplitHostPort(*addr); len(c.conf.SERVE_PASSWORD) == 0 && !isLoopback(host) {
+		c.logf("warning: SERVE_PASSWORD isn't set, so anyone who can reach %s can use it", *addr)
+	}
+	httpServer := &http.Server{Handler: server, ReadHeaderTimeout: 10 * time.Second}
+	served := make(chan error, 1)
+	go func() {
+		served <- httpServer.Serve(listener)
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-c.ctx.Done():
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return httpServer.Shutdown(ctx)
+	}
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
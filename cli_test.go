@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCLI(t *testing.T) {
+	dir := t.TempDir()
+	dbFile := filepath.Join(dir, "db.sqlite")
+	conf, _ := LoadConfig(filepath.Join(dir, "missing.ini"))
+	run := func(want int, args ...string) string {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		if code := runCLI(context.Background(), args, dbFile, conf, &stdout, &stderr); code != want {
+			t.Fatalf("%s: exit code %d, expected %d. stderr: %s", strings.Join(args, " "), code, want, stderr.String())
+		}
+		return stdout.String()
+	}
+
+	var bd Basedir
+	if err := json.Unmarshal([]byte(run(exitOK, "basedir", "add", dir)), &bd); err != nil {
+		t.Fatal(err)
+	}
+	if bd.ID != 1 || bd.Directory != dir {
+		t.Errorf("unexpected basedir %+v", bd)
+	}
+	run(exitError, "basedir", "add", dir)
+	run(exitUsage, "basedir", "rename")
+	run(exitUsage, "colour")
+
+	// images a, b and c, each further from a than the last
+	db, err := NewDatabase(dbFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model, err := db.EnsureModel("tiny", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range [][]float32{{1, 0}, {0.8, 0.6}, {0, 1}} {
+		name := string(rune('a' + i))
+		id, err := db.CreateUpdateImage(&Image{BasedirID: bd.ID, Path: "dir", SubPath: name, Width: 1, Height: 1, FileSize: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CreateUpdateEmbedding(model, id, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SetActiveModel("tiny"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReplaceTags(2, []string{"favourite"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	var stats Stats
+	if err := json.Unmarshal([]byte(run(exitOK, "stats")), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Images != 3 || stats.Tags != 1 || stats.ActiveModel != "tiny" || len(stats.Basedirs) != 1 ||
+		stats.Basedirs[0].Images != 3 || stats.Models[len(stats.Models)-1] != (ModelStats{"tiny", 2, QuantizationNone, 3}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	var found []ImageJSON
+	if err := json.Unmarshal([]byte(run(exitOK, "search", "similar", "-limit", "2", "1")), &found); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0].ID != 1 || found[1].ID != 2 || found[1].Distance == nil ||
+		found[1].Path != filepath.Join(dir, "dir", "b") {
+		t.Errorf("unexpected search results %+v", found)
+	}
+	run(exitUsage, "search", "similar", "1", "a", "description")
+	run(exitUsage, "search", "similar", "-limit", "0", "1")
+	run(exitUsage, "search", "text", "cat", "w>wide")
+
+	// export writes a line per image, in path order
+	lines := bufio.NewScanner(strings.NewReader(run(exitOK, "export", "-embeddings", "tag:favourite")))
+	exported := make([]ImageJSON, 0)
+	for lines.Scan() {
+		var img ImageJSON
+		if err := json.Unmarshal(lines.Bytes(), &img); err != nil {
+			t.Fatal(err)
+		}
+		exported = append(exported, img)
+	}
+	if len(exported) != 1 || exported[0].ID != 2 || len(exported[0].Tags) != 1 || len(exported[0].Embedding) != 2 {
+		t.Errorf("unexpected export %+v", exported)
+	}
+	if got := strings.Count(run(exitOK, "export"), "\n"); got != 3 {
+		t.Errorf("expected every image to be exported, got %d lines", got)
+	}
+
+	run(exitOK, "basedir", "remove", dir)
+	if err := json.Unmarshal([]byte(run(exitOK, "stats")), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Images != 0 || len(stats.Basedirs) != 0 {
+		t.Errorf("expected the basedir and its images to be removed, got %+v", stats)
+	}
+}
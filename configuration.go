@@ -1,37 +1,320 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/crimro-se/imagedb/embedder"
 	"gopkg.in/ini.v1"
 )
 
 type Config struct {
 	API_SERVER             string
+	EMBEDDER               string // which kind of embedding server API_SERVER is: litserve, openai or llamacpp. Or onnx for in-process
+	EMBEDDING_MODEL        string // model name, required except for litserve
+	EMBEDDING_DIMENSION    int    // length of the model's vectors, 0 to learn it from the server
+	EMBEDDING_QUANTIZATION string // none, int8 or binary: coarse copies of vectors that speed up searches
+	HNSW_EF_SEARCH         int    // 0 searches every vector, otherwise an HNSW index is used with this ef
+	API_KEY                string // optional bearer token for the embedding server
+	API_BATCH_SIZE         int    // max images sent to the embedding server per request
+	API_TIMEOUT            int    // seconds before a request to the embedding server is abandoned
+	API_RETRIES            int    // retries for requests that fail with a transient error
+	ONNX_RUNTIME_LIBRARY   string // path to the onnxruntime shared library, if not installed system wide
+	ONNX_IMAGE_MODEL       string
+	ONNX_TEXT_MODEL        string
+	ONNX_AESTHETIC_MODEL   string // optional
+	ONNX_TOKENIZER_DIR     string // containing vocab.json and merges.txt
+	ONNX_IMAGE_SIZE        int    // input size of ONNX_IMAGE_MODEL
 	IMAGE_SIZE_EMBEDDING   int
 	IMAGE_SIZE_THUMBNAIL   int
 	THREADS_FOR_THUMBNAILS int
 	THREADS_FOR_INDEXING   int
+	INDEX_JOBS             int // basedirs indexed at once, sharing THREADS_FOR_INDEXING
 	QUERY_RESULTS          int
+	AUTOTAG_VOCABULARY     string  // file of labels to auto tag images with, one per line
+	AUTOTAG_PROMPT         string  // each label is embedded as this text, with {} replaced by the label
+	AUTOTAG_THRESHOLD      float64 // minimum confidence (0-1) for an auto tag
+	AUTOTAG_MAX_TAGS       int     // most auto tags per image
+	RANK_SIMILARITY        float64 // weights of the scores sort:hybrid ranks searches by, see RankWeights
+	RANK_AESTHETIC         float64
+	RANK_RECENCY           float64
+	RANK_TAGS              float64
+	SERVE_ADDRESS          string // where imagedb serve listens
+	SERVE_USER             string // basic auth for imagedb serve, only required if SERVE_PASSWORD is set
+	SERVE_PASSWORD         string
+	SERVE_READ_ONLY        bool // whether imagedb serve refuses changes, eg to tags
 }
 
-func LoadConfig(path string) (*Config, error) {
-	// default config
-	config := &Config{
+// settings are read from config.ini, and each can be overridden by an environment variable of the same name
+// prefixed with IMAGEDB_, eg IMAGEDB_API_SERVER. empty values keep the defaults.
+const configEnvPrefix = "IMAGEDB_"
+
+// settings naming files, which when relative are relative to config.ini's directory rather than the working directory.
+// nb: those set by the environment are left relative to the working directory, as a shell would expect.
+var configPaths = []string{"ONNX_RUNTIME_LIBRARY", "ONNX_IMAGE_MODEL", "ONNX_TEXT_MODEL", "ONNX_AESTHETIC_MODEL",
+	"ONNX_TOKENIZER_DIR", "AUTOTAG_VOCABULARY"}
+
+func DefaultConfig() *Config {
+	return &Config{
 		API_SERVER:             "",
+		EMBEDDER:               embedder.BackendLitServe,
+		EMBEDDING_QUANTIZATION: QuantizationNone,
+		API_BATCH_SIZE:         24,
+		API_TIMEOUT:            60,
+		API_RETRIES:            3,
+		ONNX_IMAGE_SIZE:        224,
 		IMAGE_SIZE_EMBEDDING:   336,
 		IMAGE_SIZE_THUMBNAIL:   192,
 		THREADS_FOR_THUMBNAILS: max(runtime.NumCPU()-4, 2),
 		THREADS_FOR_INDEXING:   max(runtime.NumCPU()-4, 2),
+		INDEX_JOBS:             1,
 		QUERY_RESULTS:          64,
+		AUTOTAG_VOCABULARY:     "tags.txt",
+		AUTOTAG_PROMPT:         "a photo of {}",
+		AUTOTAG_THRESHOLD:      0.1,
+		AUTOTAG_MAX_TAGS:       3,
+		RANK_SIMILARITY:        DefaultRankWeights.Similarity,
+		RANK_AESTHETIC:         DefaultRankWeights.Aesthetic,
+		RANK_RECENCY:           DefaultRankWeights.Recency,
+		RANK_TAGS:              DefaultRankWeights.Tags,
+		SERVE_ADDRESS:          "localhost:8080",
+		SERVE_USER:             "imagedb",
+	}
+}
+
+// reads the config file at path, applies the environment's overrides and validates the result.
+// a missing file leaves the defaults, returning an error matching fs.ErrNotExist alongside a usable config.
+func LoadConfig(path string) (*Config, error) {
+	cfgFile, loadErr := ini.Load(path)
+	if loadErr != nil {
+		if !errors.Is(loadErr, fs.ErrNotExist) {
+			return DefaultConfig(), loadErr
+		}
+		cfgFile = ini.Empty()
 	}
-	cfgFile, err := ini.Load(path)
+	section := cfgFile.Section("")
+	config, err := NewConfig(func(name string) string {
+		if value, ok := os.LookupEnv(configEnvPrefix + name); ok {
+			return value
+		}
+		return section.Key(name).String()
+	})
 	if err != nil {
+		return config, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	config.resolvePaths(filepath.Dir(path))
+	fmt.Fprintln(os.Stderr, "Loaded config:")
+	fmt.Fprintln(os.Stderr, config.printable())
+	return config, loadErr
+}
+
+// a config of the defaults, with each setting lookup returns a value for replaced. the result is validated.
+func NewConfig(lookup func(name string) string) (*Config, error) {
+	config := DefaultConfig()
+	var errs []error
+	v := reflect.ValueOf(config).Elem()
+	for _, name := range ConfigNames() {
+		value := strings.TrimSpace(lookup(name))
+		if len(value) == 0 {
+			continue
+		}
+		if err := setConfigField(v.FieldByName(name), value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
 		return config, err
 	}
-	err = cfgFile.MapTo(config)
-	fmt.Println("Loaded config:")
-	fmt.Println(config)
-	return config, err
+	return config, config.Validate()
+}
+
+// the names of every setting, in the order they're declared
+func ConfigNames() []string {
+	t := reflect.TypeFor[Config]()
+	names := make([]string, t.NumField())
+	for i := range names {
+		names[i] = t.Field(i).Name
+	}
+	return names
+}
+
+// makes the relative configPaths relative to dir instead.
+// a bare ONNX_RUNTIME_LIBRARY file name is left for the system to find.
+func (c *Config) resolvePaths(dir string) {
+	v := reflect.ValueOf(c).Elem()
+	for _, name := range configPaths {
+		field := v.FieldByName(name)
+		value := field.String()
+		if len(value) == 0 || filepath.IsAbs(value) || ConfigFromEnv(name) ||
+			name == "ONNX_RUNTIME_LIBRARY" && filepath.Base(value) == value {
+			continue
+		}
+		field.SetString(filepath.Join(dir, value))
+	}
+}
+
+// the setting's current value, as it would be written in config.ini
+func (c *Config) Get(name string) string {
+	return fmt.Sprint(reflect.ValueOf(c).Elem().FieldByName(name).Interface())
+}
+
+func setConfigField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q isn't a whole number", value)
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q isn't a number", value)
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q isn't true or false", value)
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Kind())
+	}
+	return nil
+}
+
+// checks every setting, returning all the problems found
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, name, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: "+format, append([]any{name}, args...)...))
+		}
+	}
+	if len(c.API_SERVER) > 0 {
+		u, err := url.Parse(c.API_SERVER)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && len(u.Host) > 0,
+			"API_SERVER", "%q isn't an http(s) URL", c.API_SERVER)
+	}
+	check(slices.Contains([]string{embedder.BackendLitServe, embedder.BackendOpenAI, embedder.BackendLlamaCpp, embedder.BackendONNX}, c.EMBEDDER),
+		"EMBEDDER", "%q isn't litserve, openai, llamacpp or onnx", c.EMBEDDER)
+	check(slices.Contains([]string{QuantizationNone, QuantizationInt8, QuantizationBinary}, c.EMBEDDING_QUANTIZATION),
+		"EMBEDDING_QUANTIZATION", "%q isn't none, int8 or binary", c.EMBEDDING_QUANTIZATION)
+	for name, n := range map[string]int{
+		"API_BATCH_SIZE": c.API_BATCH_SIZE, "API_TIMEOUT": c.API_TIMEOUT, "ONNX_IMAGE_SIZE": c.ONNX_IMAGE_SIZE,
+		"IMAGE_SIZE_EMBEDDING": c.IMAGE_SIZE_EMBEDDING, "IMAGE_SIZE_THUMBNAIL": c.IMAGE_SIZE_THUMBNAIL,
+		"THREADS_FOR_THUMBNAILS": c.THREADS_FOR_THUMBNAILS, "THREADS_FOR_INDEXING": c.THREADS_FOR_INDEXING,
+		"INDEX_JOBS": c.INDEX_JOBS, "QUERY_RESULTS": c.QUERY_RESULTS, "AUTOTAG_MAX_TAGS": c.AUTOTAG_MAX_TAGS,
+	} {
+		check(n > 0, name, "must be positive, not %d", n)
+	}
+	for name, n := range map[string]int{
+		"EMBEDDING_DIMENSION": c.EMBEDDING_DIMENSION, "HNSW_EF_SEARCH": c.HNSW_EF_SEARCH, "API_RETRIES": c.API_RETRIES,
+	} {
+		check(n >= 0, name, "can't be negative, not %d", n)
+	}
+	for name, f := range map[string]float64{
+		"RANK_SIMILARITY": c.RANK_SIMILARITY, "RANK_AESTHETIC": c.RANK_AESTHETIC,
+		"RANK_RECENCY": c.RANK_RECENCY, "RANK_TAGS": c.RANK_TAGS,
+	} {
+		check(f >= 0, name, "can't be negative, not %g", f)
+	}
+	check(c.AUTOTAG_THRESHOLD >= 0 && c.AUTOTAG_THRESHOLD <= 1, "AUTOTAG_THRESHOLD", "must be between 0 and 1, not %g", c.AUTOTAG_THRESHOLD)
+	_, _, err := net.SplitHostPort(c.SERVE_ADDRESS)
+	check(err == nil, "SERVE_ADDRESS", "%q isn't a host:port", c.SERVE_ADDRESS)
+	// nb: maps are unordered, so sort for stable messages
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errors.Join(errs...)
+}
+
+// writes the settings in values to the config file at path, creating it if need be.
+// other settings, and the file's comments, are kept as they are.
+func SaveConfig(path string, values map[string]string) error {
+	cfgFile, err := ini.LoadSources(ini.LoadOptions{Loose: true}, path)
+	if err != nil {
+		return err
+	}
+	section := cfgFile.Section("")
+	for _, name := range ConfigNames() {
+		if value, ok := values[name]; ok {
+			section.Key(name).SetValue(value)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return cfgFile.SaveTo(path)
+}
+
+// whether the setting is overridden by the environment, so editing config.ini won't change it
+func ConfigFromEnv(name string) bool {
+	_, ok := os.LookupEnv(configEnvPrefix + name)
+	return ok
+}
+
+// a copy for printing, with secrets masked
+func (c *Config) printable() Config {
+	printable := *c
+	if len(printable.API_KEY) > 0 {
+		printable.API_KEY = "********"
+	}
+	if len(printable.SERVE_PASSWORD) > 0 {
+		printable.SERVE_PASSWORD = "********"
+	}
+	return printable
+}
+
+// the settings used to construct an embedder.Embedder
+func (c *Config) EmbedderOptions() embedder.Options {
+	return embedder.Options{
+		Backend:   c.EMBEDDER,
+		URL:       c.API_SERVER,
+		Model:     c.EMBEDDING_MODEL,
+		APIKey:    c.API_KEY,
+		Dimension: c.EMBEDDING_DIMENSION,
+		Timeout:   time.Duration(c.API_TIMEOUT) * time.Second,
+		Retries:   c.API_RETRIES,
+		BatchSize: c.API_BATCH_SIZE,
+		ONNX: embedder.ONNXOptions{
+			Library:        c.ONNX_RUNTIME_LIBRARY,
+			ImageModel:     c.ONNX_IMAGE_MODEL,
+			TextModel:      c.ONNX_TEXT_MODEL,
+			AestheticModel: c.ONNX_AESTHETIC_MODEL,
+			TokenizerDir:   c.ONNX_TOKENIZER_DIR,
+			ImageSize:      c.ONNX_IMAGE_SIZE,
+			// indexing runs inferences in parallel, so share the cores out between them
+			Threads: max(runtime.NumCPU()/max(c.THREADS_FOR_INDEXING, 1), 1),
+		},
+	}
+}
+
+func (c *Config) AutoTagOptions() AutoTagOptions {
+	return AutoTagOptions{
+		Prompt:    c.AUTOTAG_PROMPT,
+		Threshold: c.AUTOTAG_THRESHOLD,
+		MaxTags:   c.AUTOTAG_MAX_TAGS,
+	}
+}
+
+func (c *Config) RankWeights() RankWeights {
+	return RankWeights{
+		Similarity: c.RANK_SIMILARITY,
+		Aesthetic:  c.RANK_AESTHETIC,
+		Recency:    c.RANK_RECENCY,
+		Tags:       c.RANK_TAGS,
+	}
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	// the shipped config must be valid
+	conf, err := LoadConfig("config.ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.API_SERVER != "http://localhost:5000" || conf.THREADS_FOR_INDEXING <= 0 {
+		t.Errorf("unexpected config %+v", conf)
+	}
+
+	// relative files are found beside the config, unless set by the environment
+	dir := t.TempDir()
+	t.Setenv("IMAGEDB_ONNX_TEXT_MODEL", "text.onnx")
+	conf, _ = LoadConfig(filepath.Join(dir, "missing.ini"))
+	if conf.AUTOTAG_VOCABULARY != filepath.Join(dir, "tags.txt") || conf.ONNX_TEXT_MODEL != "text.onnx" || len(conf.ONNX_RUNTIME_LIBRARY) > 0 {
+		t.Errorf("unexpected paths %q, %q and %q", conf.AUTOTAG_VOCABULARY, conf.ONNX_TEXT_MODEL, conf.ONNX_RUNTIME_LIBRARY)
+	}
+
+	t.Setenv("IMAGEDB_QUERY_RESULTS", "10")
+	conf, err = LoadConfig(filepath.Join(t.TempDir(), "missing.ini"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a missing file error, got %v", err)
+	}
+	if conf.QUERY_RESULTS != 10 {
+		t.Errorf("expected the environment to override QUERY_RESULTS, got %d", conf.QUERY_RESULTS)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.ini")
+	if err := os.WriteFile(path, []byte("API_SERVER = localhost:5000\nIMAGE_SIZE_THUMBNAIL = 0\nAPI_TIMEOUT = soon\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "API_TIMEOUT") {
+		t.Fatalf("expected API_TIMEOUT to be rejected, got %v", err)
+	}
+	t.Setenv("IMAGEDB_API_TIMEOUT", "5")
+	_, err = LoadConfig(path)
+	for _, want := range []string{"API_SERVER", "IMAGE_SIZE_THUMBNAIL"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %s to be rejected, got %v", want, err)
+		}
+	}
+}
+
+func TestSaveConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.ini")
+	if err := os.WriteFile(path, []byte("; the thumbnails\nIMAGE_SIZE_THUMBNAIL = 128\nQUERY_RESULTS = 32\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveConfig(path, map[string]string{"QUERY_RESULTS": "100"}); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.IMAGE_SIZE_THUMBNAIL != 128 || conf.QUERY_RESULTS != 100 {
+		t.Errorf("unexpected config %+v", conf)
+	}
+	saved, _ := os.ReadFile(path)
+	if !strings.Contains(string(saved), "; the thumbnails") {
+		t.Errorf("expected the comment to be kept:\n%s", saved)
+	}
+}
@@ -2,25 +2,29 @@ package main
 
 import (
 	"database/sql"
-	_ "embed"
 	"errors"
 	"fmt"
 	"image"
+	"io"
+	"math"
 	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
 
 	sqlite_vec "github.com/asg017/sqlite-vec-go-bindings/cgo"
 	"github.com/crimro-se/imagedb/internal/imagedbutil"
+	"github.com/crimro-se/imagedb/pkg/archivewalk"
 	"github.com/crimro-se/imagedb/pkg/querystructs"
+	"github.com/crimro-se/imagedb/pkg/vecmath"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-//go:embed schema.sql
-var dbSchema string
-
 type Basedir struct {
-	ID        int64  `db:"rowid"`
-	Directory string `db:"directory"`
+	ID        int64  `db:"rowid" json:"id"`
+	Directory string `db:"directory" json:"directory"`
 }
 
 type Image struct {
@@ -29,11 +33,12 @@ type Image struct {
 	BasedirPath string          // obtain via foreign key if needed.
 	Path        string          `db:"parent_path"` // path of parent directory or zip file
 	SubPath     string          `db:"sub_path"`    // filename or path within zip
-	Tags        sql.NullString  `db:"tags"`
 	Aesthetic   sql.NullFloat64 `db:"aesthetic"`
 	Width       int64           `db:"width"`
 	Height      int64           `db:"height"`
 	FileSize    int64           `db:"filesize"`
+	ModTime     sql.NullInt64   `db:"mtime"`    // unix time the file (or its archive) was modified
+	Distance    sql.NullFloat64 `db:"distance"` // from the searched vector, in similarity search results. not stored
 }
 
 // todo: handle archives
@@ -42,12 +47,20 @@ func (dbImg *Image) GetRealPath() string {
 	return imagedbutil.AddTrailingSlash(dbImg.BasedirPath) + imagedbutil.AddTrailingSlash(dbImg.Path) + dbImg.SubPath
 }
 
-// todo: handle archives
+// opens the image's file, or its file within the archive it's in.
+// the image's BasedirPath needs to be set first
+func (dbImg *Image) Open() (io.ReadCloser, error) {
+	// nb: for images in archives, Path is the archive
+	container := imagedbutil.AddTrailingSlash(dbImg.BasedirPath) + dbImg.Path
+	if info, err := os.Stat(container); err == nil && !info.IsDir() {
+		return archivewalk.OpenArchiveFile(container, dbImg.SubPath)
+	}
+	return os.Open(dbImg.GetRealPath())
+}
+
 // the image's BasedirPath needs to be set first
 func (dbImg *Image) Load() (image.Image, error) {
-	// Open the file for reading
-	filePath := dbImg.GetRealPath()
-	file, err := os.Open(filePath)
+	file, err := dbImg.Open()
 	if err != nil {
 		return nil, err
 	}
@@ -62,35 +75,70 @@ func (dbImg *Image) Load() (image.Image, error) {
 
 }
 
+// safe for concurrent use: reads share a pool of connections, while writes go through a single
+// connection so they queue in Go rather than contending for SQLite's write lock.
 type Database struct {
-	con                  *sqlx.DB
+	con                  *sqlx.DB // reads
+	wcon                 *sqlx.DB // writes, a single connection
+	file                 string
 	whereClauseGenerator func(QueryFilter) (string, error)
+	annScope             string // identifies the database for sharing ANN indexes between connections
+	annEfSearch          int    // see UseANN
+	pathSearch           bool   // whether SQLite has FTS5 for path searches, see database_fts.go
 	// pre-calculated strings for use in queries
 	insertIntoImageTableSQL     string
 	insertIntoImageTableSQLNoID string
 }
 
-// obtain a new sqlx connection.
-// may optionally execute the schema
-// don't share the same connection to multiple threads
-func NewDatabase(file string, execSchema bool) (*Database, error) {
+// connections kept open for reading
+const READCONNECTIONS = 4
+
+// open the database.
+// may optionally migrate the schema up to date (see migrations/)
+func NewDatabase(file string, migrate bool) (*Database, error) {
 	var myself Database
 	var err error
-	myself.con, err = sqlx.Connect("sqlite3", file)
+	myself.file, myself.annScope = file, file
+	if file == ":memory:" {
+		myself.annScope = fmt.Sprintf(":memory:%p", &myself)
+	}
+	// nb: the writer goes first, as it creates the file and switches it to WAL
+	myself.wcon, err = sqlx.Connect("sqlite3", dataSourceName(file, writeOptions))
 	if err != nil {
 		return nil, err
 	}
-	if execSchema {
-		_, err = myself.con.Exec(dbSchema)
+	myself.wcon.SetMaxOpenConns(1)
+	// nb: readers are opened after migrating, as a connection's first query can see the schema from
+	// when it connected, and mattn/go-sqlite3 takes a query's columns from before it re-prepares.
+	myself.con = myself.wcon
+	if migrate {
+		err = myself.migrate(file)
+		if err == nil {
+			err = myself.ensurePathIndex()
+		}
+	}
+	if err != nil {
+		return &myself, err
 	}
+	myself.pathSearch, err = myself.hasFTS5()
 	if err != nil {
 		return &myself, err
 	}
-	myself.insertIntoImageTableSQL, err = structToSQLString(Image{}, []string{})
+	// every connection to :memory: is a separate database, so reads have to share the writer's
+	if file != ":memory:" {
+		myself.con, err = sqlx.Connect("sqlite3", dataSourceName(file, readOptions))
+		if err != nil {
+			myself.wcon.Close()
+			return nil, err
+		}
+		myself.con.SetMaxOpenConns(max(READCONNECTIONS, runtime.NumCPU()))
+		myself.con.SetMaxIdleConns(READCONNECTIONS)
+	}
+	myself.insertIntoImageTableSQL, err = structToSQLString(Image{}, []string{"distance"})
 	if err != nil {
 		return &myself, err
 	}
-	myself.insertIntoImageTableSQLNoID, err = structToSQLString(Image{}, []string{"rowid"})
+	myself.insertIntoImageTableSQLNoID, err = structToSQLString(Image{}, []string{"rowid", "distance"})
 	if err != nil {
 		return &myself, err
 	}
@@ -98,6 +146,25 @@ func NewDatabase(file string, execSchema bool) (*Database, error) {
 	return &myself, err
 }
 
+// mattn/go-sqlite3 options applied to every connection it opens.
+// WAL lets reads carry on while another connection writes, and NORMAL synchronous is safe with it
+// (a power cut may lose the last commits, but won't corrupt the database).
+// The busy timeout has connections wait for each other rather than failing with "database is locked",
+// and immediate transactions take the write lock up front, as waiting can't resolve two readers both
+// trying to upgrade to writing. Readers are query only, to catch writes sent to the wrong pool.
+const (
+	writeOptions = "_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=10000&_txlock=immediate"
+	readOptions  = "_busy_timeout=10000&_query_only=true"
+)
+
+func dataSourceName(file, options string) string {
+	separator := "?"
+	if strings.Contains(file, "?") {
+		separator = "&"
+	}
+	return file + separator + options
+}
+
 func (s *Database) AugmentImages(images []Image) ([]Image, error) {
 	basedirs, err := s.GetAllBasedirAsMap()
 	if err != nil {
@@ -110,7 +177,7 @@ func (s *Database) AugmentImages(images []Image) ([]Image, error) {
 }
 
 func (s *Database) CreateBasedir(directory string) error {
-	_, err := s.con.Exec(`
+	_, err := s.wcon.Exec(`
 	INSERT INTO basedir 
 		   (directory) 
 	VALUES (?)`, directory)
@@ -136,41 +203,194 @@ func (s *Database) GetAllBasedirAsMap() (map[int64]string, error) {
 }
 
 func (s *Database) DeleteBasedir(id int64) error {
-	_, err1 := s.con.Exec(`DELETE FROM basedir WHERE rowid = ?`, id)
+	_, err1 := s.wcon.Exec(`DELETE FROM basedir WHERE rowid = ?`, id)
 	err2 := s.DeleteImagesByBasedirID(id)
 	return errors.Join(err1, err2)
 }
 
-// removes images and associated embeddings by basedir_id
-func (s *Database) DeleteImagesByBasedirID(id int64) error {
-	_, err1 := s.con.Exec(`
-	DELETE FROM embeddings 
-	WHERE rowid IN 
-		(SELECT rowid FROM images WHERE basedir_id = ?)`, id)
+// a summary of the database's contents
+type Stats struct {
+	SchemaVersion int            `json:"schema_version"`
+	Images        int64          `json:"images"`
+	Tags          int64          `json:"tags"`                   // distinct tags
+	ActiveModel   string         `json:"active_model,omitempty"` // the model searched, if there is one yet
+	Basedirs      []BasedirStats `json:"basedirs"`
+	Models        []ModelStats   `json:"models"`
+}
 
-	_, err2 := s.con.Exec(`
+type BasedirStats struct {
+	ID        int64  `db:"rowid" json:"id"`
+	Directory string `db:"directory" json:"directory"`
+	Images    int64  `db:"images" json:"images"`
+}
+
+type ModelStats struct {
+	ModelID      string `db:"model_id" json:"model_id"`
+	Dimension    int    `db:"dimension" json:"dimension"`
+	Quantization string `db:"quantization" json:"quantization"`
+	Embeddings   int64  `db:"embeddings" json:"embeddings"`
+}
+
+func (s *Database) Stats() (Stats, error) {
+	stats := Stats{Basedirs: make([]BasedirStats, 0), Models: make([]ModelStats, 0)}
+	var err error
+	stats.SchemaVersion, err = s.SchemaVersion()
+	if err != nil {
+		return stats, err
+	}
+	err = s.con.Get(&stats.Images, `SELECT count(*) FROM images`)
+	if err != nil {
+		return stats, err
+	}
+	err = s.con.Get(&stats.Tags, `SELECT count(DISTINCT tag) FROM tags`)
+	if err != nil {
+		return stats, err
+	}
+	err = s.con.Get(&stats.ActiveModel, `SELECT value FROM settings WHERE key = 'active_model'`)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return stats, err
+	}
+	err = s.con.Select(&stats.Basedirs, `
+	SELECT rowid, directory, (SELECT count(*) FROM images WHERE basedir_id = basedir.rowid) AS images
+	FROM basedir ORDER BY rowid`)
+	if err != nil {
+		return stats, err
+	}
+	err = s.con.Select(&stats.Models, `
+	SELECT model_id, dimension, quantization,
+		(SELECT count(*) FROM image_embeddings WHERE model_id = models.rowid) AS embeddings
+	FROM models ORDER BY rowid`)
+	return stats, err
+}
+
+// removes images and associated embeddings (from every model) by basedir_id
+// nb: embeddings are deleted by the images_delete_embeddings trigger
+func (s *Database) DeleteImagesByBasedirID(id int64) error {
+	indexes := s.loadedANNIndexes()
+	ids := make([]int64, 0)
+	if len(indexes) > 0 {
+		err := s.con.Select(&ids, `SELECT rowid FROM images WHERE basedir_id = ?`, id)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := s.wcon.Exec(`
 	DELETE FROM images 
 		WHERE images.basedir_id = ?`, id)
-	return errors.Join(err1, err2)
+	if err != nil {
+		return err
+	}
+	for _, idx := range indexes {
+		for _, imgID := range ids {
+			idx.delete(imgID)
+		}
+	}
+	return nil
 }
 
-// creates or updates embedding for specified Image.
+// creates or updates the model's embedding for specified Image.
 // img.ID must be correct.
-// todo: vec_quantize_float16 when it works.
-func (s *Database) CreateUpdateEmbedding(imgID int64, emb []float32) error {
+// a coarse copy is stored too if the model is quantized.
+func (s *Database) CreateUpdateEmbedding(model Model, imgID int64, emb []float32) error {
+	tx, err := s.wcon.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := createUpdateEmbedding(tx, model, imgID, emb); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if idx := s.loadedANNIndex(model); idx != nil {
+		var basedirID int64
+		err = s.con.Get(&basedirID, `SELECT basedir_id FROM images WHERE rowid = ?`, imgID)
+		if err != nil {
+			return err
+		}
+		idx.add(imgID, basedirID, emb)
+	}
+	return nil
+}
+
+func createUpdateEmbedding(ex sqlx.Execer, model Model, imgID int64, emb []float32) error {
+	if len(emb) != model.Dimension {
+		return fmt.Errorf("embedding has dimension %d, but model %s has %d", len(emb), model.ModelID, model.Dimension)
+	}
 	embedding, err := sqlite_vec.SerializeFloat32(emb)
 	if err != nil {
 		return err
 	}
-	_, err = s.con.Exec(`
-	INSERT OR REPLACE INTO embeddings 
-		   (rowid, embedding) 
-	VALUES (?, ?)`, imgID, embedding)
+	_, err = ex.Exec(`
+	INSERT OR REPLACE INTO image_embeddings
+		   (image_id, model_id, embedding)
+	VALUES (?, ?, ?)`, imgID, model.ID, embedding)
+	if err != nil {
+		return err
+	}
+	if coarse := quantize(model.Quantization, emb); coarse != nil {
+		_, err = ex.Exec(`
+		INSERT OR REPLACE INTO image_embeddings_coarse
+			   (image_id, model_id, embedding)
+		VALUES (?, ?, ?)`, imgID, model.ID, coarse)
+	}
+	return err
+}
+
+// an image and its embedding, to be written together
+type IndexedImage struct {
+	Image     Image
+	Model     Model
+	Embedding []float32
+}
+
+// creates or updates the images and their embeddings in a single transaction,
+// so either all of them are written or none are.
+// new images have their ID set. nb: errors don't say which image failed, see batchWriter.
+func (s *Database) WriteIndexedImages(batch []IndexedImage) error {
+	tx, err := s.wcon.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i := range batch {
+		id, err := s.createUpdateImage(tx, &batch[i].Image)
+		if err != nil {
+			return fmt.Errorf("error adding image to database: %w", err)
+		}
+		err = createUpdateEmbedding(tx, batch[i].Model, id, batch[i].Embedding)
+		if err != nil {
+			return fmt.Errorf("error adding image's embedding to database: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, ii := range batch {
+		if idx := s.loadedANNIndex(ii.Model); idx != nil {
+			idx.add(ii.Image.ID, ii.Image.BasedirID, ii.Embedding)
+		}
+	}
+	return nil
+}
+
+// reports whether the image has an embedding from the model stored
+func (s *Database) HasEmbedding(model Model, imgID int64) (bool, error) {
+	var count int
+	err := s.con.Get(&count, `
+	SELECT count(*) FROM image_embeddings
+	WHERE model_id = ? AND image_id = ?`, model.ID, imgID)
+	return count > 0, err
+}
+
+func (s *Database) UpdateModTime(imgID int64, mtime int64) error {
+	_, err := s.wcon.Exec(`UPDATE images SET mtime = ? WHERE rowid = ?`, mtime, imgID)
 	return err
 }
 
 func (s *Database) UpdateAesthetic(imgID int64, aesthetic float32) error {
-	_, err := s.con.Exec(`
+	_, err := s.wcon.Exec(`
 	UPDATE images SET aesthetic = ?
 	WHERE rowid = ?`, aesthetic, imgID)
 	return err
@@ -181,13 +401,17 @@ func (s *Database) UpdateAesthetic(imgID int64, aesthetic float32) error {
 // (this is fine as SQLite rowids start at 1)
 // Returns the ID of the image chosen by the database.
 func (s *Database) CreateUpdateImage(img *Image) (int64, error) {
+	return s.createUpdateImage(s.wcon, img)
+}
+
+func (s *Database) createUpdateImage(ex sqlx.Ext, img *Image) (int64, error) {
 	var err error
 	if img.ID > 0 {
-		_, err = s.con.NamedExec(`
+		_, err = sqlx.NamedExec(ex, `
 			INSERT OR REPLACE INTO images `+s.insertIntoImageTableSQL, img)
 		return img.ID, err
 	} else {
-		result, err := s.con.NamedExec(`
+		result, err := sqlx.NamedExec(ex, `
 			INSERT INTO images `+s.insertIntoImageTableSQLNoID, img)
 		if err != nil {
 			return 0, err
@@ -207,7 +431,10 @@ func (s *Database) ReadImages(qf QueryFilter, so SortOrder) ([]Image, error) {
 	if len(qf.BaseDirs) == 0 {
 		return nil, fmt.Errorf("no basedirs specified in query")
 	}
-	where, err := s.whereClauseGenerator(qf)
+	if so == OrderByHybrid {
+		return s.readImagesHybrid(qf)
+	}
+	where, qf, err := s.where(qf)
 	if err != nil {
 		return nil, err
 	}
@@ -251,7 +478,7 @@ func (s *Database) scanAllRows(rows *sqlx.Rows) ([]Image, error) {
 
 // Finds the image entry in the database with the given path. (exact match)
 // May return multiple results for archives if subSearch isn't specified
-// TODO: fts5 version
+// see QueryFilter.PathKeywords for searching paths
 func (s *Database) MatchImagesByPath(parent_path, sub_path string, basedirID int64, limit, offset int) ([]Image, error) {
 	imgs := make([]Image, 0)
 	var err error
@@ -276,16 +503,56 @@ func (s *Database) MatchImagesByPath(parent_path, sub_path string, basedirID int
 	return imgs, err
 }
 
+// reads the image's embedding from the active model
 func (s *Database) ReadEmbedding(imageRowID int64) ([]byte, error) {
+	model, err := s.ActiveModel()
+	if err != nil {
+		return nil, err
+	}
 	emb := make([]byte, 0)
-	queryString := "SELECT embedding FROM embeddings WHERE rowid = ?"
-	rows, err := s.con.Queryx(queryString, imageRowID)
+	queryString := "SELECT embedding FROM image_embeddings WHERE model_id = ? AND image_id = ?"
+	rows, err := s.con.Queryx(queryString, model.ID, imageRowID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 	for rows.Next() {
 		err = rows.Scan(&emb)
 	}
+	if err == nil && len(emb) == 0 {
+		err = fmt.Errorf("image %d has no embedding from %s", imageRowID, model.ModelID)
+	}
 	return emb, err
 }
 
+// an image's vector, as stored
+type StoredEmbedding struct {
+	ImageID   int64  `db:"image_id"`
+	Embedding []byte `db:"embedding"`
+}
+
+// reads the model's vectors a page at a time, in image id order.
+// pass the last image id of the previous page as afterID, or 0 to start.
+func (s *Database) ReadEmbeddingsPage(model Model, afterID int64, limit int) ([]StoredEmbedding, error) {
+	page := make([]StoredEmbedding, 0, limit)
+	err := s.con.Select(&page, `
+	SELECT image_id, embedding FROM image_embeddings
+	WHERE model_id = ? AND image_id > ?
+	ORDER BY image_id
+	LIMIT ?`, model.ID, afterID, limit)
+	return page, err
+}
+
+// counts the images with a vector from the model
+func (s *Database) CountEmbeddings(model Model) (int64, error) {
+	var count int64
+	err := s.con.Get(&count, `SELECT count(*) FROM image_embeddings WHERE model_id = ?`, model.ID)
+	return count, err
+}
+
+// searches the embeddings of the active model, setting each image's Distance.
+// if the model is quantized, candidates are found by comparing the coarse copies, then ranked exactly.
+// with qf.MaxDistance, only images closer than it are returned, still no more than qf.Limit. see CountEmbeddingsWithin.
 // nb: target can be produced from sqlite_vec.SerializeFloat32
 func (s *Database) MatchEmbeddingsWithFilter(target []byte, qf QueryFilter) ([]Image, error) {
 	if qf.Limit <= 0 {
@@ -294,60 +561,218 @@ func (s *Database) MatchEmbeddingsWithFilter(target []byte, qf QueryFilter) ([]I
 	if len(qf.BaseDirs) == 0 {
 		return nil, fmt.Errorf("no basedirs specified in query")
 	}
-
-	// Generate WHERE clause for query filter
-	where, err := s.whereClauseGenerator(qf)
+	if qf.Diversity > 0 {
+		return s.matchEmbeddingsDiverse(target, qf)
+	}
+	model, err := s.ActiveModel()
 	if err != nil {
 		return nil, err
 	}
+	if s.annEfSearch > 0 {
+		return s.matchEmbeddingsANN(model, target, qf)
+	}
+	return s.matchEmbeddingsExhaustive(model, target, qf)
+}
+
+// compares the target against every vector of the model, or every coarse copy if it's quantized
+func (s *Database) matchEmbeddingsExhaustive(model Model, target []byte, qf QueryFilter) ([]Image, error) {
+	if model.Quantization != QuantizationNone {
+		return s.matchEmbeddingsCoarse(model, target, qf)
+	}
 
 	// Build the query
-	// CTEs because joins on vector table aren't possible.
+	// vectors are normalised, so L2 distance ranks the same as cosine.
+	within := ""
+	args := []any{target, model.ID}
+	if qf.MaxDistance.Valid {
+		within = ` AND distance <= ?`
+		args = append(args, qf.MaxDistance.Float64)
+	}
 	queryString := `
-		WITH filtered_images AS (
-			SELECT rowid
-			FROM images
-			WHERE ` + where + `
-		),
-		filtered AS (
-			SELECT rowid, distance 
-			FROM embeddings
-			WHERE embedding MATCH ? AND k = ? AND rowid IN (select rowid FROM filtered_images)
-		)
-		SELECT images.rowid, images.*
-		FROM images, filtered
-		WHERE images.rowid = filtered.rowid
-		ORDER BY distance ASC`
-
-	// Prepare named query
-	namedQuery, args, err := sqlx.Named(queryString, qf)
+		SELECT images.rowid, images.*, vec_distance_l2(image_embeddings.embedding, ?) AS distance
+		FROM images
+		JOIN image_embeddings ON image_embeddings.image_id = images.rowid
+		WHERE %s AND image_embeddings.model_id = ?` + within + `
+		ORDER BY distance ASC
+		LIMIT ? OFFSET ?`
+
+	images := make([]Image, 0)
+	err := s.selectFiltered(&images, queryString, qf, append(args, qf.Limit, qf.Offset)...)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to match embeddings with filter: %w", err)
 	}
+	return images, nil
+}
 
-	// Insert the embedding and limit parameters at the beginning
-	//args = append([]interface{}{target, qf.Limit}, args...)
-	args = append(args, target, qf.Limit)
+// counts the images of the active model within qf.MaxDistance of the target, regardless of qf's Limit and Offset.
+// nb: this compares against every vector, as an index can't say how many are near.
+func (s *Database) CountEmbeddingsWithin(target []byte, qf QueryFilter) (int, error) {
+	model, err := s.ActiveModel()
+	if err != nil {
+		return 0, err
+	}
+	counts := make([]int, 0, 1)
+	err = s.selectFiltered(&counts, `
+		SELECT count(*) FROM images
+		JOIN image_embeddings ON image_embeddings.image_id = images.rowid
+		WHERE %s AND image_embeddings.model_id = ? AND vec_distance_l2(image_embeddings.embedding, ?) <= ?`,
+		qf, model.ID, target, qf.maxDistance())
+	if err != nil {
+		return 0, fmt.Errorf("failed to count embeddings with filter: %w", err)
+	}
+	return counts[0], nil
+}
 
-	// Handle IN clauses if needed
-	namedQuery, args, err = sqlx.In(namedQuery, args...)
+// the coarse pass fetches rerankFactor times the results needed by comparing quantized vectors,
+// which are then ranked by their full vectors.
+func (s *Database) matchEmbeddingsCoarse(model Model, target []byte, qf QueryFilter) ([]Image, error) {
+	targetVec := vecmath.DecodeFloat32(target)
+	var distance string
+	switch model.Quantization {
+	case QuantizationInt8:
+		distance = `vec_distance_l2(vec_int8(image_embeddings_coarse.embedding), vec_int8(?))`
+	case QuantizationBinary:
+		distance = `vec_distance_hamming(vec_bit(image_embeddings_coarse.embedding), vec_bit(?))`
+	default:
+		return nil, fmt.Errorf("unknown quantization %q", model.Quantization)
+	}
+	// nb: only ids go through the sort, the full vectors are fetched for the candidates afterwards.
+	queryString := `
+		SELECT image_embeddings_coarse.image_id
+		FROM images
+		JOIN image_embeddings_coarse ON image_embeddings_coarse.image_id = images.rowid
+		WHERE %s AND image_embeddings_coarse.model_id = ?
+		ORDER BY ` + distance + ` ASC
+		LIMIT ?`
+	candidateIDs := make([]int64, 0)
+	err := s.selectFiltered(&candidateIDs, queryString, qf,
+		model.ID, quantize(model.Quantization, targetVec), (qf.Offset+qf.Limit)*rerankFactor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to match embeddings with filter: %w", err)
+	}
+
+	type candidate struct {
+		ImageID   int64  `db:"image_id"`
+		Embedding []byte `db:"embedding"`
+		distance  float32
+	}
+	candidates := make([]candidate, 0, len(candidateIDs))
+	if len(candidateIDs) > 0 {
+		query, args, err := sqlx.In(`
+		SELECT image_id, embedding FROM image_embeddings
+		WHERE model_id = ? AND image_id IN (?)`, model.ID, candidateIDs)
+		if err != nil {
+			return nil, err
+		}
+		err = s.con.Select(&candidates, s.con.Rebind(query), args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := range candidates {
+		candidates[i].distance = vecmath.L2Squared(vecmath.DecodeFloat32(candidates[i].Embedding), targetVec)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].distance < candidates[j].distance })
+	maxDistance := qf.maxDistance()
+	candidates = slices.DeleteFunc(candidates, func(c candidate) bool {
+		return math.Sqrt(float64(c.distance)) > maxDistance
+	})
+	if qf.Offset >= len(candidates) {
+		return make([]Image, 0), nil
+	}
+	candidates = candidates[qf.Offset:min(qf.Offset+qf.Limit, len(candidates))]
+
+	ids := make([]int64, len(candidates))
+	distances := make(map[int64]float32, len(candidates))
+	for i, c := range candidates {
+		ids[i] = c.ImageID
+		distances[c.ImageID] = c.distance
+	}
+	found, err := s.ReadImagesByID(ids)
 	if err != nil {
 		return nil, err
 	}
+	return withDistances(orderImagesByID(found, ids), distances), nil
+}
 
-	// Rebind for the specific database dialect
-	namedQuery = s.con.Rebind(namedQuery)
+// sets the images' Distance from their squared distances
+func withDistances(imgs []Image, squared map[int64]float32) []Image {
+	for i, img := range imgs {
+		if d, ok := squared[img.ID]; ok {
+			imgs[i].Distance = sql.NullFloat64{Float64: math.Sqrt(float64(d)), Valid: true}
+		}
+	}
+	return imgs
+}
 
-	// Execute query
-	images := make([]Image, 0)
-	err = s.con.Select(&images, namedQuery, args...)
+// the greatest distance of a match, for queries without a maximum too
+func (qf QueryFilter) maxDistance() float64 {
+	if qf.MaxDistance.Valid {
+		return qf.MaxDistance.Float64
+	}
+	return math.MaxFloat64
+}
+
+// reads the images with the given ids, in no particular order
+func (s *Database) ReadImagesByID(ids []int64) ([]Image, error) {
+	images := make([]Image, 0, len(ids))
+	if len(ids) == 0 {
+		return images, nil
+	}
+	query, args, err := sqlx.In(`SELECT rowid,* FROM images WHERE rowid IN (?)`, ids)
 	if err != nil {
-		return nil, fmt.Errorf("failed to match embeddings with filter: %w", err)
+		return nil, err
 	}
+	err = s.con.Select(&images, s.con.Rebind(query), args...)
+	return images, err
+}
 
-	return images, nil
+// runs queryString, a query whose %s is replaced with qf's WHERE clause, into dest.
+// args are the query's positional parameters in order, placed either side of the named parameters qf provides
+// by counting the ?s before the %s.
+func (s *Database) selectFiltered(dest any, queryString string, qf QueryFilter, args ...any) error {
+	where, qf, err := s.where(qf)
+	if err != nil {
+		return err
+	}
+	namedQuery, namedArgs, err := sqlx.Named(fmt.Sprintf(queryString, where), qf)
+	if err != nil {
+		return err
+	}
+	leading := min(strings.Count(queryString[:max(strings.Index(queryString, "%s"), 0)], "?"), len(args))
+	allArgs := slices.Concat(args[:leading], namedArgs, args[leading:])
+	namedQuery, namedArgs, err = sqlx.In(namedQuery, allArgs...)
+	if err != nil {
+		return err
+	}
+	return s.con.Select(dest, s.con.Rebind(namedQuery), namedArgs...)
 }
 
+// qf's WHERE clause (without the WHERE), and qf as it should be bound to the clause's named parameters.
+// tag and path keyword filters are handled here, as they're subqueries rather than conditions on images' columns.
+func (s *Database) where(qf QueryFilter) (string, QueryFilter, error) {
+	where, err := s.whereClauseGenerator(qf)
+	if err != nil {
+		return "", qf, err
+	}
+	qf.TagsAny, qf.TagsAll, qf.TagsNone = normalizeTags(qf.TagsAny), normalizeTags(qf.TagsAll), normalizeTags(qf.TagsNone)
+	qf.PathMatch = pathMatchQuery(qf.PathKeywords, qf.Keywords)
+	qf.PathExclude = pathExcludeQuery(qf.PathKeywordsNone)
+	if (len(qf.PathMatch) > 0 || len(qf.PathExclude) > 0) && !s.pathSearch {
+		return "", qf, errNoPathIndex
+	}
+	conditions := append(tagConditions(qf), pathConditions(qf)...)
+	if len(where) > 0 {
+		conditions = append([]string{where}, conditions...)
+	}
+	return strings.Join(conditions, " AND "), qf, nil
+}
+
+// nb: also saves any changes to the database's ANN indexes
 func (s *Database) Close() error {
-	return s.con.Close()
+	err := errors.Join(s.SaveANNIndexes(), s.con.Close())
+	if s.wcon != s.con {
+		err = errors.Join(err, s.wcon.Close())
+	}
+	return err
 }
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/crimro-se/imagedb/pkg/hnsw"
+	"github.com/crimro-se/imagedb/pkg/vecmath"
+	"github.com/jmoiron/sqlx"
+)
+
+// an approximate nearest neighbour index of one model's vectors, shared by every connection to the database.
+// it's kept in step with image_embeddings while loaded, and reconciled with it when loaded.
+type annIndex struct {
+	graph *hnsw.Graph
+	path  string // where it's saved, empty for in-memory databases
+
+	// held while the index is loaded, so only those using this model wait for it
+	loading sync.Mutex
+	err     error // why it failed to load, it's unusable if set
+
+	mu       sync.RWMutex
+	basedirs map[int64]int64 // image id -> basedir id, for filtering searches
+	dirty    bool            // changed since it was saved
+}
+
+// loaded indexes, and those being loaded, keyed by annKey
+var annIndexes = struct {
+	sync.Mutex
+	m map[string]*annIndex
+}{m: make(map[string]*annIndex)}
+
+// nb: scope is the database file, except for in-memory databases which are each their own
+func annKey(scope string, model Model) string {
+	return fmt.Sprintf("%s#%d", scope, model.ID)
+}
+
+// searches use the index when efSearch > 0, higher is more accurate but slower.
+// otherwise they compare against every vector.
+func (s *Database) UseANN(efSearch int) {
+	s.annEfSearch = efSearch
+}
+
+// the model's index if it's loaded, otherwise nil. waits for it if it's being loaded.
+func (s *Database) loadedANNIndex(model Model) *annIndex {
+	annIndexes.Lock()
+	idx := annIndexes.m[annKey(s.annScope, model)]
+	annIndexes.Unlock()
+	if idx == nil || idx.wait() != nil {
+		return nil
+	}
+	return idx
+}
+
+// waits until the index has finished loading, returning why it failed to
+func (idx *annIndex) wait() error {
+	idx.loading.Lock()
+	defer idx.loading.Unlock()
+	return idx.err
+}
+
+// the model's index, loading it from disk (or building it) if needed.
+func (s *Database) annIndexFor(model Model) (*annIndex, error) {
+	key := annKey(s.annScope, model)
+	annIndexes.Lock()
+	idx, ok := annIndexes.m[key]
+	if !ok {
+		idx = &annIndex{basedirs: make(map[int64]int64)}
+		idx.loading.Lock()
+		annIndexes.m[key] = idx
+	}
+	annIndexes.Unlock()
+	if ok {
+		if err := idx.wait(); err != nil {
+			return nil, err
+		}
+		return idx, nil
+	}
+
+	defer idx.loading.Unlock()
+	if idx.err = s.loadANNIndex(idx, model); idx.err != nil {
+		// nb: forgotten, so the next search tries again
+		annIndexes.Lock()
+		delete(annIndexes.m, key)
+		annIndexes.Unlock()
+		return nil, idx.err
+	}
+	return idx, nil
+}
+
+// reads the index saved beside the database, or starts an empty one, and reconciles it
+func (s *Database) loadANNIndex(idx *annIndex, model Model) error {
+	if len(s.file) > 0 && s.file != ":memory:" {
+		idx.path = fmt.Sprintf("%s.model%d.hnsw", s.file, model.ID)
+	}
+	if len(idx.path) > 0 {
+		file, err := os.Open(idx.path)
+		if err == nil {
+			var info fs.FileInfo
+			if info, err = file.Stat(); err == nil {
+				idx.graph, err = hnsw.Load(file, info.Size(), model.Dimension)
+			}
+			file.Close()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "rebuilding search index, failed to load", idx.path, err)
+			}
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if idx.graph == nil {
+		idx.graph = hnsw.New(model.Dimension)
+	}
+	return s.reconcileANNIndex(idx, model)
+}
+
+// brings a freshly loaded index in line with the database: adding vectors it's missing,
+// and removing those no longer in the database.
+func (s *Database) reconcileANNIndex(idx *annIndex, model Model) error {
+	type row struct {
+		ImageID   int64 `db:"image_id"`
+		BasedirID int64 `db:"basedir_id"`
+	}
+	rows := make([]row, 0)
+	err := s.con.Select(&rows, `
+	SELECT image_embeddings.image_id, images.basedir_id
+	FROM image_embeddings
+	JOIN images ON images.rowid = image_embeddings.image_id
+	WHERE image_embeddings.model_id = ?`, model.ID)
+	if err != nil {
+		return err
+	}
+	missing := make([]int64, 0)
+	for _, r := range rows {
+		idx.basedirs[r.ImageID] = r.BasedirID
+		if !idx.graph.Contains(r.ImageID) {
+			missing = append(missing, r.ImageID)
+		}
+	}
+	for _, id := range idx.graph.IDs() {
+		if _, ok := idx.basedirs[id]; !ok {
+			idx.graph.Delete(id)
+			idx.dirty = true
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(os.Stderr, "adding %d images to the search index for %s\n", len(missing), model.ModelID)
+		idx.dirty = true
+	}
+	for start := 0; start < len(missing); start += 1000 {
+		page := missing[start:min(start+1000, len(missing))]
+		query, args, err := sqlx.In(`
+		SELECT image_id, embedding FROM image_embeddings
+		WHERE model_id = ? AND image_id IN (?)`, model.ID, page)
+		if err != nil {
+			return err
+		}
+		embeddings := make([]struct {
+			ImageID   int64  `db:"image_id"`
+			Embedding []byte `db:"embedding"`
+		}, 0, len(page))
+		err = s.con.Select(&embeddings, s.con.Rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		for _, e := range embeddings {
+			idx.graph.Add(e.ImageID, vecmath.DecodeFloat32(e.Embedding))
+		}
+	}
+	return nil
+}
+
+func (idx *annIndex) add(imgID, basedirID int64, vec []float32) {
+	idx.graph.Add(imgID, vec)
+	idx.mu.Lock()
+	idx.basedirs[imgID] = basedirID
+	idx.dirty = true
+	idx.mu.Unlock()
+}
+
+func (idx *annIndex) delete(imgID int64) {
+	idx.graph.Delete(imgID)
+	idx.mu.Lock()
+	delete(idx.basedirs, imgID)
+	idx.dirty = true
+	idx.mu.Unlock()
+}
+
+// the k nearest images within the basedirs
+func (idx *annIndex) search(vec []float32, k, ef int, basedirs []int64) []hnsw.Result {
+	allowed := make(map[int64]bool, len(basedirs))
+	for _, b := range basedirs {
+		allowed[b] = true
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.graph.Search(vec, k, ef, func(id int64) bool {
+		return allowed[idx.basedirs[id]]
+	})
+}
+
+// writes the index next to the database if it's changed, via a temporary file so a crash can't corrupt it.
+func (idx *annIndex) save() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if !idx.dirty || len(idx.path) == 0 {
+		return nil
+	}
+	tmp := idx.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = idx.graph.Save(file)
+	err = errors.Join(err, file.Close())
+	if err == nil {
+		err = os.Rename(tmp, idx.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	idx.dirty = false
+	return nil
+}
+
+// saves this database's changed indexes
+func (s *Database) SaveANNIndexes() error {
+	errs := make([]error, 0)
+	for _, idx := range s.loadedANNIndexes() {
+		errs = append(errs, idx.save())
+	}
+	return errors.Join(errs...)
+}
+
+// the loaded indexes of this database, for keeping in step with deletes
+func (s *Database) loadedANNIndexes() []*annIndex {
+	annIndexes.Lock()
+	prefix := s.annScope + "#"
+	indexes := make([]*annIndex, 0)
+	for key, idx := range annIndexes.m {
+		if strings.HasPrefix(key, prefix) {
+			indexes = append(indexes, idx)
+		}
+	}
+	annIndexes.Unlock()
+	loaded := make([]*annIndex, 0, len(indexes))
+	for _, idx := range indexes {
+		if idx.wait() == nil {
+			loaded = append(loaded, idx)
+		}
+	}
+	return loaded
+}
+
+// the most neighbours an index search is widened to. past this, a filter passes so few images
+// that comparing against every vector is the quicker way to find them.
+const maxANNCandidates = 4096
+
+// nearest neighbour search via the index. images filtered out by qf's other criteria are only found
+// to be so after searching, so the search widens until enough images pass or the index is exhausted.
+func (s *Database) matchEmbeddingsANN(model Model, target []byte, qf QueryFilter) ([]Image, error) {
+	idx, err := s.annIndexFor(model)
+	if err != nil {
+		return nil, err
+	}
+	targetVec := vecmath.DecodeFloat32(target)
+	need := qf.Offset + qf.Limit
+	for k := need; ; k *= 4 {
+		if k > maxANNCandidates {
+			return s.matchEmbeddingsExhaustive(model, target, qf)
+		}
+		results := idx.search(targetVec, k, max(s.annEfSearch, k), qf.BaseDirs)
+		exhausted := len(results) < k
+		// results are nearest first, so once one is too far there are no more to find
+		maxDistance := qf.maxDistance()
+		if i := slices.IndexFunc(results, func(r hnsw.Result) bool {
+			return math.Sqrt(float64(r.Distance)) > maxDistance
+		}); i >= 0 {
+			results, exhausted = results[:i], true
+		}
+		ids := make([]int64, len(results))
+		distances := make(map[int64]float32, len(results))
+		for i, r := range results {
+			ids[i] = r.ID
+			distances[r.ID] = r.Distance
+		}
+		found := make([]Image, 0, len(ids))
+		for start := 0; start < len(ids); start += 1000 {
+			page := make([]Image, 0)
+			err = s.selectFiltered(&page, `SELECT rowid,* FROM images WHERE %s AND rowid IN (?)`,
+				qf, ids[start:min(start+1000, len(ids))])
+			if err != nil {
+				return nil, fmt.Errorf("failed to match embeddings with filter: %w", err)
+			}
+			found = append(found, page...)
+		}
+		images := withDistances(orderImagesByID(found, ids), distances)
+		if len(images) >= need || exhausted {
+			if qf.Offset >= len(images) {
+				return make([]Image, 0), nil
+			}
+			return images[qf.Offset:min(need, len(images))], nil
+		}
+	}
+}
+
+// images sorted into the order of ids. ids without an image are skipped.
+func orderImagesByID(images []Image, ids []int64) []Image {
+	byID := make(map[int64]Image, len(images))
+	for _, img := range images {
+		byID[img.ID] = img
+	}
+	ordered := make([]Image, 0, len(ids))
+	for _, id := range ids {
+		if img, ok := byID[id]; ok {
+			ordered = append(ordered, img)
+		}
+	}
+	return ordered
+}
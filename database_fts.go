@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// path search uses an FTS5 table over images' paths and tags. SQLite only has FTS5 when imagedb is built with
+// -tags sqlite_fts5, so unlike the rest of the schema it's managed here rather than by a migration:
+// created and filled by builds that have FTS5, and left alone (with its triggers dropped) by builds that don't,
+// as the triggers would otherwise make every change to images fail. It's rebuilt once FTS5 is available again.
+
+// the index's table, the triggers keeping it in sync, and a query to fill it from scratch
+const (
+	createPathIndexSQL = `
+CREATE VIRTUAL TABLE IF NOT EXISTS images_fts USING fts5 (
+  parent_path, sub_path,
+  basedir,                        -- basedir.directory
+  tags,                           -- the image's tags, space separated
+  tokenize = 'unicode61 remove_diacritics 2'
+);`
+	// nb: images_fts.rowid is images.rowid. INSERT OR REPLACE into images only fires the insert trigger.
+	pathIndexTriggersSQL = `
+CREATE TRIGGER IF NOT EXISTS images_fts_insert AFTER INSERT ON images
+BEGIN
+  INSERT OR REPLACE INTO images_fts (rowid, parent_path, sub_path, basedir, tags)
+  VALUES (NEW.rowid, NEW.parent_path, NEW.sub_path,
+    (SELECT directory FROM basedir WHERE rowid = NEW.basedir_id),
+    (SELECT group_concat(tag, ' ') FROM tags WHERE image_id = NEW.rowid));
+END;
+CREATE TRIGGER IF NOT EXISTS images_fts_update AFTER UPDATE OF parent_path, sub_path, basedir_id ON images
+BEGIN
+  UPDATE images_fts SET parent_path = NEW.parent_path, sub_path = NEW.sub_path,
+    basedir = (SELECT directory FROM basedir WHERE rowid = NEW.basedir_id)
+  WHERE rowid = NEW.rowid;
+END;
+CREATE TRIGGER IF NOT EXISTS images_fts_delete AFTER DELETE ON images
+BEGIN
+  DELETE FROM images_fts WHERE rowid = OLD.rowid;
+END;
+CREATE TRIGGER IF NOT EXISTS tags_fts_insert AFTER INSERT ON tags
+BEGIN
+  UPDATE images_fts SET tags = (SELECT group_concat(tag, ' ') FROM tags WHERE image_id = NEW.image_id)
+  WHERE rowid = NEW.image_id;
+END;
+CREATE TRIGGER IF NOT EXISTS tags_fts_delete AFTER DELETE ON tags
+BEGIN
+  UPDATE images_fts SET tags = (SELECT group_concat(tag, ' ') FROM tags WHERE image_id = OLD.image_id)
+  WHERE rowid = OLD.image_id;
+END;`
+	rebuildPathIndexSQL = `
+DELETE FROM images_fts;
+INSERT INTO images_fts (rowid, parent_path, sub_path, basedir, tags)
+SELECT images.rowid, images.parent_path, images.sub_path, basedir.directory,
+  (SELECT group_concat(tag, ' ') FROM tags WHERE image_id = images.rowid)
+FROM images LEFT JOIN basedir ON basedir.rowid = images.basedir_id;`
+)
+
+var pathIndexTriggers = []string{"images_fts_insert", "images_fts_update", "images_fts_delete", "tags_fts_insert", "tags_fts_delete"}
+
+// the columns path keywords are matched against
+const pathColumns = "{parent_path sub_path basedir}"
+
+// reports whether this build's SQLite has FTS5
+func (s *Database) hasFTS5() (bool, error) {
+	var enabled bool
+	err := s.wcon.Get(&enabled, `SELECT sqlite_compileoption_used('ENABLE_FTS5')`)
+	return enabled, err
+}
+
+// brings the path search index up to date if this build has FTS5, otherwise stops maintaining it.
+// nb: its triggers exist exactly when it's being kept in sync, so their absence means it needs rebuilding.
+func (s *Database) ensurePathIndex() error {
+	enabled, err := s.hasFTS5()
+	if err != nil {
+		return err
+	}
+	var triggers int
+	err = s.wcon.Get(&triggers, `SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'images_fts_insert'`)
+	if err != nil {
+		return err
+	}
+	if enabled == (triggers > 0) {
+		return nil
+	}
+	tx, err := s.wcon.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if !enabled {
+		fmt.Fprintln(os.Stderr, "built without FTS5, path search is disabled until imagedb is built with -tags sqlite_fts5")
+		for _, trigger := range pathIndexTriggers {
+			if _, err := tx.Exec(`DROP TRIGGER IF EXISTS ` + trigger); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+	for _, query := range []string{createPathIndexSQL, rebuildPathIndexSQL, pathIndexTriggersSQL} {
+		if _, err := tx.Exec(query); err != nil {
+			return fmt.Errorf("failed to build the path search index: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// an FTS5 query matching images whose paths contain every path keyword and whose paths or tags
+// contain every other keyword, as words or the start of words.
+// keywords are quoted, so FTS5's query syntax in them is taken literally.
+func pathMatchQuery(pathKeywords, keywords []string) string {
+	terms := make([]string, 0, len(pathKeywords)+len(keywords))
+	for i, keyword := range append(pathKeywords, keywords...) {
+		keyword = strings.TrimSpace(keyword)
+		if len(keyword) == 0 {
+			continue
+		}
+		term := `"` + strings.ReplaceAll(keyword, `"`, `""`) + `"*`
+		if i < len(pathKeywords) {
+			term = pathColumns + " : " + term
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " AND ")
+}
+
+// an FTS5 query matching images whose paths contain any of the keywords, as words or the start of words
+func pathExcludeQuery(keywords []string) string {
+	terms := make([]string, 0, len(keywords))
+	for _, keyword := range keywords {
+		if term := pathMatchQuery([]string{keyword}, nil); len(term) > 0 {
+			terms = append(terms, term)
+		}
+	}
+	return strings.Join(terms, " OR ")
+}
+
+// the conditions for qf's keywords, to AND onto the WHERE clause. qf.PathMatch and PathExclude must have been set.
+func pathConditions(qf QueryFilter) []string {
+	conditions := make([]string, 0, 2)
+	if len(qf.PathMatch) > 0 {
+		conditions = append(conditions,
+			`images.rowid IN (SELECT rowid FROM images_fts WHERE images_fts MATCH :path_match)`)
+	}
+	if len(qf.PathExclude) > 0 {
+		conditions = append(conditions,
+			`images.rowid NOT IN (SELECT rowid FROM images_fts WHERE images_fts MATCH :path_exclude)`)
+	}
+	return conditions
+}
+
+var errNoPathIndex = errors.New("path search needs imagedb to be built with -tags sqlite_fts5")
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/crimro-se/imagedb/pkg/archivewalk"
+)
+
+// a request to index a basedir, see IndexQueue
+type IndexJob struct {
+	ID        int64  `db:"rowid" json:"id"`
+	BasedirID int64  `db:"basedir_id" json:"basedir"`
+	Directory string `db:"directory" json:"directory"` // the basedir's
+	Status    string `db:"status" json:"status"`       // JobQueued etc
+	Files     int64  `db:"files" json:"files"`         // found, including any that aren't images
+	Errors    int64  `db:"errors" json:"errors"`       // files that couldn't be indexed
+	Error     string `db:"error" json:"error,omitempty"`
+	Model     string `db:"model" json:"model,omitempty"` // searched with once done
+	Created   int64  `db:"created" json:"created"`       // unix times
+	Started   *int64 `db:"started" json:"started,omitempty"`
+	Finished  *int64 `db:"finished" json:"finished,omitempty"`
+
+	Progress *archivewalk.Progress `db:"-" json:"-"` // while running, not saved
+}
+
+// index job statuses
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobDone      = "done" // even if some files couldn't be indexed
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// whether the job is queued or running, rather than finished one way or another
+func (job IndexJob) Active() bool {
+	return job.Status == JobQueued || job.Status == JobRunning
+}
+
+const selectIndexJobs = `SELECT index_jobs.rowid, index_jobs.*, basedir.directory
+	FROM index_jobs JOIN basedir ON basedir.rowid = index_jobs.basedir_id`
+
+// queues a job for the basedir, unless it already has one queued or running, in which case that's returned
+func (s *Database) QueueIndexJob(basedirID int64) (IndexJob, error) {
+	_, err := s.wcon.Exec(`INSERT INTO index_jobs (basedir_id, created)
+		SELECT ?, ? WHERE NOT EXISTS
+			(SELECT 1 FROM index_jobs WHERE basedir_id = ? AND status IN ('queued', 'running'))`,
+		basedirID, time.Now().Unix(), basedirID)
+	if err != nil {
+		return IndexJob{}, err
+	}
+	var job IndexJob
+	err = s.wcon.Get(&job, selectIndexJobs+` WHERE basedir_id = ? AND status IN ('queued', 'running')`, basedirID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return job, errors.New("no such basedir")
+	}
+	return job, err
+}
+
+// every job, oldest first
+func (s *Database) ReadIndexJobs() ([]IndexJob, error) {
+	jobs := make([]IndexJob, 0)
+	err := s.con.Select(&jobs, selectIndexJobs+` ORDER BY index_jobs.rowid`)
+	return jobs, err
+}
+
+func (s *Database) ReadIndexJob(id int64) (IndexJob, error) {
+	var job IndexJob
+	err := s.con.Get(&job, selectIndexJobs+` WHERE index_jobs.rowid = ?`, id)
+	return job, err
+}
+
+// the oldest queued job, ok is false if there are none
+func (s *Database) NextIndexJob() (job IndexJob, ok bool, err error) {
+	err = s.wcon.Get(&job, selectIndexJobs+` WHERE status = 'queued' ORDER BY index_jobs.rowid LIMIT 1`)
+	if errors.Is(err, sql.ErrNoRows) {
+		return job, false, nil
+	}
+	return job, err == nil, err
+}
+
+// saves the job's status and progress
+func (s *Database) UpdateIndexJob(job IndexJob) error {
+	_, err := s.wcon.NamedExec(`UPDATE index_jobs SET status = :status, files = :files, errors = :errors,
+		error = :error, model = :model, started = :started, finished = :finished WHERE rowid = :rowid`, job)
+	return err
+}
+
+// puts jobs left running, by imagedb stopping mid-way, back in the queue
+func (s *Database) RequeueRunningIndexJobs() error {
+	_, err := s.wcon.Exec(`UPDATE index_jobs SET status = 'queued' WHERE status = 'running'`)
+	return err
+}
+
+// deletes the jobs that have finished, one way or another
+func (s *Database) ClearFinishedIndexJobs() error {
+	_, err := s.wcon.Exec(`DELETE FROM index_jobs WHERE status NOT IN ('queued', 'running')`)
+	return err
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Go code run as part of a migration, after its SQL, in the same transaction.
+// keyed by migration version.
+var migrationHooks = map[int]func(tx *sqlx.Tx) error{
+	3: moveVec0Embeddings,
+}
+
+type migration struct {
+	version int
+	name    string // file name
+	sql     string
+}
+
+// the embedded migrations, in order. panics if they're misnamed, as that's a build mistake.
+func loadMigrations() []migration {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		panic(err)
+	}
+	migrations := make([]migration, 0, len(entries))
+	for _, entry := range entries {
+		prefix, _, _ := strings.Cut(entry.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			panic(fmt.Sprintf("migration %s isn't named NNNN_description.sql", entry.Name()))
+		}
+		content, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			panic(err)
+		}
+		migrations = append(migrations, migration{version: version, name: entry.Name(), sql: string(content)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i, m := range migrations {
+		if m.version != i+1 {
+			panic(fmt.Sprintf("migration %s is out of sequence, expected version %d", m.name, i+1))
+		}
+	}
+	return migrations
+}
+
+// the schema version this build of imagedb expects
+func latestSchemaVersion() int {
+	return len(loadMigrations())
+}
+
+func (s *Database) SchemaVersion() (int, error) {
+	var version int
+	err := s.wcon.Get(&version, `PRAGMA user_version`)
+	return version, err
+}
+
+// brings the database's schema up to date, applying each pending migration in its own transaction.
+// file is the database's path, used to back it up first if it already has content.
+func (s *Database) migrate(file string) error {
+	migrations := loadMigrations()
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this version of imagedb supports (%d)",
+			version, len(migrations))
+	}
+	if version == len(migrations) {
+		return nil
+	}
+
+	if err := s.backup(file, version); err != nil {
+		return fmt.Errorf("failed to back up the database before migrating: %w", err)
+	}
+	for _, m := range migrations[version:] {
+		if err := s.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %s failed: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+func (s *Database) applyMigration(m migration) error {
+	tx, err := s.wcon.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(m.sql); err != nil {
+		return err
+	}
+	if hook, ok := migrationHooks[m.version]; ok {
+		if err := hook(tx); err != nil {
+			return err
+		}
+	}
+	// nb: pragmas can't take parameters, version is ours.
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, m.version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// copies the database to <file>.v<version>.bak, unless it's new (has no tables) or in memory.
+// an existing backup of the same version is kept, as it's from before any failed attempt.
+func (s *Database) backup(file string, version int) error {
+	if len(file) == 0 || file == ":memory:" || strings.HasPrefix(file, "file:") {
+		return nil
+	}
+	var tables int
+	if err := s.con.Get(&tables, `SELECT count(*) FROM sqlite_master WHERE type = 'table'`); err != nil {
+		return err
+	}
+	if tables == 0 {
+		return nil
+	}
+	dest := fmt.Sprintf("%s.v%d.bak", file, version)
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	_, err := s.wcon.Exec(`VACUUM INTO ?`, dest)
+	return err
+}
+
+// copies each model's vectors out of its vec0 table into image_embeddings, then drops the vec0 tables.
+func moveVec0Embeddings(tx *sqlx.Tx) error {
+	type vec0Model struct {
+		ID    int64  `db:"rowid"`
+		Table string `db:"table_name"`
+	}
+	models := make([]vec0Model, 0)
+	err := tx.Select(&models, `SELECT rowid, table_name FROM models`)
+	if err != nil {
+		return err
+	}
+	for _, model := range models {
+		_, err = tx.Exec(`
+		INSERT OR REPLACE INTO image_embeddings
+			   (image_id, model_id, embedding)
+		SELECT rowid, ?, embedding FROM `+model.Table, model.ID)
+		if err != nil {
+			return fmt.Errorf("failed to copy embeddings from %s: %w", model.Table, err)
+		}
+		_, err = tx.Exec(`DROP TABLE ` + model.Table)
+		if err != nil {
+			return err
+		}
+	}
+	// only vec0 tables had names
+	_, err = tx.Exec(`ALTER TABLE models DROP COLUMN table_name`)
+	return err
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/crimro-se/imagedb/pkg/vecmath"
+)
+
+// An embedding model whose vectors are stored in the database.
+type Model struct {
+	ID           int64  `db:"rowid"`
+	ModelID      string `db:"model_id"`
+	Dimension    int    `db:"dimension"`
+	Quantization string `db:"quantization"` // of the coarse copies of its vectors used to speed up searches
+}
+
+// ways the coarse copy of each vector may be stored
+const (
+	QuantizationNone   = "none"   // no coarse copy, searches compare full vectors
+	QuantizationInt8   = "int8"   // a byte per component, 1/4 the size
+	QuantizationBinary = "binary" // a bit per component, 1/32 the size
+)
+
+// candidates the coarse search pass fetches per result wanted, which are then ranked exactly.
+// higher improves recall at the cost of speed.
+const rerankFactor = 8
+
+// the coarse copy of vec, nil if not quantized
+func quantize(quantization string, vec []float32) []byte {
+	switch quantization {
+	case QuantizationInt8:
+		return vecmath.QuantizeInt8(vec)
+	case QuantizationBinary:
+		return vecmath.QuantizeBinary(vec)
+	}
+	return nil
+}
+
+// finds the model with the given model id. ok is false if it isn't registered.
+func (s *Database) GetModel(modelID string) (model Model, ok bool, err error) {
+	err = s.con.Get(&model, `SELECT rowid,* FROM models WHERE model_id = ?`, modelID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model, false, nil
+	}
+	return model, err == nil, err
+}
+
+func (s *Database) GetAllModels() ([]Model, error) {
+	models := make([]Model, 0)
+	err := s.con.Select(&models, `SELECT rowid,* FROM models`)
+	return models, err
+}
+
+// registers the model if it isn't already.
+func (s *Database) EnsureModel(modelID string, dimension int) (Model, error) {
+	model, ok, err := s.GetModel(modelID)
+	if err != nil {
+		return model, err
+	}
+	if ok {
+		if model.Dimension != dimension {
+			return model, fmt.Errorf("model %s is stored with dimension %d, but the embedder produced %d",
+				modelID, model.Dimension, dimension)
+		}
+		return model, nil
+	}
+	if dimension <= 0 {
+		return model, fmt.Errorf("invalid dimension %d for model %s", dimension, modelID)
+	}
+
+	result, err := s.wcon.Exec(`
+	INSERT INTO models
+		   (model_id, dimension)
+	VALUES (?, ?)`, modelID, dimension)
+	if err != nil {
+		return model, err
+	}
+	id, err := result.LastInsertId()
+	return Model{ID: id, ModelID: modelID, Dimension: dimension, Quantization: QuantizationNone}, err
+}
+
+// the model used for searching.
+func (s *Database) ActiveModel() (Model, error) {
+	var model Model
+	err := s.con.Get(&model, `
+	SELECT models.rowid, models.*
+	FROM models, settings
+	WHERE settings.key = 'active_model' AND models.model_id = settings.value`)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model, errors.New("the database has no active embedding model")
+	}
+	return model, err
+}
+
+// switches searching over to a registered model
+func (s *Database) SetActiveModel(modelID string) error {
+	_, ok, err := s.GetModel(modelID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("model %s has no embeddings in this database", modelID)
+	}
+	_, err = s.wcon.Exec(`
+	INSERT OR REPLACE INTO settings
+		   (key, value)
+	VALUES ('active_model', ?)`, modelID)
+	return err
+}
+
+// counts images which have no vector from the model. (optionally within one basedir, when basedirID > 0)
+func (s *Database) CountImagesMissingEmbedding(model Model, basedirID int64) (int64, error) {
+	var count int64
+	query := `
+	SELECT count(*) FROM images
+	WHERE NOT EXISTS
+		(SELECT 1 FROM image_embeddings WHERE model_id = ? AND image_id = images.rowid)`
+	args := []any{model.ID}
+	if basedirID > 0 {
+		query += ` AND basedir_id = ?`
+		args = append(args, basedirID)
+	}
+	err := s.con.Get(&count, query, args...)
+	return count, err
+}
+
+// makes model the active model if every image now has a vector from it,
+// ie, re-embedding the collection with a new model has completed.
+// reports whether the active model is now model.
+func (s *Database) PromoteModelIfComplete(model Model) (bool, error) {
+	active, err := s.ActiveModel()
+	if err == nil && active.ModelID == model.ModelID {
+		return true, nil
+	}
+	missing, err := s.CountImagesMissingEmbedding(model, 0)
+	if err != nil || missing > 0 {
+		return false, err
+	}
+	return true, s.SetActiveModel(model.ModelID)
+}
+
+// changes how the model's vectors are quantized, re-quantizing any already stored.
+// returns the updated model.
+func (s *Database) SetModelQuantization(model Model, quantization string) (Model, error) {
+	switch quantization {
+	case "":
+		quantization = QuantizationNone
+	case QuantizationNone, QuantizationInt8, QuantizationBinary:
+	default:
+		return model, fmt.Errorf("unknown quantization %q, expected %s, %s or %s",
+			quantization, QuantizationNone, QuantizationInt8, QuantizationBinary)
+	}
+	if model.Quantization == quantization {
+		return model, nil
+	}
+	model.Quantization = quantization
+
+	tx, err := s.wcon.Beginx()
+	if err != nil {
+		return model, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`UPDATE models SET quantization = ? WHERE rowid = ?`, quantization, model.ID)
+	if err != nil {
+		return model, err
+	}
+	_, err = tx.Exec(`DELETE FROM image_embeddings_coarse WHERE model_id = ?`, model.ID)
+	if err != nil {
+		return model, err
+	}
+	if quantization == QuantizationNone {
+		return model, tx.Commit()
+	}
+	// nb: read a page at a time, as a collection's vectors may not fit in memory.
+	// (the inserts can't be interleaved with reading the rows, it'd need a second connection)
+	type row struct {
+		ImageID   int64  `db:"image_id"`
+		Embedding []byte `db:"embedding"`
+	}
+	var lastID int64
+	for {
+		rows := make([]row, 0, 1000)
+		err = tx.Select(&rows, `
+		SELECT image_id, embedding FROM image_embeddings
+		WHERE model_id = ? AND image_id > ?
+		ORDER BY image_id
+		LIMIT 1000`, model.ID, lastID)
+		if err != nil || len(rows) == 0 {
+			break
+		}
+		for _, r := range rows {
+			_, err = tx.Exec(`
+			INSERT INTO image_embeddings_coarse
+				   (image_id, model_id, embedding)
+			VALUES (?, ?, ?)`, r.ImageID, model.ID, quantize(quantization, vecmath.DecodeFloat32(r.Embedding)))
+			if err != nil {
+				return model, err
+			}
+		}
+		lastID = rows[len(rows)-1].ImageID
+	}
+	if err != nil {
+		return model, err
+	}
+	return model, tx.Commit()
+}
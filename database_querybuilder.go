@@ -1,9 +1,11 @@
 package main
 
 import (
+	"cmp"
 	"database/sql"
 	"fmt"
 	"reflect"
+	"slices"
 	"strings"
 )
 
@@ -15,22 +17,34 @@ const (
 	OrderByPathAsc
 	OrderByAestheticDesc
 	OrderByAestheticAsc
+	OrderByHybrid // see database_ranking.go
 )
 
 // filtering criterea for retrieving images from the database
-// * ..PathStartsWith should end with a %
 type QueryFilter struct {
 	BaseDirs          []int64         `ref:"basedir_id" db:"basedir_id_condition" clause:"IN"` // eg: string of the form "(1,2,3)" (sqlx doesn't know what to do with []int)
 	HeightMin         sql.NullInt64   `ref:"height" db:"height_min" clause:">="`
 	HeightMax         sql.NullInt64   `ref:"height" db:"height_max" clause:"<="`
 	WidthMin          sql.NullInt64   `ref:"width" db:"width_min" clause:">="`
 	WidthMax          sql.NullInt64   `ref:"width" db:"width_max" clause:"<="`
-	FileSizeMin       sql.NullInt64   `ref:"filesize" db:"filesize_min" clause:">="` // unimplemented
-	FileSizeMax       sql.NullInt64   `ref:"filesize" db:"filesize_max" clause:"<="` // unimplemented
+	FileSizeMin       sql.NullInt64   `ref:"filesize" db:"filesize_min" clause:">="`
+	FileSizeMax       sql.NullInt64   `ref:"filesize" db:"filesize_max" clause:"<="`
 	AestheticMin      sql.NullFloat64 `ref:"aesthetic" db:"aesthetic_min" clause:">="`
 	AestheticMax      sql.NullFloat64 `ref:"aesthetic" db:"aesthetic_max" clause:"<="`
-	PathStartsWith    sql.NullString  `ref:"parent_path" db:"parent_path_prefix" clause:"LIKE"` // unimplemented
-	SubPathStartsWith sql.NullString  `ref:"sub_path" db:"sub_path_prefix" clause:"LIKE"`       // unimplemented
+	PathStartsWith    sql.NullString  `ref:"parent_path" db:"parent_path_prefix" clause:"PREFIX"` // case insensitive
+	SubPathStartsWith sql.NullString  `ref:"sub_path" db:"sub_path_prefix" clause:"PREFIX"`
+	TagsAny           []string        `db:"tags_any"`           // images with at least one of these tags
+	TagsAll           []string        `db:"tags_all"`           // images with every one of these tags
+	TagsNone          []string        `db:"tags_none"`          // images with none of these tags
+	PathKeywords      []string        `db:"path_keywords"`      // images whose path has words starting with each of these
+	Keywords          []string        `db:"keywords"`           // as PathKeywords, but tags match too
+	PathKeywordsNone  []string        `db:"path_keywords_none"` // images whose path has words starting with none of these
+	PathMatch         string          `db:"path_match"`         // set from the keywords when querying, don't set
+	PathExclude       string          `db:"path_exclude"`       // likewise
+	BoostTags         []string        `db:"-"`                  // images with these tags rank higher with OrderByHybrid
+	Weights           RankWeights     `db:"-"`                  // for OrderByHybrid, DefaultRankWeights if zero
+	Diversity         float64         `db:"-"`                  // 0-1, how much similarity searches avoid near duplicates, see mmr
+	MaxDistance       sql.NullFloat64 `db:"-"`                  // similarity searches only return images closer than this
 	Limit             int             `db:"limit"`
 	Offset            int             `db:"offset"`
 }
@@ -49,6 +63,33 @@ func sortOrderToQuery(so SortOrder) string {
 	return ""
 }
 
+// sorts images already read from the database, eg by similarity, as sortOrderToQuery would have.
+// nb: NULL aesthetic scores sort as lowest, like SQLite's.
+func sortImages(imgs []Image, so SortOrder) {
+	byPath := func(a, b Image) int {
+		return cmp.Or(strings.Compare(a.Path, b.Path), strings.Compare(a.SubPath, b.SubPath))
+	}
+	byAesthetic := func(a, b Image) int {
+		switch {
+		case a.Aesthetic.Valid == b.Aesthetic.Valid:
+			return cmp.Compare(a.Aesthetic.Float64, b.Aesthetic.Float64)
+		case a.Aesthetic.Valid:
+			return 1
+		}
+		return -1
+	}
+	switch so {
+	case OrderByAestheticDesc:
+		slices.SortStableFunc(imgs, func(a, b Image) int { return byAesthetic(b, a) })
+	case OrderByAestheticAsc:
+		slices.SortStableFunc(imgs, byAesthetic)
+	case OrderByPathDesc:
+		slices.SortStableFunc(imgs, func(a, b Image) int { return byPath(b, a) })
+	case OrderByPathAsc:
+		slices.SortStableFunc(imgs, byPath)
+	}
+}
+
 // builds a string of the form "(col1, col2, ...) VALUES (:col1, :col2, ...)"
 // based on the tagged 'db' fields in the input struct
 func structToSQLString(input any, ignoreFields []string) (string, error) {
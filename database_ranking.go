@@ -0,0 +1,306 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"sort"
+
+	"github.com/crimro-se/imagedb/pkg/vecmath"
+	"github.com/jmoiron/sqlx"
+)
+
+// OrderByHybrid ranks images by a weighted sum of scores, each normalised to 0-1 across the images being ranked:
+// similarity to the searched embedding, aesthetic score, how recently the file was modified,
+// and the share of QueryFilter.BoostTags the image has. An image without a score gets 0 for it.
+
+// how much each score counts towards OrderByHybrid's ranking
+type RankWeights struct {
+	Similarity float64
+	Aesthetic  float64
+	Recency    float64
+	Tags       float64
+}
+
+// used by queries whose weights are all zero
+var DefaultRankWeights = RankWeights{Similarity: 1, Aesthetic: 0.5, Recency: 0.25, Tags: 0.5}
+
+// a similarity search re-ranks this many times as many of its nearest images as it returns,
+// as does a hybrid sort without one of the best images by each other score
+const (
+	hybridCandidateFactor    = 8
+	diversityCandidateFactor = 4
+)
+
+func (qf QueryFilter) rankWeights() RankWeights {
+	if qf.Weights == (RankWeights{}) {
+		return DefaultRankWeights
+	}
+	return qf.Weights
+}
+
+// as MatchEmbeddingsWithFilter, but the nearest images are re-ranked by OrderByHybrid.
+// nb: with QueryFilter.Diversity, the images re-ranked are diversified first.
+func (s *Database) MatchEmbeddingsHybrid(target []byte, qf QueryFilter) ([]Image, error) {
+	candidatesQF := qf
+	candidatesQF.Offset, candidatesQF.Limit = 0, (qf.Offset+qf.Limit)*hybridCandidateFactor
+	candidates, err := s.MatchEmbeddingsWithFilter(target, candidatesQF)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, len(candidates))
+	for i, img := range candidates {
+		ids[i] = img.ID
+	}
+	vecs, err := s.readActiveEmbeddings(ids)
+	if err != nil {
+		return nil, err
+	}
+	similarity := similarities(vecs, vecmath.DecodeFloat32(target))
+	tagMatches, err := s.countTagMatches(qf.BoostTags, ids)
+	if err != nil {
+		return nil, err
+	}
+	rankHybrid(candidates, similarity, tagMatches, len(normalizeTags(qf.BoostTags)), qf.rankWeights())
+	return pageOf(candidates, qf), nil
+}
+
+// ReadImages with OrderByHybrid, which has no similarity to rank by.
+// the images ranked are the best few by each weighted score: the highest rated, most recently modified,
+// and those with the most boost tags, rather than every matching image.
+func (s *Database) readImagesHybrid(qf QueryFilter) ([]Image, error) {
+	w := qf.rankWeights()
+	boostTags := normalizeTags(qf.BoostTags)
+	n := (qf.Offset + qf.Limit) * hybridCandidateFactor
+	const selectCandidates = `SELECT rowid, aesthetic, mtime FROM images WHERE %s `
+	type candidateQuery struct {
+		query string
+		args  []any
+	}
+	queries := make([]candidateQuery, 0, 3)
+	if w.Recency > 0 {
+		queries = append(queries, candidateQuery{selectCandidates + `ORDER BY mtime DESC LIMIT ?`, []any{n}})
+	}
+	if w.Tags > 0 && len(boostTags) > 0 {
+		queries = append(queries, candidateQuery{selectCandidates + `
+		AND rowid IN (SELECT image_id FROM tags WHERE tag IN (?))
+		ORDER BY (SELECT count(*) FROM tags WHERE image_id = images.rowid AND tag IN (?)) DESC
+		LIMIT ?`, []any{boostTags, boostTags, n}})
+	}
+	// nb: also the fallback when no other score is weighed, so there's something to rank
+	if w.Aesthetic > 0 || len(queries) == 0 {
+		queries = append(queries, candidateQuery{selectCandidates + `ORDER BY aesthetic DESC LIMIT ?`, []any{n}})
+	}
+
+	candidates := make([]Image, 0)
+	seen := make(map[int64]bool)
+	for _, q := range queries {
+		found := make([]Image, 0, n)
+		if err := s.selectFiltered(&found, q.query, qf, q.args...); err != nil {
+			return nil, err
+		}
+		for _, img := range found {
+			if !seen[img.ID] {
+				seen[img.ID] = true
+				candidates = append(candidates, img)
+			}
+		}
+	}
+	ids := make([]int64, len(candidates))
+	for i, img := range candidates {
+		ids[i] = img.ID
+	}
+	tagMatches, err := s.countTagMatches(boostTags, ids)
+	if err != nil {
+		return nil, err
+	}
+	rankHybrid(candidates, nil, tagMatches, len(boostTags), w)
+	candidates = pageOf(candidates, qf)
+	ids = ids[:len(candidates)]
+	for i, img := range candidates {
+		ids[i] = img.ID
+	}
+	found, err := s.ReadImagesByID(ids)
+	if err != nil {
+		return nil, err
+	}
+	return orderImagesByID(found, ids), nil
+}
+
+// the active model's embeddings of the images, by image id
+func (s *Database) readActiveEmbeddings(ids []int64) (map[int64][]float32, error) {
+	embeddings := make(map[int64][]float32, len(ids))
+	if len(ids) == 0 {
+		return embeddings, nil
+	}
+	model, err := s.ActiveModel()
+	if err != nil {
+		return nil, err
+	}
+	query, args, err := sqlx.In(`
+	SELECT image_id, embedding FROM image_embeddings
+	WHERE model_id = ? AND image_id IN (?)`, model.ID, ids)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]StoredEmbedding, 0, len(ids))
+	if err := s.con.Select(&rows, s.con.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		embeddings[r.ImageID] = vecmath.DecodeFloat32(r.Embedding)
+	}
+	return embeddings, nil
+}
+
+// how many of the tags each of the images with any of them has
+func (s *Database) countTagMatches(tags []string, ids []int64) (map[int64]int, error) {
+	matches := make(map[int64]int)
+	tags = normalizeTags(tags)
+	if len(tags) == 0 {
+		return matches, nil
+	}
+	for start := 0; start < len(ids); start += 1000 {
+		page := ids[start:min(start+1000, len(ids))]
+		query, args, err := sqlx.In(`
+		SELECT image_id, count(*) AS matches FROM tags
+		WHERE tag IN (?) AND image_id IN (?)
+		GROUP BY image_id`, tags, page)
+		if err != nil {
+			return nil, err
+		}
+		rows := make([]struct {
+			ImageID int64 `db:"image_id"`
+			Matches int   `db:"matches"`
+		}, 0, len(page))
+		if err := s.con.Select(&rows, s.con.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			matches[r.ImageID] = r.Matches
+		}
+	}
+	return matches, nil
+}
+
+// sorts images best first by OrderByHybrid. similarity may be nil, as may tagMatches when there are no boost tags.
+func rankHybrid(imgs []Image, similarity map[int64]float64, tagMatches map[int64]int, boostTags int, w RankWeights) {
+	similarities := make([]rankScore, len(imgs))
+	aesthetics := make([]rankScore, len(imgs))
+	recencies := make([]rankScore, len(imgs))
+	for i, img := range imgs {
+		sim, ok := similarity[img.ID]
+		similarities[i] = rankScore{sim, ok}
+		aesthetics[i] = rankScore{img.Aesthetic.Float64, img.Aesthetic.Valid}
+		recencies[i] = rankScore{float64(img.ModTime.Int64), img.ModTime.Valid}
+	}
+	normalizeScores(similarities)
+	normalizeScores(aesthetics)
+	normalizeScores(recencies)
+	scores := make(map[int64]float64, len(imgs))
+	for i, img := range imgs {
+		score := w.Similarity*similarities[i].v + w.Aesthetic*aesthetics[i].v + w.Recency*recencies[i].v
+		if boostTags > 0 {
+			score += w.Tags * float64(tagMatches[img.ID]) / float64(boostTags)
+		}
+		scores[img.ID] = score
+	}
+	sort.SliceStable(imgs, func(i, j int) bool { return scores[imgs[i].ID] > scores[imgs[j].ID] })
+}
+
+// a score, if the image has one
+type rankScore struct {
+	v     float64
+	valid bool
+}
+
+// rescales valid scores to 0 (lowest) - 1 (highest), and zeroes missing ones.
+// if every score is the same, they're all 0 as they don't tell the images apart.
+func normalizeScores(scores []rankScore) {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, s := range scores {
+		if s.valid {
+			lo, hi = min(lo, s.v), max(hi, s.v)
+		}
+	}
+	for i, s := range scores {
+		if !s.valid || hi <= lo {
+			scores[i].v = 0
+			continue
+		}
+		scores[i].v = (s.v - lo) / (hi - lo)
+	}
+}
+
+// the similarity of each vector to the target.
+// vectors are normalised, so the dot product ranks as cosine similarity does.
+func similarities(vecs map[int64][]float32, target []float32) map[int64]float64 {
+	similarity := make(map[int64]float64, len(vecs))
+	for id, vec := range vecs {
+		similarity[id] = float64(vecmath.Dot(vec, target))
+	}
+	return similarity
+}
+
+// a similarity search re-ranked by MMR, see QueryFilter.Diversity
+func (s *Database) matchEmbeddingsDiverse(target []byte, qf QueryFilter) ([]Image, error) {
+	candidatesQF := qf
+	candidatesQF.Diversity, candidatesQF.Offset = 0, 0
+	candidatesQF.Limit = (qf.Offset + qf.Limit) * diversityCandidateFactor
+	candidates, err := s.MatchEmbeddingsWithFilter(target, candidatesQF)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, len(candidates))
+	for i, img := range candidates {
+		ids[i] = img.ID
+	}
+	vecs, err := s.readActiveEmbeddings(ids)
+	if err != nil {
+		return nil, err
+	}
+	relevance := similarities(vecs, vecmath.DecodeFloat32(target))
+	return pageOf(mmr(candidates, relevance, vecs, qf.Diversity, qf.Offset+qf.Limit), qf), nil
+}
+
+// maximal marginal relevance: picks n of the images one at a time, each the one that best trades off
+// relevance against similarity to the images already picked, weighing similarity by diversity (0-1).
+func mmr(imgs []Image, relevance map[int64]float64, vecs map[int64][]float32, diversity float64, n int) []Image {
+	picked := make([]Image, 0, min(n, len(imgs)))
+	remaining := slices.Clone(imgs)
+	// each remaining image's greatest similarity to those picked so far
+	redundancy := make([]float64, len(remaining))
+	for i := range redundancy {
+		redundancy[i] = math.Inf(-1)
+	}
+	for len(picked) < n && len(remaining) > 0 {
+		best, bestScore := 0, math.Inf(-1)
+		for i, img := range remaining {
+			score := (1-diversity)*relevance[img.ID] - diversity*max(redundancy[i], 0)
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		chosen := remaining[best]
+		picked = append(picked, chosen)
+		remaining = slices.Delete(remaining, best, best+1)
+		redundancy = slices.Delete(redundancy, best, best+1)
+		chosenVec, ok := vecs[chosen.ID]
+		if !ok {
+			continue
+		}
+		for i, img := range remaining {
+			if vec, ok := vecs[img.ID]; ok {
+				redundancy[i] = max(redundancy[i], float64(vecmath.Dot(vec, chosenVec)))
+			}
+		}
+	}
+	return picked
+}
+
+// the page of images qf asks for
+func pageOf(imgs []Image, qf QueryFilter) []Image {
+	if qf.Offset >= len(imgs) {
+		return make([]Image, 0)
+	}
+	return imgs[qf.Offset:min(qf.Offset+qf.Limit, len(imgs))]
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	sqlite_vec "github.com/asg017/sqlite-vec-go-bindings/cgo"
+	"github.com/crimro-se/imagedb/pkg/vecmath"
+	"github.com/jmoiron/sqlx"
+)
+
+// A tag on an image.
+type Tag struct {
+	ImageID    int64           `db:"image_id"`
+	Tag        string          `db:"tag"`
+	Source     string          `db:"source"`     // TagSourceManual or TagSourceAuto
+	Confidence sql.NullFloat64 `db:"confidence"` // auto tags only
+}
+
+// where a tag came from
+const (
+	TagSourceManual = "manual" // added by the user
+	TagSourceAuto   = "auto"   // added by a tagger, which can't replace manual tags
+)
+
+// a tag and the number of images with it
+type TagCount struct {
+	Tag    string `db:"tag"`
+	Images int64  `db:"images"`
+}
+
+// tags are matched case insensitively, so are stored lower case, without surrounding or repeated spaces.
+func normalizeTag(tag string) string {
+	return strings.Join(strings.Fields(strings.ToLower(tag)), " ")
+}
+
+// normalised tags with blanks and duplicates removed, in their original order
+func normalizeTags(tags []string) []string {
+	out := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if len(tag) > 0 && !seen[tag] {
+			seen[tag] = true
+			out = append(out, tag)
+		}
+	}
+	return out
+}
+
+// adds the tags, or updates them if the images already have them.
+// an auto tag doesn't replace a manual one, but a manual tag replaces an auto one.
+func (s *Database) AddTags(tags []Tag) error {
+	tx, err := s.wcon.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, tag := range tags {
+		if err := addTag(tx, tag); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func addTag(ex sqlx.Execer, tag Tag) error {
+	tag.Tag = normalizeTag(tag.Tag)
+	if len(tag.Tag) == 0 {
+		return errors.New("tags can't be blank")
+	}
+	switch tag.Source {
+	case TagSourceManual:
+		tag.Confidence = sql.NullFloat64{}
+	case TagSourceAuto:
+	default:
+		return fmt.Errorf("unknown tag source %q", tag.Source)
+	}
+	_, err := ex.Exec(`
+	INSERT INTO tags
+		   (image_id, tag, source, confidence)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT (image_id, tag) DO UPDATE
+		SET source = excluded.source, confidence = excluded.confidence
+		WHERE tags.source = 'auto' OR excluded.source = 'manual'`,
+		tag.ImageID, tag.Tag, tag.Source, tag.Confidence)
+	return err
+}
+
+func (s *Database) RemoveTag(imgID int64, tag string) error {
+	_, err := s.wcon.Exec(`DELETE FROM tags WHERE image_id = ? AND tag = ?`, imgID, normalizeTag(tag))
+	return err
+}
+
+// gives the image exactly the tags given, as the user edits them:
+// tags it no longer has are removed (whatever their source), and new ones are added as manual tags.
+func (s *Database) ReplaceTags(imgID int64, tags []string) error {
+	tags = normalizeTags(tags)
+	tx, err := s.wcon.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if len(tags) == 0 {
+		_, err = tx.Exec(`DELETE FROM tags WHERE image_id = ?`, imgID)
+	} else {
+		var query string
+		var args []any
+		query, args, err = sqlx.In(`DELETE FROM tags WHERE image_id = ? AND tag NOT IN (?)`, imgID, tags)
+		if err == nil {
+			_, err = tx.Exec(tx.Rebind(query), args...)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		_, err = tx.Exec(`
+		INSERT INTO tags (image_id, tag, source) VALUES (?, ?, 'manual')
+		ON CONFLICT (image_id, tag) DO NOTHING`, imgID, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// the image's tags, alphabetically
+func (s *Database) ReadTags(imgID int64) ([]Tag, error) {
+	tags := make([]Tag, 0)
+	err := s.con.Select(&tags, `SELECT * FROM tags WHERE image_id = ? ORDER BY tag`, imgID)
+	return tags, err
+}
+
+// every tag in use, most used first
+func (s *Database) ListTags() ([]TagCount, error) {
+	counts := make([]TagCount, 0)
+	err := s.con.Select(&counts, `
+	SELECT tag, count(*) AS images FROM tags
+	GROUP BY tag
+	ORDER BY images DESC, tag`)
+	return counts, err
+}
+
+// replaces the auto tags of the images with those given, keeping their manual tags.
+// nb: tags must be auto tags of the images given.
+func (s *Database) ReplaceAutoTags(imageIDs []int64, tags []Tag) error {
+	if len(imageIDs) == 0 {
+		return nil
+	}
+	tx, err := s.wcon.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query, args, err := sqlx.In(`DELETE FROM tags WHERE source = 'auto' AND image_id IN (?)`, imageIDs)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(tx.Rebind(query), args...); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := addTag(tx, tag); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// the cached embeddings from the model of those texts that have one
+func (s *Database) ReadTextEmbeddings(model Model, texts []string) (map[string][]float32, error) {
+	embeddings := make(map[string][]float32, len(texts))
+	if len(texts) == 0 {
+		return embeddings, nil
+	}
+	query, args, err := sqlx.In(`SELECT text, embedding FROM text_embeddings WHERE model_id = ? AND text IN (?)`,
+		model.ID, texts)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]struct {
+		Text      string `db:"text"`
+		Embedding []byte `db:"embedding"`
+	}, 0, len(texts))
+	if err := s.con.Select(&rows, s.con.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		embeddings[r.Text] = vecmath.DecodeFloat32(r.Embedding)
+	}
+	return embeddings, nil
+}
+
+// caches the model's embedding of text
+func (s *Database) SaveTextEmbedding(model Model, text string, emb []float32) error {
+	embedding, err := sqlite_vec.SerializeFloat32(emb)
+	if err != nil {
+		return err
+	}
+	_, err = s.wcon.Exec(`
+	INSERT OR REPLACE INTO text_embeddings
+		   (model_id, text, embedding)
+	VALUES (?, ?, ?)`, model.ID, text, embedding)
+	return err
+}
+
+// conditions for qf's tag filters, to AND onto the WHERE clause.
+// they use named parameters bound from qf like the rest of the clause, so its tags must be normalised first.
+func tagConditions(qf QueryFilter) []string {
+	conditions := make([]string, 0, 3)
+	if len(qf.TagsAny) > 0 {
+		conditions = append(conditions,
+			`images.rowid IN (SELECT image_id FROM tags WHERE tag IN (:tags_any))`)
+	}
+	if len(qf.TagsAll) > 0 {
+		conditions = append(conditions, fmt.Sprintf(
+			`images.rowid IN (SELECT image_id FROM tags WHERE tag IN (:tags_all) GROUP BY image_id HAVING count(*) = %d)`,
+			len(qf.TagsAll)))
+	}
+	if len(qf.TagsNone) > 0 {
+		conditions = append(conditions,
+			`images.rowid NOT IN (SELECT image_id FROM tags WHERE tag IN (:tags_none))`)
+	}
+	return conditions
+}
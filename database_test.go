@@ -1,10 +1,18 @@
 package main
 
 import (
-	_ "embed"
+	"database/sql"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	sqlite_vec "github.com/asg017/sqlite-vec-go-bindings/cgo"
+	"github.com/crimro-se/imagedb/pkg/vecmath"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -14,7 +22,11 @@ func TestSQLX(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = db.Exec(dbSchema)
+	baseline, err := migrationFiles.ReadFile("migrations/0001_baseline.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(string(baseline))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -30,7 +42,8 @@ func TestSQLX(t *testing.T) {
 		t.Fatal(err)
 	}
 	var im Image
-	err = db.Get(&im, "SELECT * FROM images LIMIT 1")
+	// nb: the baseline's images.tags column was later dropped
+	err = db.Get(&im, "SELECT rowid, basedir_id, parent_path, sub_path, aesthetic, width, height, filesize FROM images LIMIT 1")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -87,11 +100,15 @@ func TestDatabase(t *testing.T) {
 		t.Errorf("Expected imgBest ID to be 10, got %d", imgBest.ID)
 	}
 
+	model, err := db.ActiveModel()
+	if err != nil {
+		t.Fatal(err)
+	}
 	emb := make([]float32, 768)
 	emb[0] = 1
 	emb[1] = 1
 	emb[3] = 2
-	err = db.CreateUpdateEmbedding(imgBest.ID, emb)
+	err = db.CreateUpdateEmbedding(model, imgBest.ID, emb)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -99,7 +116,7 @@ func TestDatabase(t *testing.T) {
 	emb[0] = 1
 	emb[1] = 1
 	emb[3] = 1
-	err = db.CreateUpdateEmbedding(img1.ID, emb)
+	err = db.CreateUpdateEmbedding(model, img1.ID, emb)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -132,3 +149,1074 @@ func TestSQLStrings(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestMultipleModels(t *testing.T) {
+	db, err := NewDatabase(":memory:", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.CreateBasedir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clip, err := db.ActiveModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clip.ModelID != "openai/clip-vit-large-patch14" || clip.Dimension != 768 {
+		t.Errorf("unexpected default model %+v", clip)
+	}
+
+	ids := make([]int64, 0)
+	for _, name := range []string{"a.png", "b.png"} {
+		id, err := db.CreateUpdateImage(&Image{BasedirID: 1, Path: "dir", SubPath: name, Width: 1, Height: 1, FileSize: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		err = db.CreateUpdateEmbedding(clip, id, make([]float32, 768))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	small, err := db.EnsureModel("small", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := db.EnsureModel("small", 4)
+	if err != nil || again.ID != small.ID {
+		t.Fatalf("EnsureModel should be idempotent: %v %+v %+v", err, small, again)
+	}
+	_, err = db.EnsureModel("small", 8)
+	if err == nil {
+		t.Error("expected an error for a mismatched dimension")
+	}
+
+	// half way through re-embedding, the old model stays active
+	err = db.CreateUpdateEmbedding(small, ids[0], []float32{1, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	promoted, err := db.PromoteModelIfComplete(small)
+	if err != nil || promoted {
+		t.Fatalf("model promoted before re-embedding completed: %v", err)
+	}
+	has, err := db.HasEmbedding(small, ids[1])
+	if err != nil || has {
+		t.Fatalf("unexpected embedding: %v", err)
+	}
+	_, err = db.ReadEmbedding(ids[1])
+	if err != nil {
+		t.Errorf("old model's embeddings should still be searchable: %v", err)
+	}
+
+	err = db.CreateUpdateEmbedding(small, ids[1], []float32{0, 1, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	promoted, err = db.PromoteModelIfComplete(small)
+	if err != nil || !promoted {
+		t.Fatalf("model not promoted once re-embedding completed: %v", err)
+	}
+	target, err := sqlite_vec.SerializeFloat32([]float32{0, 1, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgs, err := db.MatchEmbeddingsWithFilter(target, QueryFilter{Limit: 1, BaseDirs: []int64{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imgs) != 1 || imgs[0].ID != ids[1] {
+		t.Errorf("search didn't use the new model: %+v", imgs)
+	}
+
+	// deleting a basedir removes vectors from every model
+	err = db.DeleteBasedir(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, model := range []Model{clip, small} {
+		missing, err := db.CountImagesMissingEmbedding(model, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		has, err := db.HasEmbedding(model, ids[0])
+		if err != nil || has || missing != 0 {
+			t.Errorf("embeddings left behind for %s", model.ModelID)
+		}
+	}
+}
+
+// a database from before migrations existed is adopted and upgraded, keeping its data
+func TestMigrateFromBaseline(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.sqlite")
+	fixture, err := sqlx.Connect("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline, err := migrationFiles.ReadFile("migrations/0001_baseline.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fixture.Exec(string(baseline))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fixture.Exec(`INSERT INTO basedir (directory) VALUES ('/pics');
+	INSERT INTO images (basedir_id, parent_path, sub_path, width, height, filesize) VALUES (1, 'dir', 'a.png', 1, 1, 1);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vec, _ := sqlite_vec.SerializeFloat32(make([]float32, 768))
+	_, err = fixture.Exec(`INSERT INTO embeddings (rowid, embedding) VALUES (1, ?)`, vec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture.Close()
+
+	db, err := NewDatabase(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := db.SchemaVersion()
+	if err != nil || version != latestSchemaVersion() {
+		t.Errorf("expected schema version %d, got %d (%v)", latestSchemaVersion(), version, err)
+	}
+	images, err := db.ReadImages(QueryFilter{BaseDirs: []int64{1}, Limit: 10}, OrderByPathAsc)
+	if err != nil || len(images) != 1 {
+		t.Errorf("images lost in migration: %v %v", images, err)
+	}
+	model, err := db.ActiveModel()
+	if err != nil || model.ModelID != "openai/clip-vit-large-patch14" {
+		t.Errorf("unexpected active model %+v: %v", model, err)
+	}
+	has, err := db.HasEmbedding(model, 1)
+	if err != nil || !has {
+		t.Errorf("embedding lost in migration: %v", err)
+	}
+	var vec0Tables int
+	err = db.con.Get(&vec0Tables, `SELECT count(*) FROM sqlite_master WHERE name = 'embeddings'`)
+	if err != nil || vec0Tables != 0 {
+		t.Errorf("vec0 table not dropped: %v", err)
+	}
+	db.Close()
+
+	backup := file + ".v0.bak"
+	if _, err := os.Stat(backup); err != nil {
+		t.Errorf("no backup made before migrating: %v", err)
+	}
+	os.Remove(backup)
+
+	// reopening is a no-op
+	db, err = NewDatabase(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(backup); err == nil {
+		t.Error("backup made without any migration to apply")
+	}
+
+	// databases from a newer imagedb are refused
+	_, err = db.wcon.Exec(`PRAGMA user_version = 1000`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	_, err = NewDatabase(file, true)
+	if err == nil {
+		t.Error("expected an error opening a database with a newer schema")
+	}
+}
+
+// a long write (as indexing does) blocks neither reads nor, beyond the busy timeout, other writers
+func TestConcurrentAccess(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "concurrent.db")
+	indexer, err := NewDatabase(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexer.Close()
+	gui, err := NewDatabase(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gui.Close()
+	if err := gui.CreateBasedir("/"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := indexer.wcon.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = indexer.createUpdateImage(tx, &Image{BasedirID: 1, Path: "dir", SubPath: "a", Width: 1, Height: 1, FileSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgs, err := gui.ReadImages(QueryFilter{BaseDirs: []int64{1}, Limit: 10}, OrderByPathAsc)
+	if err != nil {
+		t.Fatal("read failed during a write:", err)
+	}
+	if len(imgs) != 0 {
+		t.Errorf("read an uncommitted image")
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		tx.Commit()
+	}()
+	if _, err := gui.CreateUpdateImage(&Image{BasedirID: 1, Path: "dir", SubPath: "b", Width: 1, Height: 1, FileSize: 1}); err != nil {
+		t.Fatal("write failed rather than waiting for the other:", err)
+	}
+	imgs, err = gui.ReadImages(QueryFilter{BaseDirs: []int64{1}, Limit: 10}, OrderByPathAsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imgs) != 2 {
+		t.Errorf("expected both images, read %d", len(imgs))
+	}
+	if _, err := gui.con.Exec(`DELETE FROM images`); err == nil {
+		t.Error("the read pool allowed a write")
+	}
+}
+
+func TestMigrationsSequence(t *testing.T) {
+	migrations := loadMigrations()
+	if len(migrations) < 2 || migrations[0].name != "0001_baseline.sql" {
+		t.Errorf("unexpected migrations %v", migrations)
+	}
+}
+
+// vector search joins and pages like any other query
+func TestMatchEmbeddingsWithFilter(t *testing.T) {
+	db, err := NewDatabase(":memory:", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, dir := range []string{"/a", "/b"} {
+		if err := db.CreateBasedir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	model, err := db.EnsureModel("tiny", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetActiveModel("tiny"); err != nil {
+		t.Fatal(err)
+	}
+	// image i sits at angle i*10 degrees, alternating basedirs
+	for i := 0; i < 6; i++ {
+		img := Image{BasedirID: int64(i%2 + 1), Path: "dir", SubPath: fmt.Sprint(i), Width: 1, Height: 1, FileSize: 1}
+		id, err := db.CreateUpdateImage(&img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		angle := float64(i) * 10 * math.Pi / 180
+		err = db.CreateUpdateEmbedding(model, id, []float32{float32(math.Cos(angle)), float32(math.Sin(angle))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	target, _ := sqlite_vec.SerializeFloat32([]float32{1, 0})
+
+	paths := func(imgs []Image) string {
+		out := ""
+		for _, img := range imgs {
+			out += img.SubPath
+		}
+		return out
+	}
+	check := func(mode string) {
+		t.Helper()
+		imgs, err := db.MatchEmbeddingsWithFilter(target, QueryFilter{BaseDirs: []int64{1, 2}, Limit: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := paths(imgs); got != "012" {
+			t.Errorf("%s: expected nearest 012, got %s", mode, got)
+		}
+		imgs, err = db.MatchEmbeddingsWithFilter(target, QueryFilter{BaseDirs: []int64{1, 2}, Limit: 3, Offset: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := paths(imgs); got != "345" {
+			t.Errorf("%s: expected second page 345, got %s", mode, got)
+		}
+		imgs, err = db.MatchEmbeddingsWithFilter(target, QueryFilter{BaseDirs: []int64{2}, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := paths(imgs); got != "135" {
+			t.Errorf("%s: expected basedir 2's images 135, got %s", mode, got)
+		}
+		// image i is 2sin(i*5 degrees) from the target
+		imgs, err = db.MatchEmbeddingsWithFilter(target, QueryFilter{BaseDirs: []int64{1, 2}, Limit: 10,
+			MaxDistance: sql.NullFloat64{Float64: 0.4, Valid: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := paths(imgs); got != "012" {
+			t.Errorf("%s: expected the images closer than 0.4, 012, got %s", mode, got)
+		}
+		for i, img := range imgs {
+			if want := 2 * math.Sin(float64(i)*5*math.Pi/180); !img.Distance.Valid || math.Abs(img.Distance.Float64-want) > 1e-4 {
+				t.Errorf("%s: expected image %d at distance %f, got %+v", mode, i, want, img.Distance)
+			}
+		}
+	}
+	// quantized searches re-rank exactly, and every candidate fits in the coarse pass here
+	for _, quantization := range []string{QuantizationNone, QuantizationInt8, QuantizationBinary} {
+		_, err = db.SetModelQuantization(model, quantization)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(quantization)
+	}
+	// as does the ANN index, being so small
+	db.UseANN(16)
+	check("hnsw")
+	db.UseANN(0)
+
+	if _, err := db.SetModelQuantization(model, "float8"); err == nil {
+		t.Error("expected an error for an unknown quantization")
+	}
+}
+
+func TestHybridRanking(t *testing.T) {
+	db, err := NewDatabase(":memory:", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CreateBasedir("/"); err != nil {
+		t.Fatal(err)
+	}
+	model, err := db.EnsureModel("tiny", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetActiveModel("tiny"); err != nil {
+		t.Fatal(err)
+	}
+	// image i sits at angle i*10 degrees
+	aesthetics := []float64{1, 2, 3, 10}
+	mtimes := []sql.NullInt64{{Int64: 100, Valid: true}, {Int64: 300, Valid: true}, {Int64: 200, Valid: true}, {}}
+	for i := range 4 {
+		img := Image{BasedirID: 1, Path: "dir", SubPath: fmt.Sprint(i), Width: 1, Height: 1, FileSize: 1,
+			Aesthetic: sql.NullFloat64{Float64: aesthetics[i], Valid: true}, ModTime: mtimes[i]}
+		id, err := db.CreateUpdateImage(&img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		angle := float64(i) * 10 * math.Pi / 180
+		err = db.CreateUpdateEmbedding(model, id, []float32{float32(math.Cos(angle)), float32(math.Sin(angle))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.AddTags([]Tag{{ImageID: 3, Tag: "fav", Source: TagSourceManual}}); err != nil {
+		t.Fatal(err)
+	}
+	target, _ := sqlite_vec.SerializeFloat32([]float32{1, 0})
+	paths := func(imgs []Image, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := ""
+		for _, img := range imgs {
+			out += img.SubPath
+		}
+		return out
+	}
+	qf := func(w RankWeights, offset, limit int, boost ...string) QueryFilter {
+		return QueryFilter{BaseDirs: []int64{1}, Weights: w, Offset: offset, Limit: limit, BoostTags: boost}
+	}
+
+	if got := paths(db.MatchEmbeddingsHybrid(target, qf(RankWeights{Similarity: 1}, 0, 4))); got != "0123" {
+		t.Errorf("ranked by similarity alone, expected 0123, got %s", got)
+	}
+	if got := paths(db.MatchEmbeddingsHybrid(target, qf(RankWeights{Similarity: 1}, 1, 2))); got != "12" {
+		t.Errorf("expected the second and third nearest, got %s", got)
+	}
+	// similarities normalise to 1, .89, .55, 0 and aesthetics to 0, .11, .22, 1
+	if got := paths(db.MatchEmbeddingsHybrid(target, qf(RankWeights{Similarity: 1, Aesthetic: 2}, 0, 4))); got != "3102" {
+		t.Errorf("expected aesthetic to outweigh similarity, got %s", got)
+	}
+	// without a similarity, ReadImages ranks the rest. image 3's unknown time counts as oldest
+	if got := paths(db.ReadImages(qf(RankWeights{Recency: 1}, 0, 4), OrderByHybrid)); got != "1203" {
+		t.Errorf("ranked by recency, expected 1203, got %s", got)
+	}
+	if got := paths(db.ReadImages(qf(RankWeights{Recency: 0.1, Tags: 1}, 0, 2, "Fav", "other"), OrderByHybrid)); got != "21" {
+		t.Errorf("expected the tagged image first, got %s", got)
+	}
+	if got := paths(db.ReadImages(qf(RankWeights{}, 0, 1), OrderByHybrid)); got != "3" {
+		t.Errorf("default weights should favour the most aesthetic image, got %s", got)
+	}
+	// only the candidates' tags are counted
+	if matches, err := db.countTagMatches([]string{"fav"}, []int64{1, 2}); err != nil || len(matches) != 0 {
+		t.Errorf("expected no matches outside the candidates, got %v %v", matches, err)
+	}
+}
+
+func TestDiversity(t *testing.T) {
+	db, err := NewDatabase(":memory:", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CreateBasedir("/"); err != nil {
+		t.Fatal(err)
+	}
+	model, err := db.EnsureModel("tiny", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetActiveModel("tiny"); err != nil {
+		t.Fatal(err)
+	}
+	// a burst of near duplicates closest to the target (a, b, c), and two less similar but distinct images
+	deg := math.Pi / 180
+	vecs := map[string][]float64{
+		"a": {math.Cos(1 * deg), math.Sin(1 * deg), 0},
+		"b": {math.Cos(2 * deg), math.Sin(2 * deg), 0},
+		"c": {math.Cos(3 * deg), math.Sin(3 * deg), 0},
+		"d": {math.Cos(20 * deg), 0, math.Sin(20 * deg)},
+		"e": {math.Cos(25 * deg), 0, -math.Sin(25 * deg)},
+	}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		id, err := db.CreateUpdateImage(&Image{BasedirID: 1, Path: "dir", SubPath: name, Width: 1, Height: 1, FileSize: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := vecs[name]
+		if err := db.CreateUpdateEmbedding(model, id, []float32{float32(v[0]), float32(v[1]), float32(v[2])}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	target, _ := sqlite_vec.SerializeFloat32([]float32{1, 0, 0})
+	search := func(diversity float64, offset, limit int) string {
+		t.Helper()
+		imgs, err := db.MatchEmbeddingsWithFilter(target,
+			QueryFilter{BaseDirs: []int64{1}, Diversity: diversity, Offset: offset, Limit: limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := ""
+		for _, img := range imgs {
+			out += img.SubPath
+		}
+		return out
+	}
+	if got := search(0, 0, 3); got != "abc" {
+		t.Errorf("without diversity, expected the nearest abc, got %s", got)
+	}
+	if got := search(0.7, 0, 3); got != "aed" {
+		t.Errorf("with diversity, expected one of the burst and the distinct images aed, got %s", got)
+	}
+	if got := search(0.7, 1, 2); got != "ed" {
+		t.Errorf("expected the second page of the diversified results ed, got %s", got)
+	}
+	if got := search(1, 0, 5); len(got) != 5 || got[0] != 'a' {
+		t.Errorf("expected every image, most relevant first, got %s", got)
+	}
+}
+
+func TestTags(t *testing.T) {
+	db, err := NewDatabase(":memory:", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CreateBasedir("/"); err != nil {
+		t.Fatal(err)
+	}
+	model, err := db.EnsureModel("tiny", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetActiveModel("tiny"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		id, err := db.CreateUpdateImage(&Image{BasedirID: 1, Path: "dir", SubPath: fmt.Sprint(i), Width: 1, Height: 1, FileSize: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CreateUpdateEmbedding(model, id, []float32{1, float32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	auto := func(id int64, tag string, confidence float64) Tag {
+		return Tag{ImageID: id, Tag: tag, Source: TagSourceAuto, Confidence: sql.NullFloat64{Float64: confidence, Valid: true}}
+	}
+	err = db.AddTags([]Tag{
+		{ImageID: 1, Tag: " Cat ", Source: TagSourceManual},
+		{ImageID: 2, Tag: "cat", Source: TagSourceManual},
+		{ImageID: 2, Tag: "dog", Source: TagSourceManual},
+		auto(3, "dog", 0.6),
+		auto(1, "cat", 0.9), // doesn't replace the manual tag
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddTags([]Tag{{ImageID: 1, Tag: "  ", Source: TagSourceManual}}); err == nil {
+		t.Error("expected an error adding a blank tag")
+	}
+	tags, err := db.ReadTags(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].Tag != "cat" || tags[0].Source != TagSourceManual || tags[0].Confidence.Valid {
+		t.Errorf("unexpected tags on image 1: %+v", tags)
+	}
+	// a manual tag replaces an auto one
+	if err := db.AddTags([]Tag{{ImageID: 3, Tag: "DOG", Source: TagSourceManual}}); err != nil {
+		t.Fatal(err)
+	}
+	if tags, _ := db.ReadTags(3); len(tags) != 1 || tags[0].Source != TagSourceManual {
+		t.Errorf("auto tag not replaced: %+v", tags)
+	}
+	counts, err := db.ListTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 || counts[0] != (TagCount{"cat", 2}) || counts[1] != (TagCount{"dog", 2}) {
+		t.Errorf("unexpected tag counts %+v", counts)
+	}
+
+	paths := func(qf QueryFilter) string {
+		t.Helper()
+		qf.BaseDirs, qf.Limit = []int64{1}, 10
+		imgs, err := db.ReadImages(qf, OrderByPathAsc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := ""
+		for _, img := range imgs {
+			out += img.SubPath
+		}
+		// joined with image_embeddings, filters should behave the same
+		target, _ := sqlite_vec.SerializeFloat32([]float32{1, 0})
+		matched, err := db.MatchEmbeddingsWithFilter(target, qf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matched) != len(imgs) {
+			t.Errorf("searching found %d images, reading found %d", len(matched), len(imgs))
+		}
+		return out
+	}
+	for _, c := range []struct {
+		qf   QueryFilter
+		want string
+	}{
+		{QueryFilter{TagsAny: []string{"cat", "Dog"}}, "012"},
+		{QueryFilter{TagsAll: []string{"cat", "dog", "cat"}}, "1"},
+		{QueryFilter{TagsNone: []string{"dog"}}, "03"},
+		{QueryFilter{TagsAny: []string{"cat"}, TagsNone: []string{"dog"}}, "0"},
+		{QueryFilter{TagsAny: []string{"bird"}}, ""},
+	} {
+		if got := paths(c.qf); got != c.want {
+			t.Errorf("%+v: expected images %q, got %q", c.qf, c.want, got)
+		}
+	}
+
+	if err := db.ReplaceTags(2, []string{"dog", "Bird"}); err != nil {
+		t.Fatal(err)
+	}
+	if tags, _ := db.ReadTags(2); len(tags) != 2 || tags[0].Tag != "bird" || tags[1].Tag != "dog" {
+		t.Errorf("unexpected tags after replacing: %+v", tags)
+	}
+	if err := db.RemoveTag(2, "DOG"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReplaceTags(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	// re-indexing an image keeps its tags, deleting it doesn't
+	img := Image{ID: 2, BasedirID: 1, Path: "dir", SubPath: "1", Width: 2, Height: 2, FileSize: 2}
+	if _, err := db.CreateUpdateImage(&img); err != nil {
+		t.Fatal(err)
+	}
+	if tags, _ := db.ReadTags(2); len(tags) != 1 || tags[0].Tag != "bird" {
+		t.Errorf("unexpected tags after re-indexing: %+v", tags)
+	}
+	if err := db.DeleteImagesByBasedirID(1); err != nil {
+		t.Fatal(err)
+	}
+	if counts, _ := db.ListTags(); len(counts) != 0 {
+		t.Errorf("tags left after deleting their images: %+v", counts)
+	}
+}
+
+func TestPathSearch(t *testing.T) {
+	db, err := NewDatabase(":memory:", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CreateBasedir("/photos"); err != nil {
+		t.Fatal(err)
+	}
+	paths := func(keywords ...string) (string, error) {
+		imgs, err := db.ReadImages(QueryFilter{BaseDirs: []int64{1}, Limit: 10, PathKeywords: keywords}, OrderByPathAsc)
+		out := make([]string, len(imgs))
+		for i, img := range imgs {
+			out[i] = img.SubPath
+		}
+		return strings.Join(out, ","), err
+	}
+	if !db.pathSearch {
+		if _, err := paths("vacation"); err == nil {
+			t.Error("expected an error searching paths without FTS5")
+		}
+		t.Skip("path search needs -tags sqlite_fts5")
+	}
+	for _, img := range []Image{
+		{Path: "vacation2019/beach", SubPath: "IMG_001.jpg"},
+		{Path: "vacation2019", SubPath: "sunset.png"},
+		{Path: "work", SubPath: "vacation-plan.png"},
+		{Path: "archive.zip", SubPath: "Beach Day.jpg"},
+	} {
+		img.BasedirID, img.Width, img.Height, img.FileSize = 1, 1, 1, 1
+		if _, err := db.CreateUpdateImage(&img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		keywords []string
+		want     string
+	}{
+		{[]string{"vacation2019"}, "sunset.png,IMG_001.jpg"},
+		{[]string{"vacation"}, "sunset.png,IMG_001.jpg,vacation-plan.png"},
+		{[]string{"beach"}, "Beach Day.jpg,IMG_001.jpg"},
+		{[]string{"beach", "img"}, "IMG_001.jpg"},
+		{[]string{"photos", "plan"}, "vacation-plan.png"},
+		{[]string{`"sunset OR work`}, ""},
+		{[]string{" "}, "Beach Day.jpg,sunset.png,IMG_001.jpg,vacation-plan.png"},
+	} {
+		got, err := paths(c.keywords...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%q: expected %s, got %s", c.keywords, c.want, got)
+		}
+	}
+	imgs, err := db.ReadImages(QueryFilter{BaseDirs: []int64{1}, Limit: 10, PathKeywords: []string{"vacation"},
+		PathKeywordsNone: []string{"beach", "work"}}, OrderByPathAsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imgs) != 1 || imgs[0].SubPath != "sunset.png" {
+		t.Errorf("expected only sunset.png without beach or work in its path, got %+v", imgs)
+	}
+
+	// keywords match tags as well as paths
+	if err := db.AddTags([]Tag{{ImageID: 3, Tag: "Sea", Source: TagSourceManual}}); err != nil {
+		t.Fatal(err)
+	}
+	keywords := func(keywords ...string) string {
+		t.Helper()
+		imgs, err := db.ReadImages(QueryFilter{BaseDirs: []int64{1}, Limit: 10, Keywords: keywords}, OrderByPathAsc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make([]string, len(imgs))
+		for i, img := range imgs {
+			out[i] = img.SubPath
+		}
+		return strings.Join(out, ",")
+	}
+	if got := keywords("sea", "work"); got != "vacation-plan.png" {
+		t.Errorf("expected the tagged image, got %s", got)
+	}
+	if got, _ := paths("sea"); got != "" {
+		t.Errorf("path keywords matched a tag: %s", got)
+	}
+	if err := db.RemoveTag(3, "sea"); err != nil {
+		t.Fatal(err)
+	}
+	if got := keywords("sea"); got != "" {
+		t.Errorf("matched a removed tag: %s", got)
+	}
+
+	// renamed, replaced and deleted images are kept in sync
+	img := Image{ID: 2, BasedirID: 1, Path: "holiday", SubPath: "sunset.png", Width: 1, Height: 1, FileSize: 1}
+	if _, err := db.CreateUpdateImage(&img); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := paths("holiday"); got != "sunset.png" {
+		t.Errorf("replaced image not found by its new path: %s", got)
+	}
+	if got, _ := paths("vacation2019"); got != "IMG_001.jpg" {
+		t.Errorf("replaced image found by its old path: %s", got)
+	}
+	if err := db.DeleteImagesByBasedirID(1); err != nil {
+		t.Fatal(err)
+	}
+	var indexed int
+	if err := db.con.Get(&indexed, `SELECT count(*) FROM images_fts`); err != nil || indexed != 0 {
+		t.Errorf("deleted images left in the index: %d %v", indexed, err)
+	}
+}
+
+// a database last used by a build with FTS5 stays writable by one without
+func TestPathIndexWithoutFTS5(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "fts.db")
+	db, err := NewDatabase(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.pathSearch {
+		db.Close()
+		t.Skip("only applies to builds without -tags sqlite_fts5")
+	}
+	// as left by an FTS5 build. nb: triggers' statements aren't checked until they run
+	if _, err := db.wcon.Exec(pathIndexTriggersSQL); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db, err = NewDatabase(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CreateBasedir("/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateUpdateImage(&Image{BasedirID: 1, Path: "dir", SubPath: "a", Width: 1, Height: 1, FileSize: 1}); err != nil {
+		t.Error("the path index's triggers weren't dropped:", err)
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	db, err := NewDatabase(":memory:", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CreateBasedir("/"); err != nil {
+		t.Fatal(err)
+	}
+	for _, img := range []Image{
+		{Path: "a_b/c", SubPath: "1.jpg"},
+		{Path: "axb/c", SubPath: "2.jpg"},
+		{Path: "100%/x", SubPath: "3.jpg"},
+		{Path: "1000/x", SubPath: "4_thumb.jpg"},
+		{Path: `back\slash`, SubPath: "5.jpg", Width: 2000},
+	} {
+		img.BasedirID, img.Height, img.FileSize = 1, 1, 1
+		img.Width = max(img.Width, 1)
+		if _, err := db.CreateUpdateImage(&img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		qf   QueryFilter
+		want string
+	}{
+		{QueryFilter{PathStartsWith: sql.NullString{String: "a_b", Valid: true}}, "1.jpg"},
+		{QueryFilter{PathStartsWith: sql.NullString{String: "A", Valid: true}}, "1.jpg,2.jpg"},
+		{QueryFilter{PathStartsWith: sql.NullString{String: "100%", Valid: true}}, "3.jpg"},
+		{QueryFilter{PathStartsWith: sql.NullString{String: `back\`, Valid: true}}, "5.jpg"},
+		{QueryFilter{SubPathStartsWith: sql.NullString{String: "4_", Valid: true}}, "4_thumb.jpg"},
+		{QueryFilter{PathStartsWith: sql.NullString{String: "back", Valid: true}, WidthMax: sql.NullInt64{Int64: 1, Valid: true}}, ""},
+		{QueryFilter{}, "3.jpg,4_thumb.jpg,1.jpg,2.jpg,5.jpg"},
+	} {
+		c.qf.BaseDirs, c.qf.Limit = []int64{1}, 10
+		imgs, err := db.ReadImages(c.qf, OrderByPathAsc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(imgs))
+		for i, img := range imgs {
+			got[i] = img.SubPath
+		}
+		if strings.Join(got, ",") != c.want {
+			t.Errorf("%+v: expected %s, got %s", c.qf, c.want, strings.Join(got, ","))
+		}
+	}
+}
+
+// the ANN index follows inserts and deletes, and is saved and reconciled with the database
+func TestANNIndex(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.sqlite")
+	db, err := NewDatabase(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.UseANN(32)
+	for _, dir := range []string{"/a", "/b"} {
+		if err := db.CreateBasedir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	model, err := db.ActiveModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vecs := make(map[int64][]float32)
+	addImage := func(db *Database, basedir int64, name string) int64 {
+		id, err := db.CreateUpdateImage(&Image{BasedirID: basedir, Path: "dir", SubPath: name, Width: 1, Height: 1, FileSize: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vec := make([]float32, model.Dimension)
+		vec[id] = 1
+		vecs[id] = vec
+		if err := db.CreateUpdateEmbedding(model, id, vec); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	nearest := func(db *Database, id int64, basedirs ...int64) int64 {
+		t.Helper()
+		target, _ := sqlite_vec.SerializeFloat32(vecs[id])
+		imgs, err := db.MatchEmbeddingsWithFilter(target, QueryFilter{BaseDirs: basedirs, Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(imgs) == 0 {
+			return 0
+		}
+		return imgs[0].ID
+	}
+
+	first := addImage(db, 1, "first.png") // before the index is loaded
+	if got := nearest(db, first, 1, 2); got != first {
+		t.Errorf("expected image %d, got %d", first, got)
+	}
+	second := addImage(db, 2, "second.png") // after
+	if got := nearest(db, second, 1, 2); got != second {
+		t.Errorf("expected image %d, got %d", second, got)
+	}
+	if got := nearest(db, second, 1); got != first {
+		t.Errorf("basedir filter ignored, got %d", got)
+	}
+	if err := db.DeleteImagesByBasedirID(2); err != nil {
+		t.Fatal(err)
+	}
+	if db.loadedANNIndex(model).graph.Contains(second) {
+		t.Error("deleted image still in the index")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s.model%d.hnsw", file, model.ID)); err != nil {
+		t.Fatalf("index not saved: %v", err)
+	}
+
+	// changes made while the index isn't loaded are picked up when it next is
+	delete(annIndexes.m, annKey(file, model))
+	db, err = NewDatabase(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+	db.UseANN(32)
+	third := addImage(db, 1, "third.png")
+	if got := nearest(db, third, 1); got != third {
+		t.Errorf("image added while the index was unloaded not found, got %d", got)
+	}
+	if got := nearest(db, first, 1); got != first {
+		t.Errorf("saved index lost image %d, got %d", first, got)
+	}
+
+	// a corrupt index is rebuilt rather than loaded
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	delete(annIndexes.m, annKey(file, model))
+	if err := os.Truncate(fmt.Sprintf("%s.model%d.hnsw", file, model.ID), 100); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDatabase(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.UseANN(32)
+	if got := nearest(db, third, 1); got != third {
+		t.Errorf("rebuilt index lost image %d, got %d", third, got)
+	}
+}
+
+// a filter passing few images widens the index search until it's quicker to compare every vector
+func TestANNSelectiveFilter(t *testing.T) {
+	const images = 5000
+	db, err := NewDatabase(":memory:", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.UseANN(32)
+	if err := db.CreateBasedir("/"); err != nil {
+		t.Fatal(err)
+	}
+	model, err := db.EnsureModel("tiny", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetActiveModel("tiny"); err != nil {
+		t.Fatal(err)
+	}
+	tags := make([]Tag, 0)
+	for i := 0; i < images; i++ {
+		id, err := db.CreateUpdateImage(&Image{BasedirID: 1, Path: "dir", SubPath: fmt.Sprint(i), Width: 1, Height: 1, FileSize: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		angle := float64(i) / images * math.Pi / 2
+		if err := db.CreateUpdateEmbedding(model, id, []float32{float32(math.Cos(angle)), float32(math.Sin(angle))}); err != nil {
+			t.Fatal(err)
+		}
+		// the furthest images from the target
+		if i >= images-2 {
+			tags = append(tags, Tag{ImageID: id, Tag: "rare", Source: TagSourceManual})
+		}
+	}
+	if err := db.AddTags(tags); err != nil {
+		t.Fatal(err)
+	}
+	target, _ := sqlite_vec.SerializeFloat32([]float32{1, 0})
+	imgs, err := db.MatchEmbeddingsWithFilter(target, QueryFilter{BaseDirs: []int64{1}, TagsAll: []string{"rare"}, Limit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imgs) != 2 || imgs[0].ID != tags[0].ImageID || imgs[1].ID != tags[1].ImageID {
+		t.Errorf("expected the rare images nearest first, got %v", imgs)
+	}
+}
+
+// compares the latency and recall (against exact search) of each quantization, and of the ANN index.
+// run with: go test -run ^$ -bench MatchEmbeddings
+// nb: random vectors are a worst case for recall, real embeddings cluster.
+func BenchmarkMatchEmbeddings(b *testing.B) {
+	const images, dimension, k = 20000, 768, 64
+	db, err := NewDatabase(":memory:", true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CreateBasedir("/"); err != nil {
+		b.Fatal(err)
+	}
+	model, err := db.EnsureModel("bench", dimension)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := db.SetActiveModel("bench"); err != nil {
+		b.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	randomVector := func() []float32 {
+		vec := make([]float32, dimension)
+		for i := range vec {
+			vec[i] = float32(rng.NormFloat64())
+		}
+		return vecmath.Normalize(vec)
+	}
+	// real embeddings are clustered by subject rather than uniformly spread, which approximate searches rely on
+	centres := make([][]float32, 200)
+	for i := range centres {
+		centres[i] = randomVector()
+	}
+	clusteredVector := func() []float32 {
+		vec := randomVector()
+		centre := centres[rng.Intn(len(centres))]
+		for i := range vec {
+			vec[i] = centre[i] + vec[i]*0.6
+		}
+		return vecmath.Normalize(vec)
+	}
+	for i := 0; i < images; i++ {
+		id, err := db.CreateUpdateImage(&Image{BasedirID: 1, Path: "dir", SubPath: fmt.Sprint(i), Width: 1, Height: 1, FileSize: 1})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := db.CreateUpdateEmbedding(model, id, clusteredVector()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	// queries near a stored image, as similar image searches are
+	queries := make([][]byte, 16)
+	for i := range queries {
+		emb, err := db.ReadEmbedding(int64(rng.Intn(images) + 1))
+		if err != nil {
+			b.Fatal(err)
+		}
+		vec := vecmath.DecodeFloat32(emb)
+		noise := randomVector()
+		for j := range vec {
+			vec[j] += noise[j] * 0.3
+		}
+		queries[i], _ = sqlite_vec.SerializeFloat32(vecmath.Normalize(vec))
+	}
+	qf := QueryFilter{BaseDirs: []int64{1}, Limit: k}
+	exact := make([]map[int64]bool, len(queries))
+	for i, q := range queries {
+		imgs, err := db.MatchEmbeddingsWithFilter(q, qf)
+		if err != nil {
+			b.Fatal(err)
+		}
+		exact[i] = make(map[int64]bool)
+		for _, img := range imgs {
+			exact[i][img.ID] = true
+		}
+	}
+
+	for _, quantization := range []string{QuantizationNone, QuantizationInt8, QuantizationBinary} {
+		model, err = db.SetModelQuantization(model, quantization)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(quantization, func(b *testing.B) {
+			found := 0
+			for i := 0; i < b.N; i++ {
+				q := i % len(queries)
+				imgs, err := db.MatchEmbeddingsWithFilter(queries[q], qf)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, img := range imgs {
+					if exact[q][img.ID] {
+						found++
+					}
+				}
+			}
+			b.ReportMetric(float64(found)/float64(b.N*k), "recall")
+		})
+	}
+
+	_, err = db.SetModelQuantization(model, QuantizationNone)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, ef := range []int{64, 256} {
+		db.UseANN(ef)
+		// builds the index outside of the timing
+		if _, err := db.MatchEmbeddingsWithFilter(queries[0], qf); err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprintf("hnsw-ef%d", ef), func(b *testing.B) {
+			found := 0
+			for i := 0; i < b.N; i++ {
+				q := i % len(queries)
+				imgs, err := db.MatchEmbeddingsWithFilter(queries[q], qf)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, img := range imgs {
+					if exact[q][img.ID] {
+						found++
+					}
+				}
+			}
+			b.ReportMetric(float64(found)/float64(b.N*k), "recall")
+		})
+	}
+}
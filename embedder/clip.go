@@ -0,0 +1,34 @@
+package embedder
+
+import (
+	"image"
+
+	"golang.org/x/image/draw"
+)
+
+// per channel normalisation applied by CLIP's image preprocessing
+var (
+	clipMean = [3]float32{0.48145466, 0.4578275, 0.40821073}
+	clipStd  = [3]float32{0.26862954, 0.26130258, 0.27577711}
+)
+
+// clipPixelValues preprocesses img as CLIP does: the largest centred square is
+// resized (bicubic) to size x size, and returned normalised in CHW order.
+func clipPixelValues(img image.Image, size int) []float32 {
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	crop := image.Rect(0, 0, side, side).Add(image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2))
+
+	square := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(square, square.Bounds(), img, crop, draw.Src, nil)
+
+	plane := size * size
+	pixels := make([]float32, 3*plane)
+	for i := 0; i < plane; i++ {
+		for c := 0; c < 3; c++ {
+			v := float32(square.Pix[i*4+c]) / 255
+			pixels[c*plane+i] = (v - clipMean[c]) / clipStd[c]
+		}
+	}
+	return pixels
+}
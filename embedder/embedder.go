@@ -0,0 +1,152 @@
+// embedder abstracts over the services able to turn images and text into embedding vectors,
+// so the rest of imagedb doesn't need to know which one is in use.
+package embedder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/crimro-se/imagedb/embeddingserver"
+)
+
+// ImageEmbedding is the result of embedding an image.
+// Only some backends can rate aesthetics, HasAesthetic is false for the others.
+type ImageEmbedding struct {
+	Vector       []float32
+	Aesthetic    float32
+	HasAesthetic bool
+}
+
+// Embedder turns images and text into vectors in the same embedding space.
+// Implementations must be safe for concurrent use.
+type Embedder interface {
+	// imageData is an encoded image, eg a png
+	EmbedImage(ctx context.Context, imageData []byte) (ImageEmbedding, error)
+	EmbedText(ctx context.Context, text string) ([]float32, error)
+	// length of the vectors produced. May be 0 until the first vector has been produced
+	// if it wasn't configured
+	Dimension() int
+	// identifies the model, vectors from different models can't be compared
+	ModelID() string
+	Close() error
+}
+
+// names of the available backends, as used in config.ini
+const (
+	BackendLitServe = "litserve" // our own server.py
+	BackendOpenAI   = "openai"   // an OpenAI-compatible /v1/embeddings endpoint
+	BackendLlamaCpp = "llamacpp" // llama.cpp server style /embedding endpoint
+	BackendONNX     = "onnx"     // in-process via ONNX Runtime, only when built with -tags onnx
+)
+
+// Options selects and configures an Embedder
+type Options struct {
+	Backend   string
+	URL       string // base URL of the server, without the endpoint path
+	Model     string // model name sent to the server, and the ModelID
+	APIKey    string // sent as a bearer token if set
+	Dimension int    // expected vector length, 0 to learn it from the first response
+	Timeout   time.Duration
+	Retries   int
+	BatchSize int // litserve only: images sent per request
+
+	// When set, requests wait for the server to come back after an outage instead of failing,
+	// and ServerStatus is told when it goes down and comes back.
+	// Intended for long indexing runs rather than interactive use.
+	WaitForServer bool
+	ServerStatus  func(available bool)
+
+	ONNX ONNXOptions
+}
+
+// ONNXOptions configures the onnx backend, which runs models exported by embeddingserver/export_onnx.py
+type ONNXOptions struct {
+	Library        string // path to the onnxruntime shared library, empty for the platform default
+	ImageModel     string // .onnx taking pixel_values, producing image_embeds
+	TextModel      string // .onnx taking input_ids and attention_mask, producing text_embeds
+	AestheticModel string // optional .onnx rating a normalised image embedding
+	TokenizerDir   string // directory containing the model's vocab.json and merges.txt
+	ImageSize      int    // side length the image model expects, 224 if unset
+	Threads        int    // intra-op threads per inference, 0 lets onnxruntime decide
+}
+
+const (
+	// the model server.py runs
+	DefaultLitServeModel     = "openai/clip-vit-large-patch14"
+	DefaultLitServeDimension = 768
+
+	// how long a partially filled batch of images waits for more before being sent
+	batchLinger = 50 * time.Millisecond
+	// consecutive failed requests (after retries) before requests pause to wait for the server
+	breakerThreshold = 3
+	// how often the server's health is checked while requests are paused
+	healthInterval = 5 * time.Second
+)
+
+// New creates the Embedder described by opts.
+// ctx bounds the lifetime of any background work, such as batching.
+func New(ctx context.Context, opts Options) (Embedder, error) {
+	backend := strings.ToLower(opts.Backend)
+	if backend == BackendONNX {
+		return newONNX(opts)
+	}
+	if len(opts.URL) == 0 {
+		return nil, fmt.Errorf("no embedding server URL configured")
+	}
+	switch backend {
+	case BackendLitServe, "":
+		return newLitServe(ctx, opts), nil
+	case BackendOpenAI:
+		return newOpenAI(ctx, opts)
+	case BackendLlamaCpp:
+		return newLlamaCpp(ctx, opts)
+	}
+	return nil, fmt.Errorf("unknown embedding backend %q", opts.Backend)
+}
+
+// a client for talking to the server at opts.URL, set up for retries etc as described by opts.
+func newClient(ctx context.Context, opts Options) *embeddingserver.Client {
+	client := embeddingserver.NewClient(strings.TrimSuffix(opts.URL, "/"))
+	if opts.Timeout > 0 {
+		client.Timeout = opts.Timeout
+	}
+	client.MaxRetries = opts.Retries
+	if opts.WaitForServer {
+		client.Breaker = embeddingserver.NewCircuitBreaker(ctx, breakerThreshold, healthInterval, client.Healthy,
+			func(open bool) {
+				if opts.ServerStatus != nil {
+					opts.ServerStatus(!open)
+				}
+			})
+	}
+	if len(opts.APIKey) > 0 {
+		client.Header = map[string][]string{"Authorization": {"Bearer " + opts.APIKey}}
+	}
+	return client
+}
+
+// remembers the vector length, either as configured or as first seen
+type dimension struct {
+	n atomic.Int64
+}
+
+func (d *dimension) Dimension() int {
+	return int(d.n.Load())
+}
+
+// checks vec has the expected length, learning it if unknown
+func (d *dimension) check(vec []float32) error {
+	if len(vec) == 0 {
+		return fmt.Errorf("server returned an empty embedding")
+	}
+	if d.n.CompareAndSwap(0, int64(len(vec))) {
+		return nil
+	}
+	if want := d.n.Load(); want != int64(len(vec)) {
+		return fmt.Errorf("server returned an embedding of length %d, expected %d", len(vec), want)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package embedder
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewUnknownBackend(t *testing.T) {
+	_, err := New(context.Background(), Options{Backend: "nope", URL: "http://localhost"})
+	if err == nil {
+		t.Error("expected an error for an unknown backend")
+	}
+	_, err = New(context.Background(), Options{Backend: BackendOpenAI})
+	if err == nil {
+		t.Error("expected an error for a missing URL")
+	}
+	// either unsupported by this build, or missing its model files
+	_, err = New(context.Background(), Options{Backend: BackendONNX})
+	if err == nil {
+		t.Error("expected an error for an unconfigured onnx backend")
+	}
+}
+
+func TestOpenAI(t *testing.T) {
+	var gotAuth string
+	var gotInputs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/embeddings" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		gotAuth = r.Header.Get("Authorization")
+		var req openAIRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		gotInputs = append(gotInputs, req.Input...)
+		w.Write([]byte(`{"data":[{"index":0,"embedding":[3,4]}]}`))
+	}))
+	defer server.Close()
+
+	emb, err := New(context.Background(), Options{Backend: BackendOpenAI, URL: server.URL + "/", Model: "clip", APIKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer emb.Close()
+
+	vec, err := emb.EmbedText(context.Background(), "a cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// vectors are normalised
+	if math.Abs(float64(vec[0])-0.6) > 1e-6 || math.Abs(float64(vec[1])-0.8) > 1e-6 {
+		t.Errorf("unexpected vector %v", vec)
+	}
+	img, err := emb.EmbedImage(context.Background(), []byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.HasAesthetic {
+		t.Error("openai backend can't rate aesthetics")
+	}
+	if gotAuth != "Bearer secret" {
+		t.Errorf("unexpected Authorization header %q", gotAuth)
+	}
+	if len(gotInputs) != 2 || gotInputs[0] != "a cat" || !strings.HasPrefix(gotInputs[1], "data:image/png;base64,") {
+		t.Errorf("unexpected inputs %v", gotInputs)
+	}
+	if emb.Dimension() != 2 || emb.ModelID() != "clip" {
+		t.Errorf("unexpected dimension %d or model %s", emb.Dimension(), emb.ModelID())
+	}
+}
+
+func TestDimensionMismatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":[{"index":0,"embedding":[1,2,3]}]}`))
+	}))
+	defer server.Close()
+
+	emb, err := New(context.Background(), Options{Backend: BackendOpenAI, URL: server.URL, Model: "m", Dimension: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = emb.EmbedText(context.Background(), "x")
+	if err == nil {
+		t.Error("expected an error for a vector of the wrong length")
+	}
+}
+
+func TestLlamaCpp(t *testing.T) {
+	var gotImage bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req llamaCppRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		gotImage = gotImage || (len(req.ImageData) == 1 && req.Content == "[img-1]")
+		w.Write([]byte(`[{"index":0,"embedding":[[9,9],[0,2]]}]`))
+	}))
+	defer server.Close()
+
+	emb, err := New(context.Background(), Options{Backend: BackendLlamaCpp, URL: server.URL, Model: "siglip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := emb.EmbedImage(context.Background(), []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotImage {
+		t.Error("image wasn't sent in image_data")
+	}
+	if img.Vector[0] != 0 || img.Vector[1] != 1 {
+		t.Errorf("unexpected vector %v", img.Vector)
+	}
+}
+
+func TestParseLlamaCppResponse(t *testing.T) {
+	tests := map[string]float32{
+		`{"embedding":[5,1]}`:                   5,
+		`[{"index":0,"embedding":[6,1]}]`:       6,
+		`[{"index":0,"embedding":[[1],[7,1]]}]`: 7,
+	}
+	for raw, want := range tests {
+		vec, err := parseLlamaCppResponse(json.RawMessage(raw))
+		if err != nil {
+			t.Errorf("%s: %v", raw, err)
+			continue
+		}
+		if vec[0] != want {
+			t.Errorf("%s: expected %v, got %v", raw, want, vec)
+		}
+	}
+	if _, err := parseLlamaCppResponse(json.RawMessage(`[]`)); err == nil {
+		t.Error("expected an error for an empty response")
+	}
+}
+
+func TestLitServe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&req)
+		if _, ok := req["batch"]; ok {
+			w.Write([]byte(`{"results":[{"embedding":[1,0],"aesthetic":6.5}]}`))
+			return
+		}
+		w.Write([]byte(`{"embedding":[0,1],"aesthetic":0}`))
+	}))
+	defer server.Close()
+
+	emb, err := New(context.Background(), Options{URL: server.URL, Dimension: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer emb.Close()
+	if emb.ModelID() != DefaultLitServeModel {
+		t.Errorf("unexpected model %s", emb.ModelID())
+	}
+	img, err := emb.EmbedImage(context.Background(), []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !img.HasAesthetic || img.Aesthetic != 6.5 {
+		t.Errorf("unexpected image embedding %v", img)
+	}
+	vec, err := emb.EmbedText(context.Background(), "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vec[1] != 1 {
+		t.Errorf("unexpected text embedding %v", vec)
+	}
+}
+
+func TestClipPixelValues(t *testing.T) {
+	// a wide image, red in the centre square and blue either side
+	img := image.NewRGBA(image.Rect(0, 0, 30, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 30; x++ {
+			c := color.RGBA{0, 0, 255, 255}
+			if x >= 10 && x < 20 {
+				c = color.RGBA{255, 0, 0, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	pixels := clipPixelValues(img, 4)
+	if len(pixels) != 3*4*4 {
+		t.Fatalf("unexpected length %d", len(pixels))
+	}
+	wantR := (1 - clipMean[0]) / clipStd[0]
+	wantB := (0 - clipMean[2]) / clipStd[2]
+	for i := 0; i < 16; i++ {
+		if math.Abs(float64(pixels[i]-wantR)) > 1e-4 || math.Abs(float64(pixels[32+i]-wantB)) > 1e-4 {
+			t.Fatalf("pixel %d wasn't cropped from the centre: r=%v b=%v", i, pixels[i], pixels[32+i])
+		}
+	}
+}
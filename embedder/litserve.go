@@ -0,0 +1,65 @@
+package embedder
+
+import (
+	"context"
+
+	"github.com/crimro-se/imagedb/embeddingserver"
+)
+
+// LitServe embeds via our own server.py, which also rates image aesthetics.
+// Images are batched, text is sent immediately.
+type LitServe struct {
+	dimension
+	client *embeddingserver.Client
+	batch  *embeddingserver.BatchClient
+	model  string
+}
+
+func newLitServe(ctx context.Context, opts Options) *LitServe {
+	client := newClient(ctx, opts)
+	ls := &LitServe{
+		client: client,
+		batch:  embeddingserver.NewBatchClient(ctx, client, opts.BatchSize, batchLinger),
+		model:  opts.Model,
+	}
+	if len(ls.model) == 0 {
+		ls.model = DefaultLitServeModel
+	}
+	if opts.Dimension > 0 {
+		ls.n.Store(int64(opts.Dimension))
+	} else if ls.model == DefaultLitServeModel {
+		ls.n.Store(DefaultLitServeDimension)
+	}
+	return ls
+}
+
+func (ls *LitServe) EmbedImage(ctx context.Context, imageData []byte) (ImageEmbedding, error) {
+	emb, err := ls.batch.GetImageEmbeddingContext(ctx, imageData)
+	if err != nil {
+		return ImageEmbedding{}, err
+	}
+	if err := ls.check(emb.Embedding); err != nil {
+		return ImageEmbedding{}, err
+	}
+	return ImageEmbedding{Vector: emb.Embedding, Aesthetic: emb.Aesthetic, HasAesthetic: true}, nil
+}
+
+func (ls *LitServe) EmbedText(ctx context.Context, text string) ([]float32, error) {
+	emb, err := ls.client.GetEmbeddingContext(ctx, embeddingserver.Task{Text: text})
+	if err != nil {
+		return nil, err
+	}
+	if err := ls.check(emb.Embedding); err != nil {
+		return nil, err
+	}
+	return emb.Embedding, nil
+}
+
+func (ls *LitServe) ModelID() string {
+	return ls.model
+}
+
+func (ls *LitServe) Close() error {
+	ls.batch.Close()
+	return nil
+}
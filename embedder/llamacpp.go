@@ -0,0 +1,113 @@
+package embedder
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/crimro-se/imagedb/embeddingserver"
+	"github.com/crimro-se/imagedb/pkg/vecmath"
+)
+
+// LlamaCpp embeds via a llama.cpp server style /embedding endpoint,
+// as also offered by servers compatible with it.
+// Images are sent in image_data and referenced from the prompt as [img-1].
+type LlamaCpp struct {
+	dimension
+	client *embeddingserver.Client
+	model  string
+}
+
+type llamaCppImage struct {
+	Data string `json:"data"`
+	ID   int    `json:"id"`
+}
+
+type llamaCppRequest struct {
+	Content   string          `json:"content"`
+	ImageData []llamaCppImage `json:"image_data,omitempty"`
+}
+
+func newLlamaCpp(ctx context.Context, opts Options) (*LlamaCpp, error) {
+	if len(opts.Model) == 0 {
+		return nil, fmt.Errorf("the llamacpp embedding backend requires a model name to identify its embeddings")
+	}
+	lc := &LlamaCpp{
+		client: newClient(ctx, opts),
+		model:  opts.Model,
+	}
+	lc.n.Store(int64(opts.Dimension))
+	return lc, nil
+}
+
+func (lc *LlamaCpp) EmbedImage(ctx context.Context, imageData []byte) (ImageEmbedding, error) {
+	vec, err := lc.embed(ctx, llamaCppRequest{
+		Content:   "[img-1]",
+		ImageData: []llamaCppImage{{Data: base64.StdEncoding.EncodeToString(imageData), ID: 1}},
+	})
+	return ImageEmbedding{Vector: vec}, err
+}
+
+func (lc *LlamaCpp) EmbedText(ctx context.Context, text string) ([]float32, error) {
+	return lc.embed(ctx, llamaCppRequest{Content: text})
+}
+
+func (lc *LlamaCpp) embed(ctx context.Context, req llamaCppRequest) ([]float32, error) {
+	var raw json.RawMessage
+	err := lc.client.PostJSON(ctx, "/embedding", req, &raw)
+	if err != nil {
+		return nil, err
+	}
+	vec, err := parseLlamaCppResponse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := lc.check(vec); err != nil {
+		return nil, err
+	}
+	return vecmath.Normalize(vec), nil
+}
+
+// the response shape has changed between server versions:
+//
+//	{"embedding": [...]}
+//	[{"index": 0, "embedding": [...]}]
+//	[{"index": 0, "embedding": [[...]]}] (one vector per token when pooling is disabled, we use the last)
+func parseLlamaCppResponse(raw json.RawMessage) ([]float32, error) {
+	type item struct {
+		Embedding json.RawMessage `json:"embedding"`
+	}
+	var single item
+	if err := json.Unmarshal(raw, &single); err != nil {
+		var list []item
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, fmt.Errorf("failed to decode server response: %w", err)
+		}
+		if len(list) == 0 {
+			return nil, fmt.Errorf("server returned no embeddings")
+		}
+		single = list[0]
+	}
+
+	var vec []float32
+	if err := json.Unmarshal(single.Embedding, &vec); err == nil {
+		return vec, nil
+	}
+	var perToken [][]float32
+	if err := json.Unmarshal(single.Embedding, &perToken); err != nil {
+		return nil, fmt.Errorf("failed to decode embedding: %w", err)
+	}
+	if len(perToken) == 0 {
+		return nil, fmt.Errorf("server returned no embeddings")
+	}
+	return perToken[len(perToken)-1], nil
+}
+
+func (lc *LlamaCpp) ModelID() string {
+	return lc.model
+}
+
+func (lc *LlamaCpp) Close() error {
+	return nil
+}
@@ -0,0 +1,202 @@
+//go:build onnx
+
+package embedder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"sync"
+
+	"github.com/crimro-se/imagedb/pkg/cliptokenizer"
+	"github.com/crimro-se/imagedb/pkg/vecmath"
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// ONNX embeds in-process with ONNX Runtime on the CPU, so no server is needed.
+// It runs a CLIP (or compatible) model split into image and text halves,
+// plus optionally the aesthetic predictor, as exported by embeddingserver/export_onnx.py
+type ONNX struct {
+	dimension
+	model     string
+	imageSize int
+	tokenizer *cliptokenizer.Tokenizer
+	image     *ort.DynamicAdvancedSession
+	text      *ort.DynamicAdvancedSession
+	aesthetic *ort.DynamicAdvancedSession // nil if not configured
+}
+
+const defaultONNXImageSize = 224
+
+// the onnxruntime environment is process wide, and is left up once initialised
+var (
+	ortOnce sync.Once
+	ortErr  error
+)
+
+func newONNX(opts Options) (Embedder, error) {
+	o := opts.ONNX
+	if len(o.ImageModel) == 0 || len(o.TextModel) == 0 || len(o.TokenizerDir) == 0 {
+		return nil, errors.New("the onnx embedding backend requires an image model, a text model and a tokenizer directory")
+	}
+	ortOnce.Do(func() {
+		if len(o.Library) > 0 {
+			ort.SetSharedLibraryPath(o.Library)
+		}
+		ortErr = ort.InitializeEnvironment()
+	})
+	if ortErr != nil {
+		return nil, fmt.Errorf("failed to initialise onnxruntime: %w", ortErr)
+	}
+
+	tokenizer, err := cliptokenizer.Load(o.TokenizerDir)
+	if err != nil {
+		return nil, err
+	}
+	sessionOptions, err := ort.NewSessionOptions()
+	if err != nil {
+		return nil, err
+	}
+	defer sessionOptions.Destroy()
+	if o.Threads > 0 {
+		if err := sessionOptions.SetIntraOpNumThreads(o.Threads); err != nil {
+			return nil, err
+		}
+	}
+
+	on := &ONNX{
+		model:     opts.Model,
+		imageSize: o.ImageSize,
+		tokenizer: tokenizer,
+	}
+	if len(on.model) == 0 {
+		on.model = DefaultLitServeModel
+	}
+	if on.imageSize <= 0 {
+		on.imageSize = defaultONNXImageSize
+	}
+	on.n.Store(int64(opts.Dimension))
+
+	on.image, err = ort.NewDynamicAdvancedSession(o.ImageModel,
+		[]string{"pixel_values"}, []string{"image_embeds"}, sessionOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load image model: %w", err)
+	}
+	on.text, err = ort.NewDynamicAdvancedSession(o.TextModel,
+		[]string{"input_ids", "attention_mask"}, []string{"text_embeds"}, sessionOptions)
+	if err != nil {
+		on.Close()
+		return nil, fmt.Errorf("failed to load text model: %w", err)
+	}
+	if len(o.AestheticModel) > 0 {
+		on.aesthetic, err = ort.NewDynamicAdvancedSession(o.AestheticModel,
+			[]string{"embedding"}, []string{"score"}, sessionOptions)
+		if err != nil {
+			on.Close()
+			return nil, fmt.Errorf("failed to load aesthetic model: %w", err)
+		}
+	}
+	return on, nil
+}
+
+func (on *ONNX) EmbedImage(ctx context.Context, imageData []byte) (ImageEmbedding, error) {
+	if err := ctx.Err(); err != nil {
+		return ImageEmbedding{}, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return ImageEmbedding{}, err
+	}
+	input, err := ort.NewTensor(ort.NewShape(1, 3, int64(on.imageSize), int64(on.imageSize)),
+		clipPixelValues(img, on.imageSize))
+	if err != nil {
+		return ImageEmbedding{}, err
+	}
+	defer input.Destroy()
+	vec, err := run(on.image, input)
+	if err != nil {
+		return ImageEmbedding{}, err
+	}
+	if err := on.check(vec); err != nil {
+		return ImageEmbedding{}, err
+	}
+	emb := ImageEmbedding{Vector: vecmath.Normalize(vec)}
+	if on.aesthetic == nil {
+		return emb, nil
+	}
+
+	// the aesthetic predictor was trained on normalised embeddings
+	embTensor, err := ort.NewTensor(ort.NewShape(1, int64(len(emb.Vector))), emb.Vector)
+	if err != nil {
+		return ImageEmbedding{}, err
+	}
+	defer embTensor.Destroy()
+	score, err := run(on.aesthetic, embTensor)
+	if err != nil {
+		return ImageEmbedding{}, err
+	}
+	if len(score) != 1 {
+		return ImageEmbedding{}, fmt.Errorf("aesthetic model produced %d values, expected 1", len(score))
+	}
+	emb.Aesthetic, emb.HasAesthetic = score[0], true
+	return emb, nil
+}
+
+func (on *ONNX) EmbedText(ctx context.Context, text string) ([]float32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ids, mask := on.tokenizer.EncodePadded(text, cliptokenizer.ContextLength)
+	shape := ort.NewShape(1, int64(len(ids)))
+	idsTensor, err := ort.NewTensor(shape, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer idsTensor.Destroy()
+	maskTensor, err := ort.NewTensor(shape, mask)
+	if err != nil {
+		return nil, err
+	}
+	defer maskTensor.Destroy()
+	vec, err := run(on.text, idsTensor, maskTensor)
+	if err != nil {
+		return nil, err
+	}
+	if err := on.check(vec); err != nil {
+		return nil, err
+	}
+	return vecmath.Normalize(vec), nil
+}
+
+// runs session on inputs, returning a copy of its single float32 output.
+// Sessions may be run concurrently, as each run has its own tensors.
+func run(session *ort.DynamicAdvancedSession, inputs ...ort.Value) ([]float32, error) {
+	outputs := []ort.Value{nil} // allocated by onnxruntime
+	if err := session.Run(inputs, outputs); err != nil {
+		return nil, err
+	}
+	defer outputs[0].Destroy()
+	tensor, ok := outputs[0].(*ort.Tensor[float32])
+	if !ok {
+		return nil, errors.New("model output isn't a float32 tensor")
+	}
+	return append([]float32(nil), tensor.GetData()...), nil
+}
+
+func (on *ONNX) ModelID() string {
+	return on.model
+}
+
+func (on *ONNX) Close() error {
+	var errs []error
+	for _, session := range []*ort.DynamicAdvancedSession{on.image, on.text, on.aesthetic} {
+		if session != nil {
+			errs = append(errs, session.Destroy())
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,9 @@
+//go:build !onnx
+
+package embedder
+
+import "errors"
+
+func newONNX(opts Options) (Embedder, error) {
+	return nil, errors.New("imagedb was built without onnx support, rebuild with -tags onnx to use the onnx embedder")
+}
@@ -0,0 +1,83 @@
+package embedder
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/crimro-se/imagedb/embeddingserver"
+	"github.com/crimro-se/imagedb/pkg/vecmath"
+)
+
+// OpenAI embeds via an OpenAI-compatible /v1/embeddings endpoint.
+// Images are sent as data URIs, which servers hosting multimodal models (eg CLIP or SigLIP)
+// accept in place of text.
+type OpenAI struct {
+	dimension
+	client *embeddingserver.Client
+	model  string
+}
+
+type openAIRequest struct {
+	Model          string   `json:"model"`
+	Input          []string `json:"input"`
+	EncodingFormat string   `json:"encoding_format"`
+	Dimensions     int      `json:"dimensions,omitempty"`
+}
+
+type openAIResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+func newOpenAI(ctx context.Context, opts Options) (*OpenAI, error) {
+	if len(opts.Model) == 0 {
+		return nil, fmt.Errorf("the openai embedding backend requires a model name")
+	}
+	oa := &OpenAI{
+		client: newClient(ctx, opts),
+		model:  opts.Model,
+	}
+	oa.n.Store(int64(opts.Dimension))
+	return oa, nil
+}
+
+func (oa *OpenAI) EmbedImage(ctx context.Context, imageData []byte) (ImageEmbedding, error) {
+	vec, err := oa.embed(ctx, "data:image/png;base64,"+base64.StdEncoding.EncodeToString(imageData))
+	return ImageEmbedding{Vector: vec}, err
+}
+
+func (oa *OpenAI) EmbedText(ctx context.Context, text string) ([]float32, error) {
+	return oa.embed(ctx, text)
+}
+
+func (oa *OpenAI) embed(ctx context.Context, input string) ([]float32, error) {
+	var resp openAIResponse
+	req := openAIRequest{
+		Model:          oa.model,
+		Input:          []string{input},
+		EncodingFormat: "float",
+	}
+	err := oa.client.PostJSON(ctx, "/v1/embeddings", req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Data) != 1 {
+		return nil, fmt.Errorf("server returned %d embeddings, expected 1", len(resp.Data))
+	}
+	vec := resp.Data[0].Embedding
+	if err := oa.check(vec); err != nil {
+		return nil, err
+	}
+	return vecmath.Normalize(vec), nil
+}
+
+func (oa *OpenAI) ModelID() string {
+	return oa.model
+}
+
+func (oa *OpenAI) Close() error {
+	return nil
+}
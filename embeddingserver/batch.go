@@ -0,0 +1,188 @@
+package embeddingserver
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrClosed = errors.New("embedding batch client is closed")
+
+// BatchClient accumulates embedding tasks submitted concurrently (eg, by every archivewalk worker)
+// and sends them to the server as a single request, then hands each caller its own result.
+// A batch is sent once it holds size tasks, or linger has passed since its first task arrived.
+type BatchClient struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	client   *Client
+	size     int
+	linger   time.Duration
+	requests chan batchRequest
+	done     chan struct{}
+	inflight sync.WaitGroup // batches currently being sent
+	loopDone chan struct{}
+	once     sync.Once
+}
+
+type batchRequest struct {
+	ctx    context.Context
+	task   Task
+	result chan batchResult
+}
+
+type batchResult struct {
+	emb Embedding
+	err error
+}
+
+// NewBatchClient starts a batching goroutine in front of client.
+// Cancelling ctx aborts batches being sent. Call Close when finished to release it.
+func NewBatchClient(ctx context.Context, client *Client, size int, linger time.Duration) *BatchClient {
+	ctx, cancel := context.WithCancel(ctx)
+	bc := &BatchClient{
+		ctx:      ctx,
+		cancel:   cancel,
+		client:   client,
+		size:     max(size, 1),
+		linger:   linger,
+		requests: make(chan batchRequest),
+		done:     make(chan struct{}),
+		loopDone: make(chan struct{}),
+	}
+	go bc.loop()
+	return bc
+}
+
+// GetImageEmbedding queues an image and blocks until its batch has been processed.
+func (bc *BatchClient) GetImageEmbedding(imageData []byte) (Embedding, error) {
+	return bc.GetImageEmbeddingContext(context.Background(), imageData)
+}
+
+func (bc *BatchClient) GetImageEmbeddingContext(ctx context.Context, imageData []byte) (Embedding, error) {
+	return bc.GetEmbeddingContext(ctx, Task{Image: base64.StdEncoding.EncodeToString(imageData)})
+}
+
+// GetTextEmbedding queues some text and blocks until its batch has been processed.
+func (bc *BatchClient) GetTextEmbedding(text string) (Embedding, error) {
+	return bc.GetEmbeddingContext(context.Background(), Task{Text: text})
+}
+
+// GetEmbedding queues a task and blocks until its batch has been processed.
+func (bc *BatchClient) GetEmbedding(task Task) (Embedding, error) {
+	return bc.GetEmbeddingContext(context.Background(), task)
+}
+
+// GetEmbeddingContext queues a task and blocks until its batch has been processed or ctx is done.
+// A batch is only abandoned, retries and all, once every caller waiting on it has given up.
+func (bc *BatchClient) GetEmbeddingContext(ctx context.Context, task Task) (Embedding, error) {
+	req := batchRequest{ctx: ctx, task: task, result: make(chan batchResult, 1)}
+	select {
+	case bc.requests <- req:
+	case <-bc.done:
+		return Embedding{}, ErrClosed
+	case <-ctx.Done():
+		return Embedding{}, ctx.Err()
+	}
+	select {
+	case res := <-req.result:
+		return res.emb, res.err
+	case <-ctx.Done():
+		return Embedding{}, ctx.Err()
+	}
+}
+
+// Close stops accepting new tasks and aborts any batches still being sent.
+// Safe to call more than once.
+func (bc *BatchClient) Close() {
+	bc.once.Do(func() {
+		close(bc.done)
+		bc.cancel()
+		<-bc.loopDone
+		bc.inflight.Wait()
+	})
+}
+
+// collects requests into batches and dispatches them
+func (bc *BatchClient) loop() {
+	defer close(bc.loopDone)
+	pending := make([]batchRequest, 0, bc.size)
+	timer := time.NewTimer(bc.linger)
+	timer.Stop()
+
+	flush := func() {
+		timer.Stop()
+		if len(pending) == 0 {
+			return
+		}
+		batch := pending
+		pending = make([]batchRequest, 0, bc.size)
+		bc.inflight.Add(1)
+		go func() {
+			defer bc.inflight.Done()
+			bc.send(batch)
+		}()
+	}
+
+	for {
+		select {
+		case <-bc.done:
+			flush()
+			return
+		case req := <-bc.requests:
+			pending = append(pending, req)
+			if len(pending) == 1 {
+				timer.Reset(bc.linger)
+			}
+			if len(pending) >= bc.size {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// sends one batch and fans the results back out to the waiting callers
+func (bc *BatchClient) send(batch []batchRequest) {
+	// callers that gave up while the batch was filling aren't sent
+	live := make([]batchRequest, 0, len(batch))
+	for _, req := range batch {
+		if err := req.ctx.Err(); err != nil {
+			req.result <- batchResult{err: err}
+			continue
+		}
+		live = append(live, req)
+	}
+	if len(live) == 0 {
+		return
+	}
+	batch = live
+
+	ctx, cancel := context.WithCancel(bc.ctx)
+	defer cancel()
+	var waiting atomic.Int32
+	waiting.Store(int32(len(batch)))
+	tasks := make([]Task, len(batch))
+	for i, req := range batch {
+		tasks[i] = req.task
+		tasks[i].Id = strconv.Itoa(i)
+		stop := context.AfterFunc(req.ctx, func() {
+			if waiting.Add(-1) == 0 {
+				cancel()
+			}
+		})
+		defer stop()
+	}
+	embs, err := bc.client.GetEmbeddingsContext(ctx, tasks)
+	for i, req := range batch {
+		if err != nil {
+			req.result <- batchResult{err: err}
+			continue
+		}
+		req.result <- batchResult{emb: embs[i]}
+	}
+}
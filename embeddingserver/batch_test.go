@@ -0,0 +1,120 @@
+package embeddingserver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a stand-in for server.py which answers batches with an embedding derived from the text
+func newFakeServer(t *testing.T, requests *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		var payload batchPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("fake server failed to decode request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp := batchResponse{Results: make([]Embedding, len(payload.Batch))}
+		for i, task := range payload.Batch {
+			n, _ := strconv.Atoi(task.Text)
+			resp.Results[i] = Embedding{Embedding: []float32{float32(n)}, Aesthetic: float32(n)}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func TestBatchClientFansOutResults(t *testing.T) {
+	var requests atomic.Int32
+	server := newFakeServer(t, &requests)
+	defer server.Close()
+
+	const callers = 40
+	bc := NewBatchClient(context.Background(), NewClient(server.URL), 8, 20*time.Millisecond)
+	defer bc.Close()
+
+	var wg sync.WaitGroup
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			emb, err := bc.GetTextEmbedding(strconv.Itoa(i))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(emb.Embedding) != 1 || emb.Embedding[0] != float32(i) {
+				t.Errorf("caller %d got someone else's result: %v", i, emb.Embedding)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if requests.Load() >= callers {
+		t.Errorf("expected tasks to be batched, but %d requests were made for %d tasks", requests.Load(), callers)
+	}
+}
+
+func TestBatchClientLingerFlushesPartialBatch(t *testing.T) {
+	var requests atomic.Int32
+	server := newFakeServer(t, &requests)
+	defer server.Close()
+
+	bc := NewBatchClient(context.Background(), NewClient(server.URL), 100, 10*time.Millisecond)
+	defer bc.Close()
+
+	emb, err := bc.GetTextEmbedding("3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emb.Aesthetic != 3 {
+		t.Errorf("unexpected result %v", emb)
+	}
+}
+
+func TestBatchClientClosed(t *testing.T) {
+	bc := NewBatchClient(context.Background(), NewClient("http://127.0.0.1:0"), 4, time.Millisecond)
+	bc.Close()
+	_, err := bc.GetTextEmbedding("1")
+	if err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestBatchClientCallerCancelled(t *testing.T) {
+	abandoned := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// nb: the server only notices the client going away once the body has been read
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+		close(abandoned)
+	}))
+	defer server.Close()
+
+	bc := NewBatchClient(context.Background(), NewClient(server.URL), 1, time.Millisecond)
+	defer bc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := bc.GetEmbeddingContext(ctx, Task{Text: "1"}); err != context.DeadlineExceeded {
+		t.Errorf("expected the caller's deadline, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("cancelling took too long: %v", time.Since(start))
+	}
+	// with its only caller gone, the batch's request should be abandoned rather than retried
+	select {
+	case <-abandoned:
+	case <-time.After(time.Second):
+		t.Error("expected the batch's request to be cancelled")
+	}
+}
@@ -0,0 +1,117 @@
+package embeddingserver
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// CircuitBreaker pauses requests to a server which appears to be down.
+// After threshold consecutive failed requests the breaker opens; from then on Wait blocks
+// while the server is polled with probe, and once probe succeeds the breaker closes and
+// every waiting request resumes.
+type CircuitBreaker struct {
+	ctx       context.Context
+	threshold int
+	interval  time.Duration
+	probe     func() bool
+	onChange  func(open bool) // optional, eg to tell the user indexing is paused
+
+	mutex    sync.Mutex
+	failures int
+	open     bool
+	resumed  chan struct{} // closed when the breaker closes again
+}
+
+// NewCircuitBreaker creates a closed breaker. Probing stops when ctx is done.
+func NewCircuitBreaker(ctx context.Context, threshold int, interval time.Duration, probe func() bool, onChange func(open bool)) *CircuitBreaker {
+	return &CircuitBreaker{
+		ctx:       ctx,
+		threshold: max(threshold, 1),
+		interval:  interval,
+		probe:     probe,
+		onChange:  onChange,
+	}
+}
+
+// Wait returns immediately if the breaker is closed,
+// otherwise it blocks until the server recovers or ctx is done.
+func (cb *CircuitBreaker) Wait(ctx context.Context) error {
+	cb.mutex.Lock()
+	if !cb.open {
+		cb.mutex.Unlock()
+		return nil
+	}
+	resumed := cb.resumed
+	cb.mutex.Unlock()
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-cb.ctx.Done():
+		return cb.ctx.Err()
+	}
+}
+
+// Success records a successful request.
+func (cb *CircuitBreaker) Success() {
+	cb.mutex.Lock()
+	cb.failures = 0
+	cb.mutex.Unlock()
+}
+
+// Failure records a failed request, and reports whether the breaker is now open.
+func (cb *CircuitBreaker) Failure() bool {
+	cb.mutex.Lock()
+	cb.failures++
+	if cb.open || cb.failures < cb.threshold {
+		open := cb.open
+		cb.mutex.Unlock()
+		return open
+	}
+	cb.open = true
+	cb.resumed = make(chan struct{})
+	cb.mutex.Unlock()
+
+	cb.notify(true)
+	go cb.probeUntilHealthy()
+	return true
+}
+
+// Open reports whether requests are currently paused.
+func (cb *CircuitBreaker) Open() bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.open
+}
+
+// polls the server until it responds, then closes the breaker
+func (cb *CircuitBreaker) probeUntilHealthy() {
+	ticker := time.NewTicker(cb.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cb.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !cb.probe() {
+			continue
+		}
+		cb.mutex.Lock()
+		cb.open = false
+		cb.failures = 0
+		close(cb.resumed)
+		cb.mutex.Unlock()
+		cb.notify(false)
+		return
+	}
+}
+
+func (cb *CircuitBreaker) notify(open bool) {
+	if cb.onChange != nil {
+		cb.onChange(open)
+	}
+}
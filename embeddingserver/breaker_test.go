@@ -0,0 +1,164 @@
+package embeddingserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a server which fails with 503 until told otherwise
+func newFlakyServer(healthy *atomic.Bool, requests *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			if healthy.Load() {
+				w.Write([]byte("ok"))
+			} else {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		requests.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(Embedding{Embedding: []float32{1}, Aesthetic: 5})
+	}))
+}
+
+func TestClientRetriesTransientErrors(t *testing.T) {
+	var fails atomic.Int32
+	fails.Store(2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fails.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		json.NewEncoder(w).Encode(Embedding{Aesthetic: 5})
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.RetryBackoff = time.Millisecond
+	emb, err := client.GetTextEmbedding("retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emb.Aesthetic != 5 {
+		t.Errorf("unexpected result %v", emb)
+	}
+}
+
+func TestClientDoesNotRetryBadRequests(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.RetryBackoff = time.Millisecond
+	_, err := client.GetTextEmbedding("bad")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if requests.Load() != 1 {
+		t.Errorf("expected 1 request, got %d", requests.Load())
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.Timeout = 10 * time.Millisecond
+	client.MaxRetries = 1
+	client.RetryBackoff = time.Millisecond
+	start := time.Now()
+	_, err := client.GetTextEmbedding("slow")
+	if err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if time.Since(start) > 150*time.Millisecond {
+		t.Errorf("timeout took too long: %v", time.Since(start))
+	}
+}
+
+func TestCircuitBreakerPausesUntilHealthy(t *testing.T) {
+	var healthy atomic.Bool
+	var requests atomic.Int32
+	server := newFlakyServer(&healthy, &requests)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var opened, closed atomic.Int32
+	client := NewClient(server.URL)
+	client.MaxRetries = 0
+	client.RetryBackoff = time.Millisecond
+	client.Breaker = NewCircuitBreaker(ctx, 1, 5*time.Millisecond, client.Healthy, func(open bool) {
+		if open {
+			opened.Add(1)
+		} else {
+			closed.Add(1)
+		}
+	})
+
+	result := make(chan error)
+	go func() {
+		_, err := client.GetTextEmbedding("paused")
+		result <- err
+	}()
+
+	// the request should be held rather than failing while the server is down
+	select {
+	case err := <-result:
+		t.Fatalf("request returned while server was down: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !client.Breaker.Open() {
+		t.Fatal("breaker should be open")
+	}
+
+	healthy.Store(true)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("request didn't resume once the server was healthy")
+	}
+	if opened.Load() != 1 || closed.Load() != 1 {
+		t.Errorf("expected one open and one close notification, got %d and %d", opened.Load(), closed.Load())
+	}
+}
+
+func TestCircuitBreakerWaitCancelled(t *testing.T) {
+	var healthy atomic.Bool
+	var requests atomic.Int32
+	server := newFlakyServer(&healthy, &requests)
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.MaxRetries = 0
+	client.Breaker = NewCircuitBreaker(context.Background(), 1, time.Hour, client.Healthy, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err := client.GetEmbeddingContext(ctx, Task{Text: "cancelled"})
+	if err == nil {
+		t.Fatal("expected cancellation error")
+	}
+}
@@ -2,11 +2,17 @@ package embeddingserver
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"syscall"
+	"time"
 )
 
 type Embedding struct {
@@ -20,15 +26,50 @@ type Task struct {
 	Text  string `json:"text"`
 }
 
+// the body of a request carrying several tasks at once, and its response.
+type batchPayload struct {
+	Batch []Task `json:"batch"`
+}
+
+type batchResponse struct {
+	Results []Embedding `json:"results"`
+}
+
+// all Clients share one keep-alive http client, so that the many indexing threads
+// reuse a small number of connections rather than opening one per image.
+// nb: it doesn't limit how long a request takes, their context does, see Client.Timeout
+var sharedHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        64,
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
 // Client represents the client that interacts with the image processing server.
 type Client struct {
-	ServerURL string // URL of the server endpoint
+	ServerURL    string          // URL of the server endpoint
+	Timeout      time.Duration   // limit for a single attempt at a request
+	MaxRetries   int             // how many times a request failing with a transient error is retried
+	RetryBackoff time.Duration   // delay before the first retry, doubled for each one after
+	Breaker      *CircuitBreaker // optional. when set, requests wait out server outages instead of failing
+	Header       http.Header     // optional extra headers sent with every request, eg Authorization
+	httpClient   *http.Client
 }
 
 // NewClient creates a new instance of Client.
 func NewClient(serverURL string) *Client {
 	return &Client{
-		ServerURL: serverURL,
+		ServerURL:    serverURL,
+		Timeout:      60 * time.Second,
+		MaxRetries:   3,
+		RetryBackoff: 500 * time.Millisecond,
+		httpClient:   sharedHTTPClient,
 	}
 }
 
@@ -51,36 +92,169 @@ func (c *Client) GetTextEmbedding(text string) (Embedding, error) {
 }
 
 func (c *Client) GetEmbedding(payload Task) (Embedding, error) {
-	payloadJSON, err := json.Marshal(payload)
+	return c.GetEmbeddingContext(context.Background(), payload)
+}
+
+func (c *Client) GetEmbeddingContext(ctx context.Context, payload Task) (Embedding, error) {
 	result := Embedding{}
+	err := c.PostJSON(ctx, "/predict", payload, &result)
+	return result, err
+}
+
+// GetEmbeddings submits several tasks in a single request.
+// Results are returned in the same order as the tasks.
+func (c *Client) GetEmbeddings(tasks []Task) ([]Embedding, error) {
+	return c.GetEmbeddingsContext(context.Background(), tasks)
+}
+
+func (c *Client) GetEmbeddingsContext(ctx context.Context, tasks []Task) ([]Embedding, error) {
+	var result batchResponse
+	err := c.PostJSON(ctx, "/predict", batchPayload{Batch: tasks}, &result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Results) != len(tasks) {
+		return nil, fmt.Errorf("server returned %d results for %d tasks", len(result.Results), len(tasks))
+	}
+	return result.Results, nil
+}
+
+// Healthy reports whether the server's health endpoint currently responds.
+func (c *Client) Healthy() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.ServerURL+"/health", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return false
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// an unsuccessful http response from the server
+type statusError struct {
+	code int
+	body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("server responded with status code: %d, response body: %s", e.code, e.body)
+}
+
+// PostJSON posts payload as json to path on the server and decodes the response into result.
+// Transient failures are retried with exponential backoff, and if a Breaker is set
+// we wait for the server to become healthy again rather than give up.
+// Besides /predict, this lets other embedding APIs be used with the same retry behaviour.
+func (c *Client) PostJSON(ctx context.Context, path string, payload any, result any) error {
+	payloadJSON, err := json.Marshal(payload)
 	if err != nil {
-		return result, fmt.Errorf("failed to marshal payload: %w", err)
+		return fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, c.ServerURL+"/predict", bytes.NewBuffer(payloadJSON))
+	for attempt := 0; ; attempt++ {
+		if c.Breaker != nil {
+			if err := c.Breaker.Wait(ctx); err != nil {
+				return err
+			}
+		}
+		err = c.postOnce(ctx, path, payloadJSON, result)
+		if err == nil {
+			if c.Breaker != nil {
+				c.Breaker.Success()
+			}
+			return nil
+		}
+		if ctx.Err() != nil || !isTransient(err) {
+			return err
+		}
+		if attempt < c.MaxRetries {
+			if err := sleepContext(ctx, backoff(c.RetryBackoff, attempt)); err != nil {
+				return err
+			}
+			continue
+		}
+		// out of retries. If this tripped the breaker, wait for the server and start over.
+		if c.Breaker != nil && c.Breaker.Failure() {
+			attempt = -1
+			continue
+		}
+		return err
+	}
+}
+
+// a single attempt at posting the (already marshalled) payload
+func (c *Client) postOnce(ctx context.Context, path string, payloadJSON []byte, result any) error {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.ServerURL+path, bytes.NewReader(payloadJSON))
 	if err != nil {
-		return result, fmt.Errorf("failed to create request: %w", err)
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return result, fmt.Errorf("failed to send request: %w", err)
+		return fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 300 {
 		body, _ := io.ReadAll(resp.Body)
-		return result, fmt.Errorf("server responded with status code: %d, response body: %s", resp.StatusCode, string(body))
+		return &statusError{code: resp.StatusCode, body: string(body)}
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&result)
+	err = json.NewDecoder(resp.Body).Decode(result)
 	if err != nil {
-		return result, fmt.Errorf("failed to decode server response: %w", err)
+		return fmt.Errorf("failed to decode server response: %w", err)
 	}
+	// drain anything left so the connection can be reused
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	return nil
+}
 
-	//fmt.Printf("Task submitted successfully with result: %+v\n", result)
+// transient errors are those worth retrying: the server being unreachable, overloaded or slow.
+func isTransient(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests || se.code == http.StatusRequestTimeout
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
 
-	return result, nil
+const maxBackoff = 30 * time.Second
+
+// the delay before retry number attempt (starting at 0), with up to 25% jitter
+func backoff(base time.Duration, attempt int) time.Duration {
+	d := base << min(attempt, 16)
+	if d <= 0 || d > maxBackoff {
+		d = maxBackoff
+	}
+	return d + time.Duration(rand.Int64N(int64(d)/4+1))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
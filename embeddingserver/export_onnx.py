@@ -0,0 +1,73 @@
+# Exports the models used by server.py to ONNX, for imagedb's in-process onnx embedder
+# (build imagedb with -tags onnx). Writes to the output directory:
+#   image.onnx      pixel_values -> image_embeds
+#   text.onnx       input_ids, attention_mask -> text_embeds
+#   aesthetic.onnx  embedding -> score
+#   vocab.json, merges.txt (the tokenizer)
+#
+# usage: python export_onnx.py [output_dir]
+import sys
+import os
+import torch
+import torch.nn as nn
+from transformers import CLIPModel, CLIPTokenizer
+from safetensors.torch import load_file
+
+from server import MLP
+
+MODEL = "openai/clip-vit-large-patch14"
+OPSET = 17
+
+
+class ImageHalf(nn.Module):
+    def __init__(self, model):
+        super().__init__()
+        self.model = model
+
+    def forward(self, pixel_values):
+        return self.model.get_image_features(pixel_values=pixel_values)
+
+
+class TextHalf(nn.Module):
+    def __init__(self, model):
+        super().__init__()
+        self.model = model
+
+    def forward(self, input_ids, attention_mask):
+        return self.model.get_text_features(input_ids=input_ids, attention_mask=attention_mask)
+
+
+def main():
+    out = sys.argv[1] if len(sys.argv) > 1 else "onnx"
+    os.makedirs(out, exist_ok=True)
+
+    model = CLIPModel.from_pretrained(MODEL).eval()
+    size = model.config.vision_config.image_size
+    batch = {0: "batch"}
+
+    with torch.no_grad():
+        torch.onnx.export(
+            ImageHalf(model), (torch.zeros(1, 3, size, size),), os.path.join(out, "image.onnx"),
+            input_names=["pixel_values"], output_names=["image_embeds"],
+            dynamic_axes={"pixel_values": batch, "image_embeds": batch}, opset_version=OPSET)
+
+        ids = torch.zeros(1, 77, dtype=torch.int64)
+        torch.onnx.export(
+            TextHalf(model), (ids, torch.ones_like(ids)), os.path.join(out, "text.onnx"),
+            input_names=["input_ids", "attention_mask"], output_names=["text_embeds"],
+            dynamic_axes={"input_ids": batch, "attention_mask": batch, "text_embeds": batch}, opset_version=OPSET)
+
+        aesthetic = MLP(model.config.projection_dim)
+        aesthetic.load_state_dict(load_file("sac+logos+ava1-l14-linearMSE.safetensors"))
+        aesthetic.eval()
+        torch.onnx.export(
+            aesthetic, (torch.zeros(1, model.config.projection_dim),), os.path.join(out, "aesthetic.onnx"),
+            input_names=["embedding"], output_names=["score"],
+            dynamic_axes={"embedding": batch, "score": batch}, opset_version=OPSET)
+
+    CLIPTokenizer.from_pretrained(MODEL).save_vocabulary(out)
+    print(f"exported {MODEL} to {out}, image size {size}")
+
+
+if __name__ == "__main__":
+    main()
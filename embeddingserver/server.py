@@ -64,6 +64,10 @@ class ClipLitAPI(ls.LitAPI):
             print(f"Received a list instead of a dictionary: {request}")
             raise ValueError("Unexpected list received")
 
+        # a client-side batch of tasks, sent as {"batch": [task, ...]}
+        if "batch" in request:
+            return [self._decode_single(item) for item in request["batch"]]
+
         return self._decode_single(request)
     
     def _decode_single(self, item):
@@ -84,6 +88,30 @@ class ClipLitAPI(ls.LitAPI):
         return {"id": task_id, "image": image, "text": text}
 
     def predict(self, batch):
+        # requests may themselves be client-side batches, so flatten them first
+        # and regroup the results afterwards
+        flat, sizes = [], []
+        for item in batch:
+            if isinstance(item, list):
+                flat.extend(item)
+                sizes.append(len(item))
+            else:
+                flat.append(item)
+                sizes.append(None)
+
+        flat_results = self._predict_flat(flat)
+
+        results, pos = [], 0
+        for size in sizes:
+            if size is None:
+                results.append(flat_results[pos])
+                pos += 1
+            else:
+                results.append(flat_results[pos:pos + size])
+                pos += size
+        return results
+
+    def _predict_flat(self, batch):
         # Split batch into images and texts
         image_indices, images = [], []
         text_indices, texts = [], []
@@ -143,6 +171,8 @@ class ClipLitAPI(ls.LitAPI):
         return results
 
     def encode_response(self, output):
+        if isinstance(output, list):
+            return {"results": output}
         return output
 
 if __name__ == "__main__":
@@ -9,6 +9,7 @@ require (
 	github.com/jmoiron/sqlx v1.4.0
 	github.com/mattn/go-sqlite3 v1.14.24
 	github.com/nwaples/rardecode/v2 v2.1.1
+	github.com/yalue/onnxruntime_go v1.26.0
 	golang.org/x/image v0.25.0
 )
 
@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/container"
@@ -15,10 +16,8 @@ import (
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
 	"fyne.io/fyne/v2/widget"
-	sqlite_vec "github.com/asg017/sqlite-vec-go-bindings/cgo"
-	"github.com/crimro-se/imagedb/embeddingserver"
+	"github.com/crimro-se/imagedb/embedder"
 	"github.com/crimro-se/imagedb/internal/imagedbutil"
-	"github.com/crimro-se/imagedb/pkg/archivewalk"
 	"github.com/crimro-se/imagedb/pkg/imageutil"
 	"github.com/skratchdot/open-golang/open"
 )
@@ -26,32 +25,47 @@ import (
 type GUI struct {
 	window   fyne.Window
 	db       *Database
+	dbFile   string // the library, ie database file, db was opened from
 	conf     *Config
+	confFile string // where the Settings dialog saves conf
 	actables []*widget.DisableableWidget
 
+	library     *widget.Select // recently opened libraries, see gui_library.go
+	autoTagging atomic.Bool    // libraries can't be switched while AutoTag uses db
+
 	guiBasedirs   *fyne.Container //vbox container
 	basedirsState map[int64]binding.Bool
 
 	imageList *ImageList
 	log       *widget.Entry
 	imgInfo   *widget.Entry
+	imgTags   *widget.Entry  // the shown image's tags, editable
+	imgTagsID int64          // the image imgTags belongs to, 0 if none
+	diversity *widget.Slider // QueryFilter.Diversity
+
+	embedder embedder.Embedder // for text queries
 
-	indexingDialogue *ImageProcessDialogue
-	busyDialogue     *BusyDialogue
-	active           bool
+	indexQueue     *IndexQueue // the library's, see gui_indexqueue.go
+	stopIndexQueue func()      // stops it, waiting for its running jobs to stop
+	jobsDialogue   *IndexJobsDialogue
+	busyDialogue   *BusyDialogue
+	active         bool
 }
 
-func NewGUI(window fyne.Window, db *Database, conf *Config) *GUI {
+func NewGUI(window fyne.Window, db *Database, dbFile, confFile string, conf *Config) *GUI {
 	gui := GUI{
 		window:   window,
 		db:       db,
+		dbFile:   dbFile,
 		conf:     conf,
+		confFile: confFile,
 		actables: make([]*widget.DisableableWidget, 0),
 
 		basedirsState: make(map[int64]binding.Bool),
 		guiBasedirs:   container.NewVBox(),
 	}
 	gui.Build()
+	gui.addRecentLibrary(dbFile)
 	return &gui
 }
 
@@ -158,15 +172,21 @@ func (gui *GUI) buildIndexButtons() *fyne.Container {
 
 	updateIndexBtn := widget.NewButton("Update", func() {
 		activeBasedirs := gui.getActiveBasedirs()
-		if len(activeBasedirs) != 1 {
-			dialog.NewInformation("", "Select only exactly one index first", gui.window).Show()
+		if len(activeBasedirs) == 0 {
+			dialog.NewInformation("", "Select at least one index first", gui.window).Show()
 			return
 		}
-		err := gui.indexingDialogue.Show("db.sqlite", activeBasedirs[0], gui.conf.API_SERVER)
-		if err != nil {
-			gui.ShowError(err)
+		if gui.indexQueue == nil {
+			gui.ShowError(fmt.Errorf("indexing is unavailable, see the errors above"))
 			return
 		}
+		if _, err := gui.indexQueue.Add(activeBasedirs...); err != nil {
+			gui.ShowError(err)
+		}
+		gui.jobsDialogue.Show()
+	})
+	jobsBtn := widget.NewButton("Jobs", func() {
+		gui.jobsDialogue.Show()
 	})
 
 	deleteIndexBtn := widget.NewButton("Delete", func() {
@@ -175,6 +195,12 @@ func (gui *GUI) buildIndexButtons() *fyne.Container {
 			dialog.NewInformation("", "Select only exactly one index first", gui.window).Show()
 			return
 		}
+		if gui.indexQueue != nil {
+			if busy, err := gui.indexQueue.Busy(activeBasedirs[0].ID); busy || err != nil {
+				dialog.NewInformation("", "Cancel the index's indexing job first", gui.window).Show()
+				return
+			}
+		}
 
 		gui.deactivateAll()
 		defer gui.activateAll()
@@ -185,10 +211,21 @@ func (gui *GUI) buildIndexButtons() *fyne.Container {
 		gui.rebuildBasedirs()
 	})
 
+	var autoTagBtn *widget.Button
+	autoTagBtn = widget.NewButton("Auto Tag", func() {
+		autoTagBtn.Disable()
+		gui.autoTagging.Store(true)
+		go func() {
+			defer autoTagBtn.Enable()
+			defer gui.autoTagging.Store(false)
+			gui.AutoTag()
+		}()
+	})
+
 	gui.actables = append(gui.actables, &addIndexBtn.DisableableWidget)
 	gui.actables = append(gui.actables, &updateIndexBtn.DisableableWidget)
 	gui.actables = append(gui.actables, &deleteIndexBtn.DisableableWidget)
-	indexesButtons := container.NewHBox(addIndexBtn, updateIndexBtn, deleteIndexBtn)
+	indexesButtons := container.NewHBox(addIndexBtn, updateIndexBtn, jobsBtn, deleteIndexBtn, autoTagBtn)
 	padded := container.New(layout.NewCustomPaddedLayout(0, 0, 48, 48), indexesButtons)
 	return padded
 }
@@ -215,19 +252,24 @@ func loadPNGFromFile(filePath string) (image.Image, error) {
 // todo: this should be a new object type
 func (gui *GUI) buildSearchGUI() *fyne.Container {
 	searchbox := widget.NewEntry()
+	searchbox.SetPlaceHolder("describe an image, eg: sunset beach w>=1920 tag:favourite -path:thumbs distance<1.2")
 	btn := widget.NewButton("Search", func() {
-		if len(searchbox.Text) == 0 {
-			gui.QueryNone()
-			return
-		}
-		gui.QueryText(searchbox.Text, gui.conf.API_SERVER)
+		gui.Search(searchbox.Text)
 	})
 
 	searchbox.OnSubmitted = func(text string) {
 		btn.OnTapped()
 	}
+	// higher values trade similarity for fewer near duplicates, eg frames of the same burst
+	gui.diversity = widget.NewSlider(0, 1)
+	gui.diversity.Step = 0.1
+	// captions thumbnails with how far they are from what was searched for, see distance< in searchquery.go
+	distances := widget.NewCheck("Distances", func(show bool) {
+		gui.imageList.SetShowDistances(show)
+	})
+	options := container.NewBorder(nil, nil, widget.NewLabel("Diversity"), container.NewHBox(distances, btn), gui.diversity)
 
-	final := container.NewGridWithColumns(2, searchbox, btn)
+	final := container.NewGridWithColumns(2, searchbox, options)
 
 	return final
 }
@@ -235,33 +277,64 @@ func (gui *GUI) buildSearchGUI() *fyne.Container {
 // generates a queryfilter based on the GUI's current settings
 // todo: gui interface for more settings
 func (gui *GUI) getQueryFilter() QueryFilter {
-	return QueryFilter{BaseDirs: gui.getActiveBasedirsID(), Limit: gui.conf.QUERY_RESULTS}
+	return QueryFilter{BaseDirs: gui.getActiveBasedirsID(), Limit: gui.conf.QUERY_RESULTS, Weights: gui.conf.RankWeights(),
+		Diversity: gui.diversity.Value}
 }
 
-func (gui *GUI) QueryText(query string, server string) {
-	gui.busyDialogue.Show("Getting text embedding...")
+// the embedder used for text queries, created on first use
+func (gui *GUI) getEmbedder() (embedder.Embedder, error) {
+	if gui.embedder == nil {
+		emb, err := embedder.New(context.Background(), gui.conf.EmbedderOptions())
+		if err != nil {
+			return nil, err
+		}
+		gui.embedder = emb
+	}
+	return gui.embedder, nil
+}
 
-	client := embeddingserver.NewClient(server)
-	embedding, err := client.GetTextEmbedding(query)
-	gui.busyDialogue.Hide()
+// runs a search typed into the search box, see searchquery.go
+func (gui *GUI) Search(text string) {
+	if len(strings.TrimSpace(text)) == 0 {
+		gui.QueryNone()
+		return
+	}
+	q, err := ParseSearchQuery(text, gui.getQueryFilter())
 	if err != nil {
 		gui.ShowError(err)
 		return
 	}
-	embeddingBytes, err := sqlite_vec.SerializeFloat32(embedding.Embedding)
+	if len(q.Filter.BaseDirs) == 0 {
+		gui.ShowError(fmt.Errorf("no active basedirs to query"))
+		return
+	}
+	gui.busyDialogue.Show("Querying database...")
+	imgs, err := q.Run(gui.db, gui.textEmbedding)
+	gui.busyDialogue.Hide()
 	if err != nil {
 		gui.ShowError(err)
 		return
 	}
+	gui.ShowImages(imgs)
+}
 
-	gui.QueryEmbedding(embeddingBytes)
+// embeds the text for searching the active model's embeddings.
+// nb: called by Search's query, while the busy dialogue is showing
+func (gui *GUI) textEmbedding(query string) ([]byte, error) {
+	emb, err := gui.getEmbedder()
+	if err != nil {
+		return nil, err
+	}
+	gui.busyDialogue.Show("Getting text embedding...")
+	defer gui.busyDialogue.Show("Querying database...")
+	return embedSearchText(context.Background(), gui.db, emb, query)
 }
 
 // Finds and displays images in the database that are most similar to the provided embedding data.
 // see also: sqlite_vec.SerializeFloat32
-func (gui *GUI) QueryEmbedding(embedding []byte) {
+func (gui *GUI) QueryEmbedding(embedding []byte, qf QueryFilter) {
 	gui.busyDialogue.Show("Querying database...")
-	imgs, err := gui.db.MatchEmbeddingsWithFilter(embedding, gui.getQueryFilter())
+	imgs, err := gui.db.MatchEmbeddingsWithFilter(embedding, qf)
 	gui.busyDialogue.Hide()
 	if err != nil {
 		gui.ShowError(err)
@@ -277,7 +350,16 @@ func (gui *GUI) QueryNone() {
 		gui.ShowError(fmt.Errorf("no active basedirs to query"))
 		return
 	}
-	imgs, err := gui.db.ReadImages(QueryFilter{Limit: 128, BaseDirs: basedirs}, OrderByAestheticDesc)
+	gui.ReadImages(QueryFilter{Limit: 128, BaseDirs: basedirs}, OrderByAestheticDesc)
+}
+
+// displays the images matching qf
+func (gui *GUI) ReadImages(qf QueryFilter, so SortOrder) {
+	if len(qf.BaseDirs) == 0 {
+		gui.ShowError(fmt.Errorf("no active basedirs to query"))
+		return
+	}
+	imgs, err := gui.db.ReadImages(qf, so)
 	if err != nil {
 		gui.ShowError(err)
 		return
@@ -285,6 +367,29 @@ func (gui *GUI) QueryNone() {
 	gui.ShowImages(imgs)
 }
 
+// tags every image with labels from the vocabulary file, logging progress. Runs for a while, so call in a goroutine.
+func (gui *GUI) AutoTag() {
+	labels, err := LoadVocabulary(gui.conf.AUTOTAG_VOCABULARY)
+	if err != nil {
+		gui.ShowError(fmt.Errorf("failed to load the auto tag vocabulary: %w", err))
+		return
+	}
+	emb, err := gui.getEmbedder()
+	if err != nil {
+		gui.ShowError(err)
+		return
+	}
+	gui.log.Append(fmt.Sprintf("Auto tagging with %d labels\n", len(labels)))
+	tagged, err := AutoTag(context.Background(), gui.db, emb, labels, gui.conf.AutoTagOptions(), func(done, total int64) {
+		gui.log.Append(fmt.Sprintf("Auto tagged %d/%d images\n", done, total))
+	})
+	if err != nil {
+		gui.ShowError(err)
+		return
+	}
+	gui.log.Append(fmt.Sprintf("Auto tagging done, %d tags\n", tagged))
+}
+
 func (gui *GUI) ShowError(err error) {
 	gui.log.Append(err.Error() + "\n")
 }
@@ -298,8 +403,51 @@ func (gui *GUI) ShowImageDetails(img Image) {
 	sb.WriteString(strconv.Itoa(int(img.Height)))
 	sb.WriteString("\n Aesthetic: ")
 	sb.WriteString(fmt.Sprintf("%v \n", img.Aesthetic.Float64))
+	sb.WriteString(fmt.Sprintf(" ID: %d (search similar:%d)\n", img.ID, img.ID))
+	if img.Distance.Valid {
+		sb.WriteString(fmt.Sprintf(" Distance: %.4f\n", img.Distance.Float64))
+	}
+
+	tags, err := gui.db.ReadTags(img.ID)
+	if err != nil {
+		gui.ShowError(err)
+	}
+	for _, tag := range tags {
+		if tag.Source == TagSourceAuto {
+			sb.WriteString(fmt.Sprintf(" Auto tag: %s (%.2f)\n", tag.Tag, tag.Confidence.Float64))
+		}
+	}
 	gui.imgInfo.Text = sb.String()
 	gui.imgInfo.Refresh()
+	gui.imgTagsID = img.ID
+	gui.imgTags.SetText(strings.Join(tagNames(tags), ", "))
+	gui.imgTags.Enable()
+}
+
+// saves the tags entered for the image shown in the details panel
+func (gui *GUI) SaveImageTags() {
+	if gui.imgTagsID == 0 {
+		return
+	}
+	err := gui.db.ReplaceTags(gui.imgTagsID, strings.Split(gui.imgTags.Text, ","))
+	if err != nil {
+		gui.ShowError(err)
+		return
+	}
+	tags, err := gui.db.ReadTags(gui.imgTagsID)
+	if err != nil {
+		gui.ShowError(err)
+		return
+	}
+	gui.imgTags.SetText(strings.Join(tagNames(tags), ", "))
+}
+
+func tagNames(tags []Tag) []string {
+	names := make([]string, len(tags))
+	for i, tag := range tags {
+		names[i] = tag.Tag
+	}
+	return names
 }
 
 func (gui *GUI) ShowImages(dbImages []Image) {
@@ -409,7 +557,7 @@ func (gui *GUI) ShowThumbnailMenu(pe *fyne.PointEvent, im Image) {
 				gui.ShowError(err)
 				return
 			}
-			gui.QueryEmbedding(data)
+			gui.QueryEmbedding(data, gui.getQueryFilter())
 		}),
 	}
 	menu := fyne.NewMenu("Image", items...)
@@ -432,12 +580,19 @@ func (gui *GUI) Build() {
 	appLogLabel := widget.NewLabel("Log")
 
 	gui.imgInfo = widget.NewMultiLineEntry()
+	gui.imgTags = widget.NewEntry()
+	gui.imgTags.SetPlaceHolder("tags, comma separated")
+	gui.imgTags.OnSubmitted = func(string) { gui.SaveImageTags() }
+	gui.imgTags.Disable()
+	saveTagsBtn := widget.NewButton("Save Tags", gui.SaveImageTags)
+	imgTagsRow := container.NewBorder(nil, nil, nil, saveTagsBtn, gui.imgTags)
 	gui.log = widget.NewMultiLineEntry()
 	gui.log.Append("Started\n")
 	split := widget.NewSeparator()
 	leftContainer := container.NewVBox(
+		gui.buildLibraryGUI(),
 		indexesLabel, basedirsWrapper, indexesButtons, split,
-		imgInfoLabel, gui.imgInfo,
+		imgInfoLabel, gui.imgInfo, imgTagsRow,
 		appLogLabel, gui.log,
 	)
 	// RIGHT ----------------------------------------------------
@@ -449,7 +604,12 @@ func (gui *GUI) Build() {
 
 	// DIALOGUES ---------------------------------------------------
 	gui.busyDialogue = NewBusyDialogue(gui.window)
-	gui.indexingDialogue = NewImageProcessDialogue(gui.window, gui.conf.THREADS_FOR_INDEXING)
+	gui.jobsDialogue = NewIndexJobsDialogue(gui.window, func(id int64) error {
+		return gui.indexQueue.Cancel(id)
+	}, func() error {
+		return gui.db.ClearFinishedIndexJobs()
+	})
+	gui.startIndexQueue()
 
 	total := container.NewBorder(nil, nil, leftContainer, nil, rightContainer)
 	gui.window.SetContent(total)
@@ -484,78 +644,3 @@ func (bd *BusyDialogue) Hide() {
 	bd.activity.Stop()
 	bd.CustomDialog.Hide()
 }
-
-type ImageProcessDialogue struct {
-	*dialog.CustomDialog
-	threads       int
-	processor     *ImageProcessor
-	displayedPath binding.String
-	basedir       Basedir
-	ctx           context.Context
-	ctxCancel     context.CancelFunc
-}
-
-// prepares the dialogue for use then shows it
-func (ipd *ImageProcessDialogue) Show(dbfile string, basedir Basedir, apiserver string) error {
-	var err error
-	ipd.basedir = basedir
-	ipd.displayedPath.Set(basedir.Directory)
-	ipd.processor, err = NewImageProcessor(dbfile, basedir, apiserver)
-	if err != nil {
-		return err
-	}
-	ipd.ctx, ipd.ctxCancel = context.WithCancel(context.Background())
-	ipd.CustomDialog.Show()
-	return nil
-}
-
-// a dialogue that handles directory walking and indexing
-func NewImageProcessDialogue(w fyne.Window, threads int) *ImageProcessDialogue {
-	content := container.NewVBox()
-	ipd := &ImageProcessDialogue{
-		CustomDialog:  dialog.NewCustomWithoutButtons("Indexing", content, w),
-		displayedPath: binding.NewString(),
-	}
-	pathLabel := container.NewHBox()
-	pathLabel.Add(widget.NewLabel("Path: "))
-	pathLabel.Add(widget.NewLabelWithData(ipd.displayedPath))
-	content.Add(pathLabel)
-
-	// api server queue
-	queueStatus := binding.NewString()
-	queueBox := widget.NewLabelWithData(queueStatus)
-	queueLabel := widget.NewLabel("Queue Status: ")
-	content.Add(container.NewHBox(queueLabel, queueBox))
-
-	//log
-	logBox := widget.NewMultiLineEntry()
-	logBox.Append("Log:\n")
-	content.Add(logBox)
-	errCh := make(chan error, 5)
-	go func() {
-		for err := range errCh {
-			logBox.Append(err.Error() + "\n")
-			logBox.CursorRow = 0xFFFFFFFFFFFFFF
-		}
-	}()
-
-	// nb: various variables referenced here are set by Show()
-	var startBtn *widget.Button
-	startBtn = widget.NewButton("Start", func() {
-		startBtn.Disable()
-		go func() {
-			logBox.Append("Started\n")
-			aw := archivewalk.NewArchiveWalker(threads, errCh, true, true, ipd.processor.Handler)
-			aw.Walk(ipd.basedir.Directory, ipd.ctx)
-			logBox.Append("Done\n")
-		}()
-	})
-	content.Add(startBtn)
-	content.Add(widget.NewButton("Cancel", func() {
-		startBtn.Enable()
-		ipd.ctxCancel()
-		ipd.processor = nil
-		ipd.CustomDialog.Hide()
-	}))
-	return ipd
-}
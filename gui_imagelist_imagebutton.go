@@ -1,17 +1,21 @@
 package main
 
 import (
+	"fmt"
 	"image"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 )
 
 type ImageList struct {
 	*fyne.Container
-	callback func(*fyne.PointEvent, Image)
+	callback      func(*fyne.PointEvent, Image)
+	showDistances bool // whether thumbnails are captioned with their distance from the search
 }
 
 // The GUI element we use to display many images, typically query results.
@@ -28,10 +32,41 @@ func (il *ImageList) AddImage(img image.Image, dbdata Image) {
 	//imgBtn.SetMinSize(fyne.NewSquareSize(64))
 	imgBtn.Image.FillMode = canvas.ImageFillContain
 	//imgBtn.Resize(fyne.NewSquareSize(64))
+	if il.showDistances {
+		imgBtn.SetCaption(distanceCaption(dbdata))
+	}
 	il.Add(imgBtn)
 	//il.Add(widget.NewButton("test", nil))
 }
 
+// shows or hides the distance captions, of the images already shown too
+func (il *ImageList) SetShowDistances(show bool) {
+	il.showDistances = show
+	for _, obj := range il.Objects {
+		if ib, ok := obj.(*ImageButtonWithData[Image]); ok {
+			caption := ""
+			if show {
+				caption = distanceCaption(ib.data)
+			}
+			ib.SetCaption(caption)
+		}
+	}
+}
+
+// resizes the grid's cells. images already shown keep the resolution they were scaled to
+func (il *ImageList) SetThumbnailSize(thumbSize int) {
+	il.Layout = layout.NewGridWrapLayout(fyne.NewSquareSize(float32(thumbSize)))
+	il.Refresh()
+}
+
+// images that aren't from a similarity search have no distance, so no caption
+func distanceCaption(img Image) string {
+	if !img.Distance.Valid {
+		return ""
+	}
+	return fmt.Sprintf("%.3f", img.Distance.Float64)
+}
+
 func (il *ImageList) CreateRenderer() fyne.WidgetRenderer {
 	return widget.NewSimpleRenderer(il.Container)
 }
@@ -54,6 +89,7 @@ func (il *ImageList) Clear() {
 type ImageButtonWithData[T any] struct {
 	widget.BaseWidget // Embed BaseWidget to get proper widget behavior
 	Image             *canvas.Image
+	caption           *canvas.Text // overlaid on the image's bottom edge, empty for none
 	onClick           func(*fyne.PointEvent, T)
 	data              T
 }
@@ -61,17 +97,25 @@ type ImageButtonWithData[T any] struct {
 func NewImageButtonFromImage[T any](img image.Image, data T, onClick func(*fyne.PointEvent, T)) *ImageButtonWithData[T] {
 	ib := &ImageButtonWithData[T]{
 		Image:   canvas.NewImageFromImage(img),
+		caption: canvas.NewText("", theme.Color(theme.ColorNameForeground)),
 		onClick: onClick,
 		data:    data,
 	}
 	ib.ExtendBaseWidget(ib) // Initialize BaseWidget
 	ib.Image.FillMode = canvas.ImageFillContain
+	ib.caption.Alignment = fyne.TextAlignCenter
+	ib.caption.TextSize = theme.CaptionTextSize()
 	return ib
 }
 
+func (ib *ImageButtonWithData[T]) SetCaption(text string) {
+	ib.caption.Text = text
+	ib.caption.Refresh()
+}
+
 // CreateRenderer implements fyne.Widget
 func (ib *ImageButtonWithData[T]) CreateRenderer() fyne.WidgetRenderer {
-	return widget.NewSimpleRenderer(ib.Image)
+	return widget.NewSimpleRenderer(container.NewStack(ib.Image, container.NewVBox(layout.NewSpacer(), ib.caption)))
 }
 
 // Tapped implements fyne.Tappable
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// starts running the library's indexing queue, which resumes any jobs left from last time
+func (gui *GUI) startIndexQueue() {
+	queue, err := NewIndexQueue(gui.db, gui.dbFile, gui.conf)
+	if err != nil {
+		gui.indexQueue, gui.stopIndexQueue = nil, func() {}
+		gui.ShowError(fmt.Errorf("failed to start indexing: %w", err))
+		return
+	}
+	queue.OnUpdate = func(job IndexJob) {
+		gui.jobsDialogue.Update(job)
+		if job.Status == JobDone && len(job.Model) > 0 {
+			gui.log.Append(fmt.Sprintf("Indexed %s, searching with model: %s\n", job.Directory, job.Model))
+		}
+	}
+	queue.OnLog = func(job IndexJob, msg string) {
+		gui.jobsDialogue.Log(msg)
+	}
+	jobs, err := gui.db.ReadIndexJobs()
+	if err != nil {
+		gui.ShowError(err)
+	}
+	gui.jobsDialogue.SetJobs(jobs)
+	resumed := 0
+	for _, job := range jobs {
+		if job.Active() {
+			resumed++
+		}
+	}
+	if resumed > 0 {
+		gui.log.Append(fmt.Sprintf("Resuming %d indexing jobs\n", resumed))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := queue.Run(ctx, false); err != nil && ctx.Err() == nil {
+			gui.ShowError(fmt.Errorf("indexing stopped: %w", err))
+		}
+	}()
+	gui.indexQueue = queue
+	gui.stopIndexQueue = func() {
+		cancel()
+		<-stopped
+	}
+}
+
+// stops the running jobs, leaving them queued for next time, then closes the library
+func (gui *GUI) Close() error {
+	gui.stopIndexQueue()
+	return gui.db.Close()
+}
+
+// lists the indexing jobs, with buttons to cancel them, and a log of files that couldn't be indexed.
+// closing it leaves the jobs running.
+type IndexJobsDialogue struct {
+	*dialog.CustomDialog
+	list *widget.List
+	log  *widget.Entry
+
+	mu   sync.Mutex
+	jobs []IndexJob // oldest first
+}
+
+// cancel cancels a job by id, clear forgets the finished jobs
+func NewIndexJobsDialogue(w fyne.Window, cancel func(id int64) error, clear func() error) *IndexJobsDialogue {
+	ijd := &IndexJobsDialogue{log: widget.NewMultiLineEntry()}
+	ijd.list = widget.NewList(
+		func() int {
+			ijd.mu.Lock()
+			defer ijd.mu.Unlock()
+			return len(ijd.jobs)
+		},
+		func() fyne.CanvasObject {
+			details := container.NewVBox(widget.NewLabel(""), widget.NewProgressBar(), widget.NewLabel(""))
+			return container.NewBorder(nil, nil, nil, widget.NewButton("Cancel", nil), details)
+		},
+		func(i widget.ListItemID, obj fyne.CanvasObject) {
+			ijd.mu.Lock()
+			job := ijd.jobs[i]
+			ijd.mu.Unlock()
+			row := obj.(*fyne.Container)
+			details := row.Objects[0].(*fyne.Container)
+			details.Objects[0].(*widget.Label).SetText(jobSummary(job))
+			showJobProgress(job, details.Objects[1].(*widget.ProgressBar), details.Objects[2].(*widget.Label))
+			cancelBtn := row.Objects[1].(*widget.Button)
+			cancelBtn.OnTapped = func() {
+				if err := cancel(job.ID); err != nil {
+					ijd.Log(err.Error())
+				}
+			}
+			if job.Active() {
+				cancelBtn.Enable()
+			} else {
+				cancelBtn.Disable()
+			}
+		})
+	ijd.log.Append("Log:\n")
+
+	clearBtn := widget.NewButton("Clear Finished", func() {
+		if err := clear(); err != nil {
+			ijd.Log(err.Error())
+			return
+		}
+		ijd.mu.Lock()
+		active := make([]IndexJob, 0, len(ijd.jobs))
+		for _, job := range ijd.jobs {
+			if job.Active() {
+				active = append(active, job)
+			}
+		}
+		ijd.jobs = active
+		ijd.mu.Unlock()
+		ijd.list.Refresh()
+	})
+	content := container.NewBorder(nil, ijd.log, nil, nil, ijd.list)
+	ijd.CustomDialog = dialog.NewCustomWithoutButtons("Indexing", content, w)
+	ijd.CustomDialog.SetButtons([]fyne.CanvasObject{clearBtn, widget.NewButton("Close", ijd.Hide)})
+	ijd.CustomDialog.Resize(fyne.NewSize(700, 500))
+	return ijd
+}
+
+func (ijd *IndexJobsDialogue) SetJobs(jobs []IndexJob) {
+	ijd.mu.Lock()
+	ijd.jobs = jobs
+	ijd.mu.Unlock()
+	ijd.list.Refresh()
+}
+
+// adds the job, or replaces its earlier state
+func (ijd *IndexJobsDialogue) Update(job IndexJob) {
+	ijd.mu.Lock()
+	found := false
+	for i := range ijd.jobs {
+		if ijd.jobs[i].ID == job.ID {
+			ijd.jobs[i], found = job, true
+		}
+	}
+	if !found {
+		ijd.jobs = append(ijd.jobs, job)
+	}
+	ijd.mu.Unlock()
+	ijd.list.Refresh()
+}
+
+func (ijd *IndexJobsDialogue) Log(msg string) {
+	ijd.log.Append(msg + "\n")
+	ijd.log.CursorRow = 0xFFFFFFFFFFFFFF
+}
+
+func jobSummary(job IndexJob) string {
+	text := fmt.Sprintf("%s: %s, %d files, %d errors", job.Directory, job.Status, job.Files, job.Errors)
+	if len(job.Error) > 0 {
+		text += " - " + job.Error
+	}
+	return text
+}
+
+// running jobs show a bar, filled once the pre-scan has counted the files, with their throughput and time left
+func showJobProgress(job IndexJob, bar *widget.ProgressBar, label *widget.Label) {
+	if job.Status != JobRunning || job.Progress == nil {
+		bar.Hide()
+		label.Hide()
+		return
+	}
+	fraction, _ := job.Progress.Fraction()
+	bar.SetValue(fraction)
+	label.SetText(describeProgress(*job.Progress))
+	bar.Show()
+	label.Show()
+}
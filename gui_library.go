@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/data/binding"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/storage"
+	"fyne.io/fyne/v2/widget"
+)
+
+// a library is a database file, eg one for personal and one for work images.
+// the GUI switches between them without restarting, and remembers the recently opened ones.
+
+const (
+	recentLibrariesKey = "recent_libraries" // fyne preference, most recent first
+	maxRecentLibraries = 10
+)
+
+// the library row: a list of recent libraries, plus buttons to open or create another
+func (gui *GUI) buildLibraryGUI() *fyne.Container {
+	gui.library = widget.NewSelect(gui.recentLibraries(), func(file string) {
+		if file != gui.dbFile {
+			gui.OpenLibrary(file)
+		}
+	})
+
+	openBtn := widget.NewButton("Open", func() {
+		picker := dialog.NewFileOpen(func(rc fyne.URIReadCloser, err error) {
+			if err != nil {
+				dialog.NewError(err, gui.window).Show()
+				return
+			}
+			if rc == nil {
+				return
+			}
+			rc.Close()
+			gui.OpenLibrary(rc.URI().Path())
+		}, gui.window)
+		picker.SetFilter(storage.NewExtensionFileFilter([]string{".sqlite", ".db"}))
+		picker.Resize(gui.window.Canvas().Size())
+		picker.Show()
+	})
+
+	newBtn := widget.NewButton("New", func() {
+		picker := dialog.NewFileSave(func(wc fyne.URIWriteCloser, err error) {
+			if err != nil {
+				dialog.NewError(err, gui.window).Show()
+				return
+			}
+			if wc == nil {
+				return
+			}
+			// nb: sqlite treats the empty file as a new database
+			wc.Close()
+			gui.OpenLibrary(wc.URI().Path())
+		}, gui.window)
+		picker.SetFileName("library.sqlite")
+		picker.Resize(gui.window.Canvas().Size())
+		picker.Show()
+	})
+
+	gui.actables = append(gui.actables, &gui.library.DisableableWidget)
+	gui.actables = append(gui.actables, &openBtn.DisableableWidget)
+	gui.actables = append(gui.actables, &newBtn.DisableableWidget)
+	settingsBtn := widget.NewButton("Settings", gui.ShowSettings)
+	return container.NewBorder(nil, nil, widget.NewLabel("Library"), container.NewHBox(openBtn, newBtn, settingsBtn), gui.library)
+}
+
+// closes the current library and shows the one in file instead, creating it if needed
+func (gui *GUI) OpenLibrary(file string) {
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	if gui.autoTagging.Load() {
+		dialog.NewInformation("", "Wait for auto tagging to finish first", gui.window).Show()
+		gui.library.SetSelected(gui.dbFile)
+		return
+	}
+	gui.busyDialogue.Show("Opening library...")
+	db, err := NewDatabase(file, true)
+	gui.busyDialogue.Hide()
+	if err != nil {
+		gui.ShowError(fmt.Errorf("failed to open library %s: %w", file, err))
+		gui.library.SetSelected(gui.dbFile)
+		return
+	}
+	db.UseANN(gui.conf.HNSW_EF_SEARCH)
+
+	// nb: the old library's running jobs stay queued for when it's next opened
+	gui.busyDialogue.Show("Stopping indexing...")
+	err = gui.Close()
+	gui.busyDialogue.Hide()
+	if err != nil {
+		gui.ShowError(err)
+	}
+	gui.db, gui.dbFile = db, file
+	gui.startIndexQueue()
+	// basedir ids belong to the old library
+	gui.basedirsState = make(map[int64]binding.Bool)
+	gui.rebuildBasedirs()
+	gui.imageList.Clear()
+	gui.imgInfo.SetText("")
+	gui.imgTagsID = 0
+	gui.imgTags.SetText("")
+	gui.imgTags.Disable()
+	gui.addRecentLibrary(file)
+	gui.log.Append("Opened library " + file + "\n")
+}
+
+// the recently opened libraries which still exist
+func (gui *GUI) recentLibraries() []string {
+	files := fyne.CurrentApp().Preferences().StringList(recentLibrariesKey)
+	return slices.DeleteFunc(files, func(file string) bool {
+		_, err := os.Stat(file)
+		return err != nil
+	})
+}
+
+// moves file to the top of the recent libraries, and selects it
+func (gui *GUI) addRecentLibrary(file string) {
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	files := slices.DeleteFunc(gui.recentLibraries(), func(f string) bool { return f == file })
+	files = append([]string{file}, files...)
+	if len(files) > maxRecentLibraries {
+		files = files[:maxRecentLibraries]
+	}
+	fyne.CurrentApp().Preferences().SetStringList(recentLibrariesKey, files)
+
+	gui.dbFile = file
+	gui.library.Options = files
+	gui.library.SetSelected(file)
+	gui.window.SetTitle("imagedb - " + filepath.Base(file))
+}
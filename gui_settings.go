@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// settings the Settings dialog applies immediately, the rest take effect on restart
+var liveSettings = []string{"IMAGE_SIZE_THUMBNAIL", "QUERY_RESULTS", "THREADS_FOR_THUMBNAILS", "THREADS_FOR_INDEXING", "INDEX_JOBS"}
+
+// a dialog editing every setting, which saves them to config.ini
+func (gui *GUI) ShowSettings() {
+	entries := make(map[string]*widget.Entry)
+	form := widget.NewForm()
+	for _, name := range ConfigNames() {
+		entry := widget.NewEntry()
+		if name == "API_KEY" || name == "SERVE_PASSWORD" {
+			entry = widget.NewPasswordEntry()
+		}
+		entry.SetText(gui.conf.Get(name))
+		item := widget.NewFormItem(name, entry)
+		if ConfigFromEnv(name) {
+			entry.Disable()
+			item.HintText = "set by " + configEnvPrefix + name
+		} else if name == "THREADS_FOR_INDEXING" {
+			item.HintText = "applied immediately, but running jobs can't use more threads than they started with"
+		} else if slices.Contains(liveSettings, name) {
+			item.HintText = "applied immediately"
+		}
+		form.AppendItem(item)
+		entries[name] = entry
+	}
+	scroll := container.NewVScroll(form)
+	d := dialog.NewCustomWithoutButtons("Settings", scroll, gui.window)
+
+	saveBtn := widget.NewButton("Save", func() {
+		conf, err := NewConfig(func(name string) string { return entries[name].Text })
+		if err != nil {
+			dialog.NewError(err, gui.window).Show()
+			return
+		}
+		// only changed settings are written, so empty ones in config.ini keep following the defaults
+		changed := make(map[string]string)
+		for name, entry := range entries {
+			if !ConfigFromEnv(name) && entry.Text != gui.conf.Get(name) {
+				changed[name] = entry.Text
+			}
+		}
+		if err := SaveConfig(gui.confFile, changed); err != nil {
+			dialog.NewError(fmt.Errorf("failed to save %s: %w", gui.confFile, err), gui.window).Show()
+			return
+		}
+		d.Hide()
+		gui.applySettings(conf, changed)
+	})
+	saveBtn.Importance = widget.HighImportance
+	d.SetButtons([]fyne.CanvasObject{widget.NewButton("Cancel", d.Hide), saveBtn})
+	d.Resize(gui.window.Canvas().Size())
+	d.Show()
+}
+
+// applies the live settings from conf, and logs which of the changed ones need a restart
+func (gui *GUI) applySettings(conf *Config, changed map[string]string) {
+	gui.conf.QUERY_RESULTS = conf.QUERY_RESULTS
+	gui.conf.THREADS_FOR_THUMBNAILS = conf.THREADS_FOR_THUMBNAILS
+	gui.conf.THREADS_FOR_INDEXING = conf.THREADS_FOR_INDEXING
+	gui.conf.INDEX_JOBS = conf.INDEX_JOBS
+	// nb: the queue has its own copy of the config, as its jobs read it as they run
+	if gui.indexQueue != nil {
+		gui.indexQueue.SetLimits(conf.INDEX_JOBS, conf.THREADS_FOR_INDEXING)
+	}
+	if gui.conf.IMAGE_SIZE_THUMBNAIL != conf.IMAGE_SIZE_THUMBNAIL {
+		gui.conf.IMAGE_SIZE_THUMBNAIL = conf.IMAGE_SIZE_THUMBNAIL
+		gui.imageList.SetThumbnailSize(conf.IMAGE_SIZE_THUMBNAIL)
+	}
+
+	var restart []string
+	for name := range changed {
+		if !slices.Contains(liveSettings, name) {
+			restart = append(restart, name)
+		}
+	}
+	slices.Sort(restart)
+	gui.log.Append("Saved settings to " + gui.confFile + "\n")
+	if len(restart) > 0 {
+		gui.log.Append("Restart imagedb to apply " + strings.Join(restart, ", ") + "\n")
+	}
+}
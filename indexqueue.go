@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/crimro-se/imagedb/pkg/archivewalk"
+)
+
+// how often a running job's progress is saved and reported
+const jobProgressInterval = 2 * time.Second
+
+// runs indexing jobs, which are kept in the database so those queued or interrupted are run on the next start.
+// up to INDEX_JOBS run at once, sharing THREADS_FOR_INDEXING workers between them, see SetLimits.
+// nb: only one queue should run per database at a time.
+type IndexQueue struct {
+	db     *Database // for the jobs. each job indexes via its own connection, see ImageProcessor
+	dbFile string
+	conf   *Config // the queue's own copy
+
+	// optional, told whenever a job's status or progress changes, and of files that couldn't be indexed
+	// and the embedding server going down. nb: they mustn't call the queue, it may be locked.
+	OnUpdate func(IndexJob)
+	OnLog    func(IndexJob, string)
+
+	mu        sync.Mutex
+	jobs      int                          // how many run at once
+	running   map[int64]context.CancelFunc // by job id
+	cancelled map[int64]bool               // running jobs the user has cancelled
+	wake      chan struct{}                // something may be ready to run
+
+	workers     sync.Mutex
+	workersFree *sync.Cond
+	workersBusy int
+	threads     int // how many workers there are
+}
+
+// jobs left running when imagedb last stopped are queued again
+func NewIndexQueue(db *Database, dbFile string, conf *Config) (*IndexQueue, error) {
+	if err := db.RequeueRunningIndexJobs(); err != nil {
+		return nil, err
+	}
+	confCopy := *conf
+	q := &IndexQueue{
+		db:        db,
+		dbFile:    dbFile,
+		conf:      &confCopy,
+		jobs:      conf.INDEX_JOBS,
+		threads:   conf.THREADS_FOR_INDEXING,
+		running:   make(map[int64]context.CancelFunc),
+		cancelled: make(map[int64]bool),
+		wake:      make(chan struct{}, 1),
+	}
+	q.workersFree = sync.NewCond(&q.workers)
+	return q, nil
+}
+
+// changes how many jobs run at once, and how many workers they share.
+// nb: a running job's walker keeps the number of threads it started with, so can't use more than that.
+func (q *IndexQueue) SetLimits(jobs, threads int) {
+	q.mu.Lock()
+	q.jobs = jobs
+	q.mu.Unlock()
+	q.workers.Lock()
+	q.threads = threads
+	q.workers.Unlock()
+	q.workersFree.Broadcast()
+	q.signal()
+}
+
+// queues a job for each basedir, returning them. basedirs already queued keep their job.
+func (q *IndexQueue) Add(basedirs ...Basedir) ([]IndexJob, error) {
+	jobs := make([]IndexJob, 0, len(basedirs))
+	for _, bd := range basedirs {
+		job, err := q.db.QueueIndexJob(bd.ID)
+		if err != nil {
+			return jobs, fmt.Errorf("failed to queue %s: %w", bd.Directory, err)
+		}
+		jobs = append(jobs, job)
+		q.update(job)
+	}
+	q.signal()
+	return jobs, nil
+}
+
+// cancels the job, whether it's queued or running
+func (q *IndexQueue) Cancel(id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if cancel, ok := q.running[id]; ok {
+		q.cancelled[id] = true
+		cancel()
+		q.wakeWorkers()
+		return nil
+	}
+	job, err := q.db.ReadIndexJob(id)
+	if err != nil || job.Status != JobQueued {
+		return err
+	}
+	finished := time.Now().Unix()
+	job.Status, job.Finished = JobCancelled, &finished
+	if err := q.db.UpdateIndexJob(job); err != nil {
+		return err
+	}
+	q.update(job)
+	return nil
+}
+
+// whether the basedir has a job queued or running
+func (q *IndexQueue) Busy(basedirID int64) (bool, error) {
+	jobs, err := q.db.ReadIndexJobs()
+	for _, job := range jobs {
+		if job.BasedirID == basedirID && job.Active() {
+			return true, err
+		}
+	}
+	return false, err
+}
+
+// runs queued jobs until ctx is cancelled, or if untilEmpty, until there are none left.
+// jobs running when ctx is cancelled are stopped and left queued.
+func (q *IndexQueue) Run(ctx context.Context, untilEmpty bool) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		q.mu.Lock()
+		for len(q.running) < q.jobs {
+			job, ok, err := q.db.NextIndexJob()
+			if err != nil || !ok {
+				if err != nil {
+					q.mu.Unlock()
+					return err
+				}
+				break
+			}
+			// nb: a job interrupted earlier starts again from scratch, files already indexed are quick to skip
+			job.Status, job.Files, job.Errors, job.Error = JobRunning, 0, 0, ""
+			started := time.Now().Unix()
+			job.Started, job.Finished = &started, nil
+			if err := q.db.UpdateIndexJob(job); err != nil {
+				q.mu.Unlock()
+				return err
+			}
+			jobCtx, cancel := context.WithCancel(ctx)
+			q.running[job.ID] = cancel
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				q.finish(ctx, q.run(jobCtx, job))
+				cancel()
+			}()
+		}
+		idle := len(q.running) == 0
+		q.mu.Unlock()
+		if idle && untilEmpty {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			q.wakeWorkers()
+			return ctx.Err()
+		case <-q.wake:
+		}
+	}
+}
+
+// records how a job ended. if the whole queue was stopped, rather than the job, it's queued again.
+func (q *IndexQueue) finish(ctx context.Context, job IndexJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if job.Status == JobCancelled && !q.cancelled[job.ID] && ctx.Err() != nil {
+		job.Status = JobQueued
+		job.Started = nil
+	} else {
+		finished := time.Now().Unix()
+		job.Finished = &finished
+	}
+	delete(q.running, job.ID)
+	delete(q.cancelled, job.ID)
+	if err := q.db.UpdateIndexJob(job); err != nil {
+		job.Status, job.Error = JobFailed, err.Error()
+	}
+	q.update(job)
+	q.signal()
+}
+
+// indexes the job's basedir, returning the job as it ended
+func (q *IndexQueue) run(ctx context.Context, job IndexJob) IndexJob {
+	q.update(job)
+	bd := Basedir{ID: job.BasedirID, Directory: job.Directory}
+	var failures atomic.Int64
+	fail := func(err error) {
+		failures.Add(1)
+		q.log(job, err.Error())
+	}
+	processor, err := NewImageProcessor(ctx, q.dbFile, bd, q.conf, func(available bool) {
+		if available {
+			q.log(job, "embedding server is back, resumed")
+		} else {
+			q.log(job, "embedding server unavailable, indexing paused")
+		}
+	}, fail)
+	if err != nil {
+		job.Status, job.Error = JobFailed, err.Error()
+		if ctx.Err() != nil {
+			job.Status, job.Error = JobCancelled, ""
+		}
+		return job
+	}
+
+	// archivewalk doesn't report errors from the handler, only those walking the files
+	errCh := make(chan error)
+	go func() {
+		for err := range errCh {
+			fail(err)
+		}
+	}()
+	handler := func(path, vpath string, file io.Reader, d fs.DirEntry, threadID int) error {
+		if err := q.acquireWorker(ctx); err != nil {
+			return err
+		}
+		defer q.releaseWorker()
+		err := processor.Handler(path, vpath, file, d, threadID)
+		if err != nil && ctx.Err() == nil && !errors.Is(err, archivewalk.ErrSkipped) {
+			fail(err)
+		}
+		return err
+	}
+
+	q.workers.Lock()
+	threads := q.threads
+	q.workers.Unlock()
+	aw := archivewalk.NewArchiveWalker(threads, errCh, true, true, handler)
+	aw.SetPreScan(true)
+	aw.OnProgress(jobProgressInterval, func(p archivewalk.Progress) {
+		progress := job
+		progress.Files, progress.Errors, progress.Progress = p.FilesHandled, failures.Load(), &p
+		// nb: failing to save progress isn't worth stopping for, the job's end is saved again
+		q.db.UpdateIndexJob(progress)
+		q.update(progress)
+	})
+	// nb: the last progress is reported before Walk returns, so it isn't saved over the job's end
+	aw.Walk(bd.Directory, ctx)
+	close(errCh) // nb: errors are sent synchronously, so none are sent once the walk returns
+
+	if ctx.Err() == nil {
+		job.Model, err = processor.PromoteModel()
+	}
+	// nb: images that failed to be written have been reported once the processor is closed
+	err = errors.Join(err, processor.Close())
+	job.Files, job.Errors = aw.Progress().FilesHandled, failures.Load()
+	switch {
+	case ctx.Err() != nil:
+		job.Status = JobCancelled
+	case err != nil:
+		job.Status, job.Error = JobFailed, err.Error()
+	default:
+		job.Status = JobDone
+	}
+	return job
+}
+
+// waits until fewer than the queue's threads files are being indexed, across every job
+func (q *IndexQueue) acquireWorker(ctx context.Context) error {
+	q.workers.Lock()
+	defer q.workers.Unlock()
+	for q.workersBusy >= q.threads && ctx.Err() == nil {
+		q.workersFree.Wait()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	q.workersBusy++
+	return nil
+}
+
+// wakes the workers waiting for others to finish, so those of cancelled jobs give up.
+// nb: broadcast holding the lock, so a worker can't miss it between checking its job and waiting
+func (q *IndexQueue) wakeWorkers() {
+	q.workers.Lock()
+	defer q.workers.Unlock()
+	q.workersFree.Broadcast()
+}
+
+func (q *IndexQueue) releaseWorker() {
+	q.workers.Lock()
+	q.workersBusy--
+	q.workers.Unlock()
+	// nb: broadcast, as waiters for cancelled jobs need waking to give up
+	q.workersFree.Broadcast()
+}
+
+func (q *IndexQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *IndexQueue) update(job IndexJob) {
+	if q.OnUpdate != nil {
+		q.OnUpdate(job)
+	}
+}
+
+func (q *IndexQueue) log(job IndexJob, msg string) {
+	if q.OnLog != nil {
+		q.OnLog(job, msg)
+	}
+}
+
+// a running job's progress for people, eg "45% of 1.2 GB, 3 skipped, 12.3 files/s, 3m20s left"
+func describeProgress(p archivewalk.Progress) string {
+	var parts []string
+	if fraction, ok := p.Fraction(); ok {
+		parts = append(parts, fmt.Sprintf("%.0f%% of %s", fraction*100, formatFileSize(p.TotalBytes)))
+	} else {
+		parts = append(parts, "counting files")
+	}
+	parts = append(parts, fmt.Sprintf("%d skipped", p.FilesSkipped), fmt.Sprintf("%.1f files/s", p.Rate()))
+	if eta, ok := p.ETA(); ok {
+		parts = append(parts, eta.Round(time.Second).String()+" left")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// bytes in the largest unit that leaves at least 1 of it, as parseFileSize reads them
+func formatFileSize(bytes int64) string {
+	f, unit := float64(bytes), "bytes"
+	for _, suffix := range []string{"KB", "MB", "GB", "TB"} {
+		if f < 1024 {
+			break
+		}
+		f, unit = f/1024, suffix
+	}
+	if unit == "bytes" {
+		return fmt.Sprintf("%d bytes", bytes)
+	}
+	return fmt.Sprintf("%.1f %s", f, unit)
+}
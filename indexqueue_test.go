@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crimro-se/imagedb/embedder"
+)
+
+func TestIndexQueue(t *testing.T) {
+	// an OpenAI-compatible server embedding everything alike
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":[{"index":0,"embedding":[3,4]}]}`))
+	}))
+	defer server.Close()
+	conf := DefaultConfig()
+	conf.EMBEDDER, conf.API_SERVER, conf.EMBEDDING_MODEL = embedder.BackendOpenAI, server.URL, "tiny"
+	conf.THREADS_FOR_INDEXING, conf.INDEX_JOBS = 2, 2
+
+	dbFile := filepath.Join(t.TempDir(), "db.sqlite")
+	db, err := NewDatabase(dbFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testData, err := filepath.Abs("test_data/valid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	single := t.TempDir()
+	jpg, err := os.ReadFile(filepath.Join(testData, "000000525286.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(single, "a.jpg"), jpg, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{testData, single, t.TempDir()} {
+		if err := db.CreateBasedir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	basedirs, err := db.GetAllBasedir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a job left running by an earlier run is queued again
+	interrupted, err := db.QueueIndexJob(basedirs[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interrupted.Status = JobRunning
+	if err := db.UpdateIndexJob(interrupted); err != nil {
+		t.Fatal(err)
+	}
+	queue, err := NewIndexQueue(db, dbFile, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := queue.Add(basedirs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 3 || jobs[1].ID != interrupted.ID || jobs[1].Status != JobQueued {
+		t.Fatalf("expected the interrupted job to be requeued, got %+v", jobs)
+	}
+	if err := queue.Cancel(jobs[2].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := queue.Run(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []struct {
+		status string
+		files  int64
+	}{{JobDone, 3}, {JobDone, 1}, {JobCancelled, 0}} {
+		job, err := db.ReadIndexJob(jobs[i].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != want.status || job.Files < want.files || job.Finished == nil {
+			t.Errorf("job %d: expected %s with at least %d files, got %+v", i, want.status, want.files, job)
+		}
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Images < 3 || stats.ActiveModel != "tiny" {
+		t.Errorf("expected both basedirs' images to be indexed with the model, got %+v", stats)
+	}
+
+	// deleting a basedir forgets its jobs
+	if err := db.DeleteBasedir(basedirs[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if busy, err := queue.Busy(basedirs[1].ID); busy || err != nil {
+		t.Errorf("expected no jobs for the deleted basedir, got %v %v", busy, err)
+	}
+	if err := db.ClearFinishedIndexJobs(); err != nil {
+		t.Fatal(err)
+	}
+	if left, _ := db.ReadIndexJobs(); len(left) != 0 {
+		t.Errorf("expected finished jobs to be cleared, got %+v", left)
+	}
+}
+
+func TestIndexQueueSetLimits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":[{"index":0,"embedding":[3,4]}]}`))
+	}))
+	defer server.Close()
+	conf := DefaultConfig()
+	conf.EMBEDDER, conf.API_SERVER, conf.EMBEDDING_MODEL = embedder.BackendOpenAI, server.URL, "tiny"
+	// nb: no jobs may run until the limits are raised
+	conf.INDEX_JOBS = 0
+
+	dbFile := filepath.Join(t.TempDir(), "db.sqlite")
+	db, err := NewDatabase(dbFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CreateBasedir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	basedirs, err := db.GetAllBasedir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := NewIndexQueue(db, dbFile, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finished := make(chan IndexJob, 10)
+	queue.OnUpdate = func(job IndexJob) {
+		if !job.Active() {
+			finished <- job
+		}
+	}
+	if _, err := queue.Add(basedirs...); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- queue.Run(ctx, false) }()
+	select {
+	case job := <-finished:
+		t.Fatalf("expected the job to wait for the limits to be raised, got %+v", job)
+	case <-time.After(50 * time.Millisecond):
+	}
+	queue.SetLimits(1, 2)
+	select {
+	case job := <-finished:
+		if job.Status != JobDone {
+			t.Errorf("expected the job to be done, got %+v", job)
+		}
+	case <-time.After(time.Minute):
+		t.Error("raising the limits didn't start the job")
+	}
+	cancel()
+	<-stopped
+}
+
+// a cancelled job's workers waiting for another job's to finish give up straight away
+func TestIndexQueueCancelWakesWorkers(t *testing.T) {
+	conf := DefaultConfig()
+	conf.THREADS_FOR_INDEXING = 1
+	db, err := NewDatabase(":memory:", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	queue, err := NewIndexQueue(db, ":memory:", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another job's worker, eg paused on the embedding server, holds the only thread
+	if err := queue.acquireWorker(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue.mu.Lock()
+	queue.running[1] = cancel
+	queue.mu.Unlock()
+	acquired := make(chan error)
+	go func() { acquired <- queue.acquireWorker(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	if err := queue.Cancel(1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-acquired:
+		if err == nil {
+			t.Error("expected the cancelled job's worker to give up")
+		}
+	case <-time.After(time.Second):
+		t.Error("the cancelled job's worker is still waiting")
+	}
+}
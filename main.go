@@ -1,29 +1,75 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
 	"fyne.io/fyne/v2/app"
 )
 
 func main() {
-	a := app.NewWithID("crimro-se/imagedb")
-	w := a.NewWindow("imagedb")
-	db, err := NewDatabase("db.sqlite", true)
+	dbFlag := flag.String("db", "", "")
+	configFlag := flag.String("config", "", "")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), cliUsage)
+	}
+	flag.Parse()
+
+	configPath, err := pathOrDefault(*configFlag, defaultConfigPath)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(os.Stderr, err)
 		return
 	}
-	defer db.Close()
+	conf, err := LoadConfig(configPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		// nb: safe to continue with the defaults
+		fmt.Fprintln(os.Stderr, "no config file, using the defaults:", err)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	dbPath, err := pathOrDefault(*dbFlag, defaultDatabasePath)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(dbPath), 0o755)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	// with a command, run headless, see cli.go
+	if flag.NArg() > 0 {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		code := runCLI(ctx, flag.Args(), dbPath, conf, os.Stdout, os.Stderr)
+		stop()
+		os.Exit(code)
+	}
 
-	conf, err := LoadConfig("config.ini")
+	a := app.NewWithID("crimro-se/imagedb")
+	w := a.NewWindow("imagedb")
+	db, err := NewDatabase(dbPath, true)
 	if err != nil {
 		fmt.Println(err)
-		// nb: should be safe to continue regardless
+		return
 	}
+	db.UseANN(conf.HNSW_EF_SEARCH)
 
-	gui := NewGUI(w, db, conf)
-	_ = gui
+	gui := NewGUI(w, db, dbPath, configPath, conf)
 	w.ShowAndRun()
+	// nb: the GUI may have switched to another library
+	gui.Close()
+}
 
+func pathOrDefault(path string, defaultPath func() (string, error)) (string, error) {
+	if len(path) > 0 {
+		return path, nil
+	}
+	return defaultPath()
 }
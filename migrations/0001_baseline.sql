@@ -29,23 +29,3 @@ CREATE UNIQUE INDEX IF NOT EXISTS basedir_directory_uq ON basedir(directory);
 CREATE VIRTUAL TABLE IF NOT EXISTS embeddings USING vec0 (
     embedding float[768]
 );
-
-/* queries reference (database.go)
-
-CREATE
-  CreateUpdateImage
-  CreateUpdateEmbedding
-
-READ
-  ReadImages
-  MatchEmbeddings
-  MatchImagesByPath
-
-UPDATE
-  CreateUpdateImage
-  CreateUpdateEmbedding
-
-DELETE
-
-
-*/
\ No newline at end of file
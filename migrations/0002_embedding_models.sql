@@ -0,0 +1,19 @@
+-- uses 'rowid' innate primary key.
+-- the embedding models we have vectors from. vectors from different models can't be compared,
+-- so each model's vectors are kept in their own vec0 table (embeddings_<rowid>), created as needed.
+CREATE TABLE IF NOT EXISTS models (
+  model_id TEXT NOT NULL,         -- as reported by the embedder, eg openai/clip-vit-large-patch14
+  dimension INTEGER NOT NULL,     -- length of the model's vectors
+  table_name TEXT NOT NULL        -- the vec0 table holding them
+);
+CREATE UNIQUE INDEX IF NOT EXISTS models_model_id_uq ON models(model_id);
+INSERT OR IGNORE INTO models (model_id, dimension, table_name)
+  VALUES ('openai/clip-vit-large-patch14', 768, 'embeddings');
+
+-- key/value settings of the database itself
+CREATE TABLE IF NOT EXISTS settings (
+  key TEXT PRIMARY KEY,
+  value TEXT NOT NULL
+);
+-- the model searches use. only changed once every image has a vector from the new model.
+INSERT OR IGNORE INTO settings (key, value) VALUES ('active_model', 'openai/clip-vit-large-patch14');
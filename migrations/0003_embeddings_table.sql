@@ -0,0 +1,19 @@
+-- vectors in an ordinary table rather than one vec0 virtual table per model, so they can be joined,
+-- filtered and paged like any other data. searches use sqlite-vec's distance functions on the blobs.
+-- the existing vec0 tables are copied in and dropped by this migration's Go hook.
+CREATE TABLE IF NOT EXISTS image_embeddings (
+  image_id INTEGER NOT NULL,      -- images.rowid
+  model_id INTEGER NOT NULL,      -- models.rowid, vectors from different models can't be compared
+  embedding BLOB NOT NULL,        -- float32 little endian, as from sqlite_vec.SerializeFloat32
+  PRIMARY KEY (model_id, image_id),
+  FOREIGN KEY (image_id) REFERENCES images(rowid),
+  FOREIGN KEY (model_id) REFERENCES models(rowid)
+) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS image_embeddings_image_id_idx ON image_embeddings(image_id);
+
+-- foreign keys aren't enforced, so deletes cascade by trigger.
+-- nb: INSERT OR REPLACE into images doesn't fire this (recursive_triggers is off), so updates keep their vectors.
+CREATE TRIGGER IF NOT EXISTS images_delete_embeddings AFTER DELETE ON images
+BEGIN
+  DELETE FROM image_embeddings WHERE image_id = OLD.rowid;
+END;
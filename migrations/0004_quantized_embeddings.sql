@@ -0,0 +1,19 @@
+-- optional quantized copies of the vectors, for a fast coarse search pass that's then re-ranked exactly.
+-- which quantization (if any) a model uses is recorded against it, see QuantizationInt8 etc.
+ALTER TABLE models ADD COLUMN quantization TEXT NOT NULL DEFAULT 'none';
+
+-- kept apart from image_embeddings so the coarse pass doesn't read through the full vectors.
+CREATE TABLE IF NOT EXISTS image_embeddings_coarse (
+  image_id INTEGER NOT NULL,      -- images.rowid
+  model_id INTEGER NOT NULL,      -- models.rowid
+  embedding BLOB NOT NULL,        -- int8 or bit vector, as sqlite-vec's vec_int8() / vec_bit() expect
+  PRIMARY KEY (model_id, image_id),
+  FOREIGN KEY (image_id) REFERENCES images(rowid),
+  FOREIGN KEY (model_id) REFERENCES models(rowid)
+) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS image_embeddings_coarse_image_id_idx ON image_embeddings_coarse(image_id);
+
+CREATE TRIGGER IF NOT EXISTS images_delete_coarse_embeddings AFTER DELETE ON images
+BEGIN
+  DELETE FROM image_embeddings_coarse WHERE image_id = OLD.rowid;
+END;
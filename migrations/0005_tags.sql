@@ -0,0 +1,19 @@
+-- tags, one row per tag on an image, replacing the never used images.tags column.
+-- manual tags are the user's own, auto tags come from a tagger with its confidence in them.
+CREATE TABLE IF NOT EXISTS tags (
+  image_id INTEGER NOT NULL,      -- images.rowid
+  tag TEXT NOT NULL,              -- lower case, see normalizeTag
+  source TEXT NOT NULL DEFAULT 'manual' CHECK (source IN ('manual', 'auto')),
+  confidence REAL,                -- auto tags only, between 0 and 1
+  PRIMARY KEY (image_id, tag),
+  FOREIGN KEY (image_id) REFERENCES images(rowid)
+) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS tags_tag_idx ON tags(tag);
+
+-- nb: as with embeddings, INSERT OR REPLACE into images doesn't fire this, so re-indexing keeps tags.
+CREATE TRIGGER IF NOT EXISTS images_delete_tags AFTER DELETE ON images
+BEGIN
+  DELETE FROM tags WHERE image_id = OLD.rowid;
+END;
+
+ALTER TABLE images DROP COLUMN tags;
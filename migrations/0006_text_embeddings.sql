@@ -0,0 +1,8 @@
+-- embeddings of text, cached so labels used for auto tagging are only sent to the embedding server once.
+CREATE TABLE IF NOT EXISTS text_embeddings (
+  model_id INTEGER NOT NULL,      -- models.rowid
+  text TEXT NOT NULL,             -- as embedded, eg "a photo of a cat"
+  embedding BLOB NOT NULL,        -- float32 little endian, as image_embeddings
+  PRIMARY KEY (model_id, text),
+  FOREIGN KEY (model_id) REFERENCES models(rowid)
+) WITHOUT ROWID;
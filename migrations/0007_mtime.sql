@@ -0,0 +1,3 @@
+-- when each image's file was last modified, for ranking by recency. images in archives take the archive's time.
+-- NULL until the image is next seen by an Update.
+ALTER TABLE images ADD COLUMN mtime INTEGER;   -- unix seconds
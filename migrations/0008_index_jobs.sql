@@ -0,0 +1,19 @@
+-- the indexing queue, see indexqueue.go. jobs still queued or running when imagedb stops are run on the next start.
+CREATE TABLE IF NOT EXISTS index_jobs (
+  basedir_id INTEGER NOT NULL,    -- basedir.rowid
+  status TEXT NOT NULL DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'done', 'failed', 'cancelled')),
+  files INTEGER NOT NULL DEFAULT 0,   -- found so far, including any that aren't images
+  errors INTEGER NOT NULL DEFAULT 0,  -- files that couldn't be indexed
+  error TEXT NOT NULL DEFAULT '',     -- why the job failed
+  model TEXT NOT NULL DEFAULT '',     -- searched with once the job was done
+  created INTEGER NOT NULL,       -- unix seconds
+  started INTEGER,
+  finished INTEGER,
+  FOREIGN KEY (basedir_id) REFERENCES basedir(rowid)
+);
+CREATE INDEX IF NOT EXISTS index_jobs_status_idx ON index_jobs(status);
+
+CREATE TRIGGER IF NOT EXISTS basedir_delete_index_jobs AFTER DELETE ON basedir
+BEGIN
+  DELETE FROM index_jobs WHERE basedir_id = OLD.rowid;
+END;
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// where imagedb keeps its files unless told otherwise with -db and -config. following the XDG base directory spec,
+// $XDG_DATA_HOME/imagedb/db.sqlite and $XDG_CONFIG_HOME/imagedb/config.ini (~/.local/share and ~/.config by default).
+// windows and macOS keep both in their own config directory, eg %AppData%\imagedb.
+// db.sqlite and config.ini in the working directory, where earlier versions kept them, are used instead if they exist.
+
+const appDirName = "imagedb"
+
+const (
+	legacyDatabaseFile = "db.sqlite"
+	legacyConfigFile   = "config.ini"
+)
+
+// the database opened when none is given
+func defaultDatabasePath() (string, error) {
+	if fileExists(legacyDatabaseFile) {
+		return legacyDatabaseFile, nil
+	}
+	dir, err := userDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, appDirName, "db.sqlite"), nil
+}
+
+// the config loaded when none is given
+func defaultConfigPath() (string, error) {
+	if fileExists(legacyConfigFile) {
+		return legacyConfigFile, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, appDirName, "config.ini"), nil
+}
+
+// $XDG_DATA_HOME on unix-likes, otherwise os.UserConfigDir
+func userDataDir() (string, error) {
+	switch runtime.GOOS {
+	case "windows", "darwin", "ios", "plan9":
+		return os.UserConfigDir()
+	}
+	// nb: the spec says relative paths are invalid and should be ignored
+	if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share"), nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, fs.ErrNotExist)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestDefaultDatabasePath(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		t.Skip("XDG_DATA_HOME only applies to unix-likes")
+	}
+	if fileExists(legacyDatabaseFile) {
+		t.Skip("the working directory has a database, which takes precedence")
+	}
+	dataHome := t.TempDir()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	for value, want := range map[string]string{
+		dataHome:   filepath.Join(dataHome, "imagedb", "db.sqlite"),
+		"relative": filepath.Join(home, ".local", "share", "imagedb", "db.sqlite"),
+		"":         filepath.Join(home, ".local", "share", "imagedb", "db.sqlite"),
+	} {
+		t.Setenv("XDG_DATA_HOME", value)
+		got, err := defaultDatabasePath()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("XDG_DATA_HOME=%q: got %s, expected %s", value, got, want)
+		}
+	}
+}
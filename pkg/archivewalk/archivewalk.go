@@ -4,12 +4,15 @@ package archivewalk
 import (
 	"archive/zip"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/nwaples/rardecode/v2"
 )
@@ -23,6 +26,7 @@ d - more information about the file
 threadID - a means to discern which thread is invoking the function
 
 if you wish to early abort, monitor the error channel and close the context yourself.
+return ErrSkipped for files deliberately passed over, other errors count the file as failed in the walk's Progress.
 
 Be advised that handlers are invoked concurrently from other threads
 */
@@ -39,6 +43,11 @@ type ArchiveWalk struct {
 	openZip, openRar bool
 	handler          FileHandler
 	wg               *sync.WaitGroup
+
+	counters         *counters
+	preScan          bool
+	progressInterval time.Duration
+	progressFn       func(Progress)
 }
 
 // creates a new archive walker with certain settings.
@@ -50,14 +59,61 @@ func NewArchiveWalker(workers int, errorCh chan error, openZip bool, openRar boo
 	aw.openZip = openZip
 	aw.openRar = openRar
 	aw.wg = &sync.WaitGroup{}
+	aw.counters = &counters{}
 	return &aw
 }
 
+// if enabled, walks count the files under the root in parallel with handling them, so Progress has totals.
+func (aw *ArchiveWalk) SetPreScan(enabled bool) {
+	aw.preScan = enabled
+}
+
+// fn is called with the walk's progress every interval while walking, and once more when it's finished.
+// calls are made from another goroutine.
+func (aw *ArchiveWalk) OnProgress(interval time.Duration, fn func(Progress)) {
+	aw.progressInterval, aw.progressFn = interval, fn
+}
+
+// the current walk's progress, or the last one's once it's finished
+func (aw *ArchiveWalk) Progress() Progress {
+	return aw.counters.snapshot()
+}
+
 // walks all files from specified root, including entering supported archives.
 // ctx - can halt the dirwalk
 // the errorCh channel can optionally be set to recieve errors as they happen.
 // Important note: doesn't follow symbolic directory links (to prevent looping)
 func (aw *ArchiveWalk) Walk(rootPath string, ctx context.Context) {
+	aw.counters = &counters{}
+	aw.counters.started.Store(time.Now().UnixNano())
+	scanned := make(chan struct{})
+	if aw.preScan {
+		go func() {
+			defer close(scanned)
+			aw.scan(rootPath, ctx)
+		}()
+	} else {
+		close(scanned)
+	}
+	walked, reported := make(chan struct{}), make(chan struct{})
+	if aw.progressFn != nil {
+		go func() {
+			defer close(reported)
+			ticker := time.NewTicker(aw.progressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					aw.progressFn(aw.Progress())
+				case <-walked:
+					return
+				}
+			}
+		}()
+	} else {
+		close(reported)
+	}
+
 	// workers
 	tasks := make(chan Task, aw.workers+2)
 	aw.createWorkers(tasks, ctx)
@@ -76,6 +132,7 @@ func (aw *ArchiveWalk) Walk(rootPath string, ctx context.Context) {
 		if d.IsDir() {
 			return nil
 		}
+		aw.counters.filesDiscovered.Add(1)
 
 		// add to queue
 		var task Task
@@ -89,6 +146,38 @@ func (aw *ArchiveWalk) Walk(rootPath string, ctx context.Context) {
 	aw.softenError(err)
 	close(tasks) // signifies no more values to send.
 	aw.wg.Wait()
+	<-scanned
+	close(walked)
+	<-reported
+	if aw.progressFn != nil {
+		aw.progressFn(aw.Progress())
+	}
+}
+
+// counts the files under rootPath and their size, for Progress's totals. errors are left for the walk to report.
+func (aw *ArchiveWalk) scan(rootPath string, ctx context.Context) {
+	var files, bytes int64
+	err := filepath.WalkDir(rootPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return filepath.SkipAll
+		}
+		if !d.IsDir() {
+			files++
+			if info, err := d.Info(); err == nil {
+				bytes += info.Size()
+			}
+		}
+		return nil
+	})
+	if err != nil || ctx.Err() != nil {
+		return
+	}
+	aw.counters.totalFiles.Store(files)
+	aw.counters.totalBytes.Store(bytes)
+	aw.counters.scanned.Store(true)
 }
 
 // creates ArchiveWalk.workers number of worker threads, listening on taskQueue and added to ArchiveWalk.wg WaitGroup.
@@ -123,62 +212,106 @@ func (aw *ArchiveWalk) work(taskCh <-chan Task, ctx context.Context, fn FileHand
 			// walk archives
 			ext := getExt(task.dirEntry.Name())
 			if aw.openRar && ext == "rar" {
-				err := rarWalk(task, fn, ctx, threadID)
-				notifyIfError(aw.errorCh, err)
+				err := aw.rarWalk(task, fn, ctx, threadID)
+				aw.archiveError(err)
 				break
 			}
 			if aw.openZip && ext == "zip" {
-				err := zipWalk(task, fn, ctx, threadID)
-				notifyIfError(aw.errorCh, err)
+				err := aw.zipWalk(task, fn, ctx, threadID)
+				aw.archiveError(err)
 				break
 			}
 
 			// not an archive, so handle file directly.
 			f, err := os.Open(task.path)
 			if err != nil {
+				aw.counters.filesFailed.Add(1)
 				notifyIfError(aw.errorCh, err)
 			} else {
-				defer f.Close()
-				fn(task.path, "", f, task.dirEntry, threadID)
+				aw.handle(ctx, fn, task.path, "", f, task.dirEntry, threadID)
+				f.Close()
+				aw.counters.bytesRead.Add(fileSize(task.dirEntry))
 			}
 		}
 	}
 }
 
+// calls the handler, counting the outcome
+func (aw *ArchiveWalk) handle(ctx context.Context, fn FileHandler, path, vpath string, file io.Reader, d fs.DirEntry, threadID int) {
+	err := fn(path, vpath, file, d, threadID)
+	aw.counters.filesHandled.Add(1)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrSkipped):
+		aw.counters.filesSkipped.Add(1)
+	case ctx.Err() == nil:
+		// nb: errors from cancelling the walk aren't the file's fault
+		aw.counters.filesFailed.Add(1)
+	}
+}
+
+// an archive that couldn't be opened counts as a failed file
+func (aw *ArchiveWalk) archiveError(err error) {
+	if err != nil {
+		aw.counters.filesFailed.Add(1)
+		notifyIfError(aw.errorCh, err)
+	}
+}
+
+// the file's size on disk, 0 if unknown
+func fileSize(d fs.DirEntry) int64 {
+	info, err := d.Info()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
 // walks .zip archives
 // todo: file crc check?
-func zipWalk(task Task, fh FileHandler, ctx context.Context, threadID int) error {
+func (aw *ArchiveWalk) zipWalk(task Task, fh FileHandler, ctx context.Context, threadID int) error {
 	r, err := zip.OpenReader(task.path)
 	if err != nil {
 		return err
 	}
 	defer r.Close()
+	aw.counters.archivesOpened.Add(1)
 
 	//iterate through the archive
+	var read int64
 	for _, f := range r.File {
 		select {
 		case <-ctx.Done():
 			return nil
 		default:
 		}
+		if f.FileInfo().IsDir() {
+			continue
+		}
 		fileHandle, err := f.Open()
 		if err == nil {
-			defer fileHandle.Close()
-			fh(task.path, f.Name, fileHandle, task.dirEntry, threadID)
+			aw.handle(ctx, fh, task.path, f.Name, fileHandle, task.dirEntry, threadID)
+			fileHandle.Close()
+			read += int64(f.CompressedSize64)
+			aw.counters.bytesRead.Add(int64(f.CompressedSize64))
 		} else {
 			return err
 		}
 	}
+	// nb: the rest of the archive, its headers and directory
+	aw.counters.bytesRead.Add(max(fileSize(task.dirEntry)-read, 0))
 	return nil
 }
 
 // walks .rar archives
-func rarWalk(task Task, fh FileHandler, ctx context.Context, threadID int) error {
+func (aw *ArchiveWalk) rarWalk(task Task, fh FileHandler, ctx context.Context, threadID int) error {
 	r, err := rardecode.OpenReader(task.path)
 	if err != nil {
 		return err
 	}
 	defer r.Close()
+	aw.counters.archivesOpened.Add(1)
+	var read int64
 
 	//iterate through the archive
 	err = nil
@@ -194,13 +327,75 @@ func rarWalk(task Task, fh FileHandler, ctx context.Context, threadID int) error
 			if header.IsDir {
 				continue
 			}
-			fh(task.path, header.Name, r, task.dirEntry, threadID)
+			aw.handle(ctx, fh, task.path, header.Name, r, task.dirEntry, threadID)
+			read += header.PackedSize
+			aw.counters.bytesRead.Add(header.PackedSize)
 		}
 	}
 
 	//wipe EOF error since we shouldn't care about it.
 	if err.Error() == "EOF" {
 		err = nil
+		aw.counters.bytesRead.Add(max(fileSize(task.dirEntry)-read, 0))
+	}
+	return err
+}
+
+// opens the file at vpath within the zip or rar archive at path, as walking it would pass it to a FileHandler.
+// closing the file closes the archive too.
+func OpenArchiveFile(path, vpath string) (io.ReadCloser, error) {
+	switch getExt(path) {
+	case "zip":
+		r, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range r.File {
+			if f.Name == vpath {
+				fileHandle, err := f.Open()
+				if err != nil {
+					r.Close()
+					return nil, err
+				}
+				return &archiveFile{Reader: fileHandle, closers: []io.Closer{fileHandle, r}}, nil
+			}
+		}
+		r.Close()
+	case "rar":
+		r, err := rardecode.OpenReader(path)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			header, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				r.Close()
+				return nil, err
+			}
+			if !header.IsDir && header.Name == vpath {
+				return &archiveFile{Reader: r, closers: []io.Closer{r}}, nil
+			}
+		}
+		r.Close()
+	default:
+		return nil, fmt.Errorf("%s isn't a zip or rar archive", path)
+	}
+	return nil, &fs.PathError{Op: "open", Path: path + ":" + vpath, Err: fs.ErrNotExist}
+}
+
+// a file in an archive, which closes the archive with it
+type archiveFile struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (f *archiveFile) Close() error {
+	var err error
+	for _, c := range f.closers {
+		err = errors.Join(err, c.Close())
 	}
 	return err
 }
@@ -2,9 +2,12 @@ package archivewalk
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -32,7 +35,7 @@ func Test_archivewalk(t *testing.T) {
 		files++
 		return nil
 	})
-	aw.Walk("../test_data/valid", ctx)
+	aw.Walk("../../test_data/valid", ctx)
 	time.Sleep(10 * time.Millisecond)
 
 	if files != 17 {
@@ -56,6 +59,59 @@ func Test_archivewalk(t *testing.T) {
 	}
 }
 
-/*
-todo: test what happens when handler returns errors
-*/
+// Ensures a file can be read from an archive, and a missing one reported
+func Test_OpenArchiveFile(t *testing.T) {
+	archive := "../../test_data/valid/test_archive.zip"
+	f, err := OpenArchiveFile(archive, "000000034873.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Error(err)
+	}
+	if len(data) != 94292 {
+		t.Errorf("expected 94292 bytes, read %d", len(data))
+	}
+	if _, err := OpenArchiveFile(archive, "missing.jpg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a missing file to not exist, got %v", err)
+	}
+}
+
+// Ensures progress is counted, including the handler's skipped and failed files, with the pre-scan's totals
+func Test_Progress(t *testing.T) {
+	var reports atomic.Int64
+	aw := NewArchiveWalker(4, nil, true, true, func(path, vpath string, file io.Reader, d fs.DirEntry, threadID int) error {
+		switch {
+		case vpath == "":
+			return fmt.Errorf("%s: %w", path, ErrSkipped)
+		case strings.HasPrefix(vpath, "000000034873"):
+			return errors.New("unreadable")
+		}
+		_, err := io.Copy(io.Discard, file)
+		return err
+	})
+	aw.SetPreScan(true)
+	aw.OnProgress(time.Millisecond, func(Progress) { reports.Add(1) })
+	aw.Walk("../../test_data/valid", context.Background())
+
+	p := aw.Progress()
+	if p.FilesDiscovered != 3 || p.ArchivesOpened != 1 || p.FilesHandled != 17 || p.FilesSkipped != 2 || p.FilesFailed != 1 {
+		t.Errorf("unexpected counts %+v", p)
+	}
+	if !p.Scanned || p.TotalFiles != 3 || p.TotalBytes != p.BytesRead || p.TotalBytes < 2_900_000 {
+		t.Errorf("expected the pre-scan's totals to match what was read, got %+v", p)
+	}
+	if fraction, ok := p.Fraction(); !ok || fraction != 1 {
+		t.Errorf("expected the walk to be complete, got %v %v", fraction, ok)
+	}
+	if eta, ok := p.ETA(); !ok || eta != 0 {
+		t.Errorf("expected no time left, got %v %v", eta, ok)
+	}
+	if reports.Load() < 1 {
+		t.Error("expected progress to be reported")
+	}
+}
@@ -0,0 +1,86 @@
+package archivewalk
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// handlers return ErrSkipped, or an error wrapping it, for files they deliberately pass over,
+// such as those that aren't images, so that they're counted as skipped rather than failed.
+var ErrSkipped = errors.New("skipped")
+
+// a snapshot of a walk's progress, see ArchiveWalk.Progress
+type Progress struct {
+	FilesDiscovered int64 // files found walking the directories, each archive counting as one
+	ArchivesOpened  int64
+	FilesHandled    int64 // files passed to the handler, including those within archives
+	FilesSkipped    int64 // of those handled, ones the handler returned ErrSkipped for
+	FilesFailed     int64 // ones the handler returned another error for, or that couldn't be opened
+	BytesRead       int64 // on disk, archives' by the compressed size of the entries walked so far
+
+	// the pre-scan's totals of what's on disk, valid once Scanned
+	Scanned    bool
+	TotalFiles int64 // each archive counting as one
+	TotalBytes int64
+
+	Elapsed time.Duration // since the walk started
+}
+
+// how far through the walk is, between 0 and 1. ok is false until the pre-scan has finished.
+func (p Progress) Fraction() (fraction float64, ok bool) {
+	if !p.Scanned {
+		return 0, false
+	}
+	if p.TotalBytes <= 0 {
+		return 1, true
+	}
+	return min(float64(p.BytesRead)/float64(p.TotalBytes), 1), true
+}
+
+// files handled per second
+func (p Progress) Rate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.FilesHandled) / p.Elapsed.Seconds()
+}
+
+// the estimated time left, going by the bytes read so far. ok is false until there's enough to go on.
+func (p Progress) ETA() (eta time.Duration, ok bool) {
+	fraction, ok := p.Fraction()
+	if !ok || p.BytesRead <= 0 || p.Elapsed <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(p.Elapsed) * (1 - fraction) / fraction), true
+}
+
+// the live counts behind Progress, updated concurrently by the workers
+type counters struct {
+	filesDiscovered, archivesOpened         atomic.Int64
+	filesHandled, filesSkipped, filesFailed atomic.Int64
+	bytesRead                               atomic.Int64
+	scanned                                 atomic.Bool
+	totalFiles, totalBytes                  atomic.Int64
+	started                                 atomic.Int64 // unix nanoseconds
+}
+
+func (c *counters) snapshot() Progress {
+	p := Progress{
+		FilesDiscovered: c.filesDiscovered.Load(),
+		ArchivesOpened:  c.archivesOpened.Load(),
+		FilesHandled:    c.filesHandled.Load(),
+		FilesSkipped:    c.filesSkipped.Load(),
+		FilesFailed:     c.filesFailed.Load(),
+		BytesRead:       c.bytesRead.Load(),
+		Scanned:         c.scanned.Load(),
+	}
+	// nb: totals are set before scanned, so they're complete if it is
+	if p.Scanned {
+		p.TotalFiles, p.TotalBytes = c.totalFiles.Load(), c.totalBytes.Load()
+	}
+	if started := c.started.Load(); started > 0 {
+		p.Elapsed = time.Since(time.Unix(0, started))
+	}
+	return p
+}
@@ -0,0 +1,211 @@
+// cliptokenizer is a Go port of the byte-level BPE tokenizer used by CLIP's text encoder,
+// reading the vocab.json and merges.txt files distributed with Hugging Face CLIP models.
+package cliptokenizer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	StartOfText = "<|startoftext|>"
+	EndOfText   = "<|endoftext|>"
+	// the sequence length CLIP text encoders are trained with
+	ContextLength = 77
+
+	endOfWord = "</w>"
+)
+
+// splits text into words, numbers and runs of punctuation, as CLIP does
+var wordPattern = regexp.MustCompile(`(?i)<\|startoftext\|>|<\|endoftext\|>|'s|'t|'re|'ve|'m|'ll|'d|\p{L}+|\p{N}|[^\s\p{L}\p{N}]+`)
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+type Tokenizer struct {
+	vocab    map[string]int64
+	ranks    map[[2]string]int // merge priority, lower merges first
+	byteRune [256]rune
+	sot, eot int64
+
+	cacheMutex sync.Mutex
+	cache      map[string][]string
+}
+
+// Load reads vocab.json and merges.txt from dir.
+func Load(dir string) (*Tokenizer, error) {
+	vocabFile, err := os.Open(filepath.Join(dir, "vocab.json"))
+	if err != nil {
+		return nil, err
+	}
+	defer vocabFile.Close()
+	var vocab map[string]int64
+	if err := json.NewDecoder(vocabFile).Decode(&vocab); err != nil {
+		return nil, fmt.Errorf("failed to read vocab.json: %w", err)
+	}
+
+	mergesFile, err := os.Open(filepath.Join(dir, "merges.txt"))
+	if err != nil {
+		return nil, err
+	}
+	defer mergesFile.Close()
+	merges, err := readMerges(mergesFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read merges.txt: %w", err)
+	}
+	return New(vocab, merges)
+}
+
+// one merge per line, as two space separated symbols. Lines starting with # are ignored.
+func readMerges(r io.Reader) ([][2]string, error) {
+	merges := make([][2]string, 0, 48894)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		a, b, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("malformed merge %q", line)
+		}
+		merges = append(merges, [2]string{a, b})
+	}
+	return merges, scanner.Err()
+}
+
+// New creates a tokenizer from a vocabulary and a list of merges in priority order.
+// The vocabulary must contain the start and end of text tokens.
+func New(vocab map[string]int64, merges [][2]string) (*Tokenizer, error) {
+	t := &Tokenizer{
+		vocab: vocab,
+		ranks: make(map[[2]string]int, len(merges)),
+		cache: make(map[string][]string),
+	}
+	for i, merge := range merges {
+		if _, ok := t.ranks[merge]; !ok {
+			t.ranks[merge] = i
+		}
+	}
+	var ok bool
+	if t.sot, ok = vocab[StartOfText]; !ok {
+		return nil, fmt.Errorf("vocabulary has no %s token", StartOfText)
+	}
+	if t.eot, ok = vocab[EndOfText]; !ok {
+		return nil, fmt.Errorf("vocabulary has no %s token", EndOfText)
+	}
+	t.byteRune = bytesToUnicode()
+	return t, nil
+}
+
+// bytesToUnicode maps every byte to a printable rune, so that BPE can work on strings
+// without whitespace or control characters. Printable latin-1 bytes map to themselves.
+func bytesToUnicode() [256]rune {
+	var table [256]rune
+	printable := func(b int) bool {
+		return (b >= '!' && b <= '~') || (b >= 0xA1 && b <= 0xAC) || (b >= 0xAE && b <= 0xFF)
+	}
+	n := 0
+	for b := 0; b < 256; b++ {
+		if printable(b) {
+			table[b] = rune(b)
+		} else {
+			table[b] = rune(256 + n)
+			n++
+		}
+	}
+	return table
+}
+
+// Encode tokenizes text, without the start and end of text tokens.
+func (t *Tokenizer) Encode(text string) []int64 {
+	text = html.UnescapeString(html.UnescapeString(text))
+	text = strings.ToLower(strings.TrimSpace(whitespace.ReplaceAllString(text, " ")))
+
+	ids := make([]int64, 0, len(text)/3)
+	for _, word := range wordPattern.FindAllString(text, -1) {
+		var encoded strings.Builder
+		for _, b := range []byte(word) {
+			encoded.WriteRune(t.byteRune[b])
+		}
+		for _, symbol := range t.bpe(encoded.String()) {
+			if id, ok := t.vocab[symbol]; ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// EncodePadded tokenizes text for a CLIP text encoder: wrapped in start and end of text tokens,
+// truncated or zero padded to length. mask is 1 for real tokens and 0 for padding.
+func (t *Tokenizer) EncodePadded(text string, length int) (ids, mask []int64) {
+	tokens := t.Encode(text)
+	if len(tokens) > length-2 {
+		tokens = tokens[:max(length-2, 0)]
+	}
+	ids = make([]int64, length)
+	mask = make([]int64, length)
+	ids[0] = t.sot
+	copy(ids[1:], tokens)
+	ids[len(tokens)+1] = t.eot
+	for i := 0; i < len(tokens)+2; i++ {
+		mask[i] = 1
+	}
+	return ids, mask
+}
+
+// applies the merges to a single byte-encoded word, returning its symbols
+func (t *Tokenizer) bpe(word string) []string {
+	t.cacheMutex.Lock()
+	cached, ok := t.cache[word]
+	t.cacheMutex.Unlock()
+	if ok {
+		return cached
+	}
+
+	runes := []rune(word)
+	symbols := make([]string, len(runes))
+	for i, r := range runes {
+		symbols[i] = string(r)
+	}
+	symbols[len(symbols)-1] += endOfWord
+
+	for len(symbols) > 1 {
+		// find the highest priority pair
+		best, bestRank := -1, 0
+		for i := 0; i < len(symbols)-1; i++ {
+			rank, ok := t.ranks[[2]string{symbols[i], symbols[i+1]}]
+			if ok && (best < 0 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		// merge every occurrence of it
+		first, second := symbols[best], symbols[best+1]
+		merged := symbols[:0:0]
+		for i := 0; i < len(symbols); i++ {
+			if i < len(symbols)-1 && symbols[i] == first && symbols[i+1] == second {
+				merged = append(merged, first+second)
+				i++
+				continue
+			}
+			merged = append(merged, symbols[i])
+		}
+		symbols = merged
+	}
+
+	t.cacheMutex.Lock()
+	t.cache[word] = symbols
+	t.cacheMutex.Unlock()
+	return symbols
+}
@@ -0,0 +1,90 @@
+package cliptokenizer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testTokenizer(t *testing.T) *Tokenizer {
+	vocab := map[string]int64{
+		"a": 1, "c": 2, "t": 3, "a</w>": 4, "t</w>": 5, "s</w>": 6,
+		"ca": 7, "cat</w>": 8, "!</w>": 9, "'s</w>": 10, "'": 11,
+		StartOfText: 100, EndOfText: 101,
+	}
+	merges := [][2]string{{"c", "a"}, {"ca", "t</w>"}, {"'", "s</w>"}}
+	tok, err := New(vocab, merges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func TestEncode(t *testing.T) {
+	tok := testTokenizer(t)
+	tests := map[string][]int64{
+		"cat":         {8},
+		"  CAT  cat ": {8, 8},
+		"cats":        {7, 3, 6}, // ca t s</w>: "ts</w>" isn't a merge
+		"a cat!":      {4, 8, 9},
+		"cat's":       {8, 10},
+		"&amp;":       {}, // & isn't in the vocabulary
+	}
+	for text, want := range tests {
+		got := tok.Encode(text)
+		if !reflect.DeepEqual(got, want) && !(len(got) == 0 && len(want) == 0) {
+			t.Errorf("Encode(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
+
+func TestEncodePadded(t *testing.T) {
+	tok := testTokenizer(t)
+	ids, mask := tok.EncodePadded("a cat", 6)
+	if !reflect.DeepEqual(ids, []int64{100, 4, 8, 101, 0, 0}) {
+		t.Errorf("unexpected ids %v", ids)
+	}
+	if !reflect.DeepEqual(mask, []int64{1, 1, 1, 1, 0, 0}) {
+		t.Errorf("unexpected mask %v", mask)
+	}
+	// truncated, keeping the end of text token
+	ids, _ = tok.EncodePadded("cat cat cat cat cat", 4)
+	if !reflect.DeepEqual(ids, []int64{100, 8, 8, 101}) {
+		t.Errorf("unexpected truncated ids %v", ids)
+	}
+}
+
+func TestBytesToUnicode(t *testing.T) {
+	table := bytesToUnicode()
+	if table['a'] != 'a' || table[' '] != 'Ġ' || table['\n'] != 'Ċ' {
+		t.Errorf("unexpected mapping: a=%q space=%q newline=%q", table['a'], table[' '], table['\n'])
+	}
+	seen := make(map[rune]bool)
+	for _, r := range table {
+		if seen[r] {
+			t.Fatalf("rune %q is mapped from more than one byte", r)
+		}
+		seen[r] = true
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "vocab.json"),
+		[]byte(`{"c":0,"a":1,"ca</w>":2,"<|startoftext|>":3,"<|endoftext|>":4}`), 0o644)
+	os.WriteFile(filepath.Join(dir, "merges.txt"), []byte("#version: 0.2\nc a</w>\n"), 0o644)
+	tok, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tok.Encode("ca"); !reflect.DeepEqual(got, []int64{2}) {
+		t.Errorf("unexpected ids %v", got)
+	}
+
+	_, err = readMerges(strings.NewReader("nospace\n"))
+	if err == nil {
+		t.Error("expected an error for a malformed merge")
+	}
+}
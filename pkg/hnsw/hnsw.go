@@ -0,0 +1,300 @@
+// hnsw is an in-memory approximate nearest neighbour index: a Hierarchical Navigable Small World graph
+// (Malkov & Yashunin, 2016) over float32 vectors, compared by euclidean distance.
+// Supports incremental inserts, deletion, filtered search and saving/loading.
+package hnsw
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sync"
+
+	"github.com/crimro-se/imagedb/pkg/vecmath"
+)
+
+const (
+	DefaultM              = 16
+	DefaultEfConstruction = 200
+	DefaultEfSearch       = 64
+)
+
+type node struct {
+	id        int64
+	vec       []float32
+	neighbors [][]uint32 // per level, indices into Graph.nodes
+	deleted   bool
+}
+
+// Graph is safe for concurrent use. Searches run in parallel, inserts and deletes are serialised.
+type Graph struct {
+	// neighbours per node on each level above 0, level 0 has 2*M. Fixed once the graph has nodes.
+	M int
+	// candidates considered when inserting. higher builds a better graph, slower.
+	EfConstruction int
+
+	mu        sync.RWMutex
+	dimension int
+	nodes     []node
+	ids       map[int64]uint32 // id -> index of its live node
+	entry     uint32
+	maxLevel  int
+	deleted   int
+	rng       *rand.Rand
+}
+
+// Result is a search hit, Distance is the squared euclidean distance to the query.
+type Result struct {
+	ID       int64
+	Distance float32
+}
+
+// New creates an empty graph for vectors of the given dimension, with default parameters.
+func New(dimension int) *Graph {
+	return &Graph{
+		M:              DefaultM,
+		EfConstruction: DefaultEfConstruction,
+		dimension:      dimension,
+		ids:            make(map[int64]uint32),
+		rng:            rand.New(rand.NewSource(1)),
+	}
+}
+
+func (g *Graph) Dimension() int {
+	return g.dimension
+}
+
+// Len is the number of (live) vectors in the graph.
+func (g *Graph) Len() int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return len(g.ids)
+}
+
+func (g *Graph) Contains(id int64) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	_, ok := g.ids[id]
+	return ok
+}
+
+// IDs lists the ids in the graph, in no particular order.
+func (g *Graph) IDs() []int64 {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	ids := make([]int64, 0, len(g.ids))
+	for id := range g.ids {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Add inserts vec under id, replacing any vector already added with that id.
+// vec must have the graph's dimension, and isn't copied.
+func (g *Graph) Add(id int64, vec []float32) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if old, ok := g.ids[id]; ok {
+		g.markDeleted(old)
+	}
+	g.insert(id, vec)
+	g.compactIfNeeded()
+}
+
+// Delete removes id from the graph, reporting whether it was present.
+func (g *Graph) Delete(id int64) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	idx, ok := g.ids[id]
+	if !ok {
+		return false
+	}
+	g.markDeleted(idx)
+	g.compactIfNeeded()
+	return true
+}
+
+// deleted nodes stay in the graph to be navigated through, but are never returned.
+func (g *Graph) markDeleted(idx uint32) {
+	g.nodes[idx].deleted = true
+	delete(g.ids, g.nodes[idx].id)
+	g.deleted++
+}
+
+// once most of the graph is deleted nodes, it's rebuilt from the live ones.
+func (g *Graph) compactIfNeeded() {
+	if g.deleted < 1024 || g.deleted < len(g.ids) {
+		return
+	}
+	old := g.nodes
+	g.nodes = make([]node, 0, len(g.ids))
+	g.ids = make(map[int64]uint32, len(g.ids))
+	g.deleted = 0
+	g.maxLevel = 0
+	for _, n := range old {
+		if !n.deleted {
+			g.insert(n.id, n.vec)
+		}
+	}
+}
+
+func (g *Graph) maxNeighbors(level int) int {
+	if level == 0 {
+		return 2 * g.M
+	}
+	return g.M
+}
+
+func (g *Graph) randomLevel() int {
+	return int(math.Floor(-math.Log(1-g.rng.Float64()) / math.Log(float64(g.M))))
+}
+
+func (g *Graph) distance(a []float32, idx uint32) float32 {
+	return vecmath.L2Squared(a, g.nodes[idx].vec)
+}
+
+func (g *Graph) insert(id int64, vec []float32) {
+	level := g.randomLevel()
+	idx := uint32(len(g.nodes))
+	g.nodes = append(g.nodes, node{id: id, vec: vec, neighbors: make([][]uint32, level+1)})
+	g.ids[id] = idx
+	if idx == 0 {
+		g.entry, g.maxLevel = idx, level
+		return
+	}
+
+	ep := []candidate{{g.entry, g.distance(vec, g.entry)}}
+	for l := g.maxLevel; l > level; l-- {
+		ep = g.searchLayer(vec, ep, 1, l, nil)
+	}
+	for l := min(level, g.maxLevel); l >= 0; l-- {
+		found := g.searchLayer(vec, ep, g.EfConstruction, l, nil)
+		neighbors := g.selectNeighbors(found, g.M)
+		g.nodes[idx].neighbors[l] = indices(neighbors)
+		for _, n := range neighbors {
+			g.link(n.idx, idx, l)
+		}
+		ep = found
+	}
+	if level > g.maxLevel {
+		g.entry, g.maxLevel = idx, level
+	}
+}
+
+// adds a link from -> to on level, pruning from's links if it now has too many.
+func (g *Graph) link(from, to uint32, level int) {
+	links := append(g.nodes[from].neighbors[level], to)
+	if len(links) > g.maxNeighbors(level) {
+		vec := g.nodes[from].vec
+		cands := make([]candidate, len(links))
+		for i, l := range links {
+			cands[i] = candidate{l, g.distance(vec, l)}
+		}
+		sortCandidates(cands)
+		links = indices(g.selectNeighbors(cands, g.maxNeighbors(level)))
+	}
+	g.nodes[from].neighbors[level] = links
+}
+
+// the heuristic neighbour selection from the paper: a candidate is kept only if it's closer to the
+// base than to any neighbour already kept, which spreads links out in different directions.
+// The remaining slots are then filled with the nearest candidates that were skipped.
+// cands must be sorted nearest first.
+func (g *Graph) selectNeighbors(cands []candidate, m int) []candidate {
+	if len(cands) <= m {
+		return cands
+	}
+	selected := make([]candidate, 0, m)
+	skipped := make([]candidate, 0, len(cands))
+	for _, c := range cands {
+		if len(selected) >= m {
+			break
+		}
+		keep := true
+		for _, s := range selected {
+			if vecmath.L2Squared(g.nodes[c.idx].vec, g.nodes[s.idx].vec) < c.distance {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			selected = append(selected, c)
+		} else {
+			skipped = append(skipped, c)
+		}
+	}
+	for _, c := range skipped {
+		if len(selected) >= m {
+			break
+		}
+		selected = append(selected, c)
+	}
+	return selected
+}
+
+// greedy beam search of one level, returning up to ef nearest nodes sorted nearest first.
+// accept (optional) restricts which nodes may be results, but all nodes are navigated through.
+func (g *Graph) searchLayer(query []float32, entry []candidate, ef int, level int, accept func(idx uint32) bool) []candidate {
+	visited := make(map[uint32]struct{}, ef*4)
+	candidates := &minHeap{}
+	results := &maxHeap{}
+	for _, e := range entry {
+		visited[e.idx] = struct{}{}
+		heap.Push(candidates, e)
+		if accept == nil || accept(e.idx) {
+			heap.Push(results, e)
+		}
+	}
+	for candidates.Len() > 0 {
+		c := heap.Pop(candidates).(candidate)
+		if results.Len() >= ef && c.distance > (*results)[0].distance {
+			break
+		}
+		for _, n := range g.nodes[c.idx].neighbors[level] {
+			if _, seen := visited[n]; seen {
+				continue
+			}
+			visited[n] = struct{}{}
+			d := g.distance(query, n)
+			if results.Len() < ef || d < (*results)[0].distance {
+				heap.Push(candidates, candidate{n, d})
+				if accept == nil || accept(n) {
+					heap.Push(results, candidate{n, d})
+					if results.Len() > ef {
+						heap.Pop(results)
+					}
+				}
+			}
+		}
+	}
+	out := make([]candidate, results.Len())
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = heap.Pop(results).(candidate)
+	}
+	return out
+}
+
+// Search finds the k nearest vectors to query. ef (at least k) trades speed for recall.
+// filter (optional) restricts results to the ids it accepts. Very selective filters make searches slower,
+// as more of the graph has to be explored to find k matches.
+func (g *Graph) Search(query []float32, k, ef int, filter func(id int64) bool) []Result {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if len(g.nodes) == 0 || k <= 0 {
+		return nil
+	}
+	ef = max(ef, k)
+	ep := []candidate{{g.entry, g.distance(query, g.entry)}}
+	for l := g.maxLevel; l > 0; l-- {
+		ep = g.searchLayer(query, ep, 1, l, nil)
+	}
+	accept := func(idx uint32) bool {
+		n := &g.nodes[idx]
+		return !n.deleted && (filter == nil || filter(n.id))
+	}
+	found := g.searchLayer(query, ep, ef, 0, accept)
+	results := make([]Result, 0, min(k, len(found)))
+	for _, c := range found[:min(k, len(found))] {
+		results = append(results, Result{ID: g.nodes[c.idx].id, Distance: c.distance})
+	}
+	return results
+}
@@ -0,0 +1,252 @@
+package hnsw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/crimro-se/imagedb/pkg/vecmath"
+)
+
+func randomVectors(n, dimension int, seed int64) [][]float32 {
+	rng := rand.New(rand.NewSource(seed))
+	vecs := make([][]float32, n)
+	for i := range vecs {
+		vecs[i] = make([]float32, dimension)
+		for j := range vecs[i] {
+			vecs[i][j] = float32(rng.NormFloat64())
+		}
+		vecmath.Normalize(vecs[i])
+	}
+	return vecs
+}
+
+// the ids of the k nearest vectors by exhaustive search, among those filter accepts
+func bruteForce(vecs [][]float32, query []float32, k int, filter func(id int64) bool) map[int64]bool {
+	type hit struct {
+		id int64
+		d  float32
+	}
+	hits := make([]hit, 0, len(vecs))
+	for i, v := range vecs {
+		if filter == nil || filter(int64(i)) {
+			hits = append(hits, hit{int64(i), vecmath.L2Squared(v, query)})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].d < hits[j].d })
+	out := make(map[int64]bool)
+	for _, h := range hits[:min(k, len(hits))] {
+		out[h.id] = true
+	}
+	return out
+}
+
+func recall(g *Graph, vecs, queries [][]float32, k, ef int, filter func(id int64) bool) float64 {
+	found, total := 0, 0
+	for _, q := range queries {
+		want := bruteForce(vecs, q, k, filter)
+		for _, r := range g.Search(q, k, ef, filter) {
+			if want[r.ID] {
+				found++
+			}
+			if filter != nil && !filter(r.ID) {
+				return 0
+			}
+		}
+		total += len(want)
+	}
+	return float64(found) / float64(total)
+}
+
+func buildGraph(vecs [][]float32) *Graph {
+	g := New(len(vecs[0]))
+	g.EfConstruction = 64
+	for i, v := range vecs {
+		g.Add(int64(i), v)
+	}
+	return g
+}
+
+func TestRecall(t *testing.T) {
+	vecs := randomVectors(3000, 24, 1)
+	queries := randomVectors(50, 24, 2)
+	g := buildGraph(vecs)
+	if g.Len() != len(vecs) {
+		t.Fatalf("expected %d vectors, got %d", len(vecs), g.Len())
+	}
+	low := recall(g, vecs, queries, 10, 10, nil)
+	high := recall(g, vecs, queries, 10, 200, nil)
+	if high < 0.95 {
+		t.Errorf("recall %.3f with ef 200 is too low", high)
+	}
+	if low > high {
+		t.Errorf("recall should improve with ef: %.3f (ef 10) vs %.3f (ef 200)", low, high)
+	}
+	// results are sorted nearest first
+	results := g.Search(queries[0], 10, 64, nil)
+	for i := 1; i < len(results); i++ {
+		if results[i].Distance < results[i-1].Distance {
+			t.Fatalf("results out of order: %v", results)
+		}
+	}
+}
+
+func TestFilteredSearch(t *testing.T) {
+	vecs := randomVectors(2000, 16, 3)
+	queries := randomVectors(20, 16, 4)
+	g := buildGraph(vecs)
+	// a selective filter, 1 in 20
+	filter := func(id int64) bool { return id%20 == 0 }
+	if r := recall(g, vecs, queries, 10, 100, filter); r < 0.9 {
+		t.Errorf("filtered recall %.3f is too low", r)
+	}
+	if results := g.Search(queries[0], 5, 50, func(id int64) bool { return false }); len(results) != 0 {
+		t.Errorf("expected no results when nothing passes the filter, got %v", results)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	vecs := randomVectors(500, 8, 5)
+	g := buildGraph(vecs)
+	for i := 0; i < 500; i += 2 {
+		if !g.Delete(int64(i)) {
+			t.Fatalf("%d wasn't present", i)
+		}
+	}
+	if g.Delete(0) {
+		t.Error("deleted the same id twice")
+	}
+	if g.Len() != 250 || g.Contains(0) || !g.Contains(1) {
+		t.Errorf("unexpected contents after deleting, len %d", g.Len())
+	}
+	for _, q := range randomVectors(20, 8, 6) {
+		for _, r := range g.Search(q, 10, 50, nil) {
+			if r.ID%2 == 0 {
+				t.Fatalf("deleted id %d returned", r.ID)
+			}
+		}
+	}
+	// replacing a vector moves the id
+	g.Add(1, vecs[3])
+	if results := g.Search(vecs[3], 2, 50, nil); len(results) != 2 || results[0].Distance != 0 || results[1].Distance != 0 {
+		t.Errorf("replaced vector not found: %v", results)
+	}
+	if g.Len() != 250 {
+		t.Errorf("replacing changed the length to %d", g.Len())
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	vecs := randomVectors(3000, 8, 7)
+	g := buildGraph(vecs)
+	for i := 0; i < 2000; i++ {
+		g.Delete(int64(i))
+	}
+	// rebuilt once half were deleted
+	if len(g.nodes) >= 3000 || g.deleted >= 1000 || g.Len() != 1000 {
+		t.Errorf("expected the graph to have been rebuilt, have %d nodes, %d deleted", len(g.nodes), g.deleted)
+	}
+	for i := 2000; i < 2100; i++ {
+		results := g.Search(vecs[i], 1, 50, nil)
+		if len(results) != 1 || results[0].ID != int64(i) {
+			t.Fatalf("vector %d not found after compaction: %v", i, results)
+		}
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	vecs := randomVectors(300, 12, 9)
+	g := buildGraph(vecs)
+	g.Delete(5)
+	var buf bytes.Buffer
+	if err := g.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	saved := buf.Bytes()
+	loaded, err := Load(bytes.NewReader(saved), int64(len(saved)), 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Len() != g.Len() || loaded.Contains(5) || loaded.Dimension() != 12 || loaded.M != g.M {
+		t.Fatalf("loaded graph differs: len %d vs %d", loaded.Len(), g.Len())
+	}
+	for _, q := range randomVectors(10, 12, 10) {
+		a, b := g.Search(q, 5, 40, nil), loaded.Search(q, 5, 40, nil)
+		for i := range a {
+			if a[i] != b[i] {
+				t.Fatalf("loaded graph searches differently: %v vs %v", a, b)
+			}
+		}
+	}
+	// still usable for inserts
+	loaded.Add(1000, vecs[0])
+	if !loaded.Contains(1000) {
+		t.Error("insert after load failed")
+	}
+
+	if _, err := Load(bytes.NewReader([]byte("nope")), 4, 12); err == nil {
+		t.Error("expected an error loading garbage")
+	}
+	if _, err := Load(bytes.NewReader(saved), int64(len(saved)), 16); err == nil {
+		t.Error("expected an error loading a graph of another dimension")
+	}
+	if _, err := Load(bytes.NewReader(saved[:len(saved)/2]), int64(len(saved)/2), 12); err == nil {
+		t.Error("expected an error loading a truncated graph")
+	}
+	// a node count far beyond what the file holds is rejected rather than allocated
+	corrupt := bytes.Clone(saved)
+	binary.LittleEndian.PutUint32(corrupt[len(magic)+6*4:], 1<<31)
+	if _, err := Load(bytes.NewReader(corrupt), int64(len(corrupt)), 12); !errors.Is(err, errTruncated) {
+		t.Errorf("expected a corrupt node count to be rejected, got %v", err)
+	}
+}
+
+// structurally broken graphs would panic searches, so they must fail to load
+func TestLoadRejectsBrokenStructure(t *testing.T) {
+	vecs := randomVectors(300, 12, 9)
+	cases := map[string]func(g *Graph){
+		"node without levels": func(g *Graph) {
+			g.nodes[1].neighbors = nil
+		},
+		"entry below the top level": func(g *Graph) {
+			n := &g.nodes[g.entry]
+			n.neighbors = n.neighbors[:len(n.neighbors)-1]
+		},
+		"link to a node without that level": func(g *Graph) {
+			for i := range g.nodes {
+				if len(g.nodes[i].neighbors) == 1 {
+					top := g.nodes[g.entry].neighbors
+					top[g.maxLevel] = append(top[g.maxLevel], uint32(i))
+					return
+				}
+			}
+		},
+	}
+	for name, corrupt := range cases {
+		g := buildGraph(vecs)
+		if g.maxLevel == 0 {
+			t.Fatal("test graph needs more than one level")
+		}
+		corrupt(g)
+		var buf bytes.Buffer
+		if err := g.Save(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(bytes.NewReader(buf.Bytes()), int64(buf.Len()), 12); err == nil || !strings.Contains(err.Error(), "corrupt hnsw index") {
+			t.Errorf("%s: expected a corrupt index error, got %v", name, err)
+		}
+	}
+}
+
+func BenchmarkAdd(b *testing.B) {
+	vecs := randomVectors(b.N, 768, 11)
+	g := New(768)
+	b.ResetTimer()
+	for i, v := range vecs {
+		g.Add(int64(i), v)
+	}
+}
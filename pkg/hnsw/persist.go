@@ -0,0 +1,155 @@
+package hnsw
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+)
+
+// file format: little endian throughout
+//
+//	magic "HNSW", version uint32
+//	dimension, M, efConstruction, maxLevel, entry, node count: uint32 each
+//	per node: id int64, deleted uint8, vector float32 * dimension,
+//	          level count uint32, per level: link count uint32, links uint32 * count
+const (
+	magic         = "HNSW"
+	formatVersion = 1
+)
+
+var errTruncated = errors.New("corrupt hnsw index: truncated")
+
+// Save writes the graph to w, in a form Load reads back.
+func (g *Graph) Save(w io.Writer) error {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	bw := bufio.NewWriter(w)
+	write := func(v any) error {
+		return binary.Write(bw, binary.LittleEndian, v)
+	}
+	if _, err := bw.WriteString(magic); err != nil {
+		return err
+	}
+	header := []uint32{formatVersion, uint32(g.dimension), uint32(g.M), uint32(g.EfConstruction),
+		uint32(g.maxLevel), g.entry, uint32(len(g.nodes))}
+	if err := write(header); err != nil {
+		return err
+	}
+	for _, n := range g.nodes {
+		var deleted uint8
+		if n.deleted {
+			deleted = 1
+		}
+		if err := errors.Join(write(n.id), write(deleted), write(n.vec), write(uint32(len(n.neighbors)))); err != nil {
+			return err
+		}
+		for _, links := range n.neighbors {
+			if err := errors.Join(write(uint32(len(links))), write(links)); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// Load reads a graph of the given dimension written by Save from r, which holds size bytes.
+// Counts in a truncated or corrupt file are checked against size before anything is allocated for them.
+func Load(r io.Reader, size int64, dimension int) (*Graph, error) {
+	br := bufio.NewReader(r)
+	read := func(v any) error {
+		return binary.Read(br, binary.LittleEndian, v)
+	}
+	// the bytes not yet accounted for, to check counts against
+	remaining := size - int64(len(magic)) - 7*4
+	take := func(count, bytesEach uint32) error {
+		n := int64(count) * int64(bytesEach)
+		if n > remaining {
+			return errTruncated
+		}
+		remaining -= n
+		return nil
+	}
+	gotMagic := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, gotMagic); err != nil {
+		return nil, err
+	}
+	if string(gotMagic) != magic {
+		return nil, errors.New("not an hnsw index")
+	}
+	header := make([]uint32, 7)
+	if err := read(header); err != nil {
+		return nil, err
+	}
+	if header[0] != formatVersion {
+		return nil, fmt.Errorf("unsupported hnsw index version %d", header[0])
+	}
+	if int(header[1]) != dimension {
+		return nil, fmt.Errorf("hnsw index has dimension %d, expected %d", header[1], dimension)
+	}
+	// id, deleted, vector and level count
+	if err := take(header[6], 8+1+4*header[1]+4); err != nil {
+		return nil, err
+	}
+	g := &Graph{
+		dimension:      int(header[1]),
+		M:              int(header[2]),
+		EfConstruction: int(header[3]),
+		maxLevel:       int(header[4]),
+		entry:          header[5],
+		nodes:          make([]node, header[6]),
+		ids:            make(map[int64]uint32, header[6]),
+		rng:            rand.New(rand.NewSource(int64(header[6]))),
+	}
+	for i := range g.nodes {
+		n := &g.nodes[i]
+		var deleted uint8
+		var levels uint32
+		n.vec = make([]float32, g.dimension)
+		if err := errors.Join(read(&n.id), read(&deleted), read(n.vec), read(&levels)); err != nil {
+			return nil, err
+		}
+		if levels == 0 || int(levels) > g.maxLevel+1 {
+			return nil, fmt.Errorf("corrupt hnsw index: node %d has %d levels of %d", i, levels, g.maxLevel+1)
+		}
+		if err := take(levels, 4); err != nil {
+			return nil, err
+		}
+		n.neighbors = make([][]uint32, levels)
+		for l := range n.neighbors {
+			var count uint32
+			if err := read(&count); err != nil {
+				return nil, err
+			}
+			if err := take(count, 4); err != nil {
+				return nil, err
+			}
+			n.neighbors[l] = make([]uint32, count)
+			if err := read(n.neighbors[l]); err != nil {
+				return nil, err
+			}
+		}
+		if deleted == 1 {
+			n.deleted = true
+			g.deleted++
+		} else {
+			g.ids[n.id] = uint32(i)
+		}
+	}
+	// searches follow the links without checking them, so they must lead to nodes on the same level
+	if len(g.nodes) > 0 && (int(g.entry) >= len(g.nodes) || len(g.nodes[g.entry].neighbors) != g.maxLevel+1) {
+		return nil, errors.New("corrupt hnsw index: bad entry point")
+	}
+	for i, n := range g.nodes {
+		for l, links := range n.neighbors {
+			for _, link := range links {
+				if int(link) >= len(g.nodes) || len(g.nodes[link].neighbors) <= l {
+					return nil, fmt.Errorf("corrupt hnsw index: node %d's level %d links to node %d, which isn't on it", i, l, link)
+				}
+			}
+		}
+	}
+	return g, nil
+}
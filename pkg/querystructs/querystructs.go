@@ -2,6 +2,7 @@
 package querystructs
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"reflect"
@@ -67,80 +68,123 @@ Your struct needs to use three annotation tags on relevant fields:
 	"db" - a placeholder name for this condition's value itself, later used by sqlx
 	"clause" - there where condition clause, eg >=, =, IN, ...
 
+and may use a fourth:
+
+	"group" - conditions of fields in the same group are ORed together, eg `group:"size"`
+
 	if a type is a sql.nullable, we only add it to the query string when not null
+
+Besides sql's binary operators, clause may be:
+
+	IN, NOT IN - for slices. nb: an empty NOT IN slice is left out, as it excludes nothing
+	PREFIX, CONTAINS - a LIKE match of strings starting with / containing the value,
+		which is escaped so % and _ in it are matched literally. nb: LIKE ignores ASCII case
+	NOT PREFIX, NOT CONTAINS - the opposite
+
+Conditions are in the order of the struct's fields, so the same struct always gives the same query.
 */
 func BuildWhereClauseGenerator[T any](queryStructExample T) (func(T) (string, error), error) {
-	names, err := BuildAnnotationMap(queryStructExample, "db")
-	if err != nil {
-		return nil, err
-	}
-	references, err := BuildAnnotationMap(queryStructExample, "ref")
-	if err != nil {
-		return nil, err
-	}
-	if len(references) == 0 {
-		return nil, errors.New("no references in provided query")
+	val := reflect.ValueOf(queryStructExample)
+	if val.Kind() == reflect.Ptr {
+		val = val.Elem()
 	}
-	clauses, err := BuildAnnotationMap(queryStructExample, "clause")
-	if err != nil {
-		return nil, err
+	if val.Kind() != reflect.Struct {
+		return nil, errors.New("the input needs to be struct")
 	}
 	nullables, err := BuildNullableMap(queryStructExample)
 	if err != nil {
 		return nil, err
 	}
-	// non-nullable parameters are appended to prefix query
-	prefixQuery := ""
-	// nullable parameters are prepared for the curried function to select from
-	prepared := make(map[string]string)
-	for fieldName, refString := range references {
-		// the db tag is used to refer to the value in this struct
-		dbtag, ok := names[fieldName]
-		_, isnullable := nullables[fieldName]
+	conditions := make([]condition, 0)
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Type().Field(i)
+		refString, ok := field.Tag.Lookup("ref")
 		if !ok {
-			return nil, fmt.Errorf("missing db tag in %s", fieldName)
+			continue
 		}
-		clause, ok := clauses[fieldName]
+		// the db tag is used to refer to the value in this struct
+		dbtag, ok := field.Tag.Lookup("db")
 		if !ok {
-			return nil, fmt.Errorf("missing clause tag in %s", fieldName)
+			return nil, fmt.Errorf("missing db tag in %s", field.Name)
 		}
-		switch strings.ToLower(clause) {
-		case "in":
-			prepared[fieldName] = fmt.Sprintf("%s IN (:%s)", refString, dbtag)
-		default:
-			prepared[fieldName] = fmt.Sprintf("%s %s :%s", refString, clause, dbtag)
+		clause, ok := field.Tag.Lookup("clause")
+		if !ok {
+			return nil, fmt.Errorf("missing clause tag in %s", field.Name)
 		}
-		//since the field is mandatory, we can add it to the prefix instead
-		if !isnullable {
-			if len(prefixQuery) > 0 {
-				prefixQuery += " AND "
+		_, isnullable := nullables[field.Name]
+		c := condition{field: i, nullable: isnullable, group: field.Tag.Get("group")}
+		isSlice := field.Type.Kind() == reflect.Slice || field.Type.Kind() == reflect.Array
+		isString := field.Type.Kind() == reflect.String || field.Type == reflect.TypeOf(sql.NullString{})
+		switch clause := strings.ToUpper(strings.Join(strings.Fields(clause), " ")); clause {
+		case "IN", "NOT IN":
+			if !isSlice {
+				return nil, fmt.Errorf("%s clause in %s needs a slice", clause, field.Name)
 			}
-			prefixQuery += prepared[fieldName]
-			delete(prepared, fieldName)
+			c.sql = fmt.Sprintf("%s %s (:%s)", refString, clause, dbtag)
+			c.optional = clause == "NOT IN"
+		case "PREFIX", "CONTAINS", "NOT PREFIX", "NOT CONTAINS":
+			if !isString {
+				return nil, fmt.Errorf("%s clause in %s needs a string", clause, field.Name)
+			}
+			pattern := likeEscaped(dbtag) + ` || '%'`
+			if strings.HasSuffix(clause, "CONTAINS") {
+				pattern = `'%' || ` + pattern
+			}
+			not := strings.TrimSuffix(strings.TrimSuffix(clause, "PREFIX"), "CONTAINS")
+			c.sql = fmt.Sprintf(`%s %sLIKE (%s) ESCAPE '\'`, refString, not, pattern)
+		default:
+			c.sql = fmt.Sprintf("%s %s :%s", refString, clause, dbtag)
 		}
+		conditions = append(conditions, c)
+	}
+	if len(conditions) == 0 {
+		return nil, errors.New("no references in provided query")
 	}
+
 	return func(queryStruct T) (string, error) {
-		// local version of nullables
-		nullables2, err := BuildNullableMap(queryStruct)
-		suffixQuery := ""
-		if err != nil {
-			return "", err
+		val := reflect.ValueOf(queryStruct)
+		if val.Kind() == reflect.Ptr {
+			val = val.Elem()
 		}
-		for k, v := range nullables2 {
-			if v {
-				// this value is confirmed valid, so add it to query
-				if len(suffixQuery) > 0 {
-					suffixQuery += " AND "
-				}
-				suffixQuery += prepared[k]
+		// the conditions that apply, grouped, with groups in order of their first field
+		groups := make([][]string, 0, len(conditions))
+		groupIndex := make(map[string]int)
+		for _, c := range conditions {
+			fieldVal := val.Field(c.field)
+			if c.nullable && !fieldVal.FieldByName("Valid").Bool() {
+				continue
+			}
+			if c.optional && fieldVal.Len() == 0 {
+				continue
+			}
+			if i, ok := groupIndex[c.group]; ok && len(c.group) > 0 {
+				groups[i] = append(groups[i], c.sql)
+				continue
 			}
+			groupIndex[c.group] = len(groups)
+			groups = append(groups, []string{c.sql})
 		}
-		// unify prefix and suffix
-		if len(prefixQuery) > 0 && len(suffixQuery) > 0 {
-			//we need an and
-			prefixQuery += " AND "
+		clauses := make([]string, len(groups))
+		for i, group := range groups {
+			clauses[i] = group[0]
+			if len(group) > 1 {
+				clauses[i] = "(" + strings.Join(group, " OR ") + ")"
+			}
 		}
-		return prefixQuery + suffixQuery, nil
-
+		return strings.Join(clauses, " AND "), nil
 	}, nil
 }
+
+// a field's part of the where clause
+type condition struct {
+	field    int    // index in the struct
+	sql      string // the condition
+	nullable bool   // left out when null
+	optional bool   // left out when empty
+	group    string
+}
+
+// sql giving the named parameter with LIKE's wildcards escaped by \
+func likeEscaped(dbtag string) string {
+	return `replace(replace(replace(:` + dbtag + `, '\', '\\'), '%', '\%'), '_', '\_')`
+}
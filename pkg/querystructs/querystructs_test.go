@@ -171,3 +171,57 @@ func TestBuildWhereClauseGenerator(t *testing.T) {
 	}
 	fmt.Println(str2)
 }
+
+func TestWhereClauseGeneratorClauses(t *testing.T) {
+	type query struct {
+		IDs       []int64        `ref:"id" db:"ids" clause:"IN"`
+		NotIDs    []int64        `ref:"id" db:"not_ids" clause:"not  in"`
+		Prefix    sql.NullString `ref:"path" db:"prefix" clause:"PREFIX"`
+		NotSub    sql.NullString `ref:"path" db:"not_sub" clause:"NOT CONTAINS"`
+		WidthMin  sql.NullInt64  `ref:"width" db:"width_min" clause:">=" group:"big"`
+		Unrelated string
+		HeightMin sql.NullInt64 `ref:"height" db:"height_min" clause:">=" group:"big"`
+		Ignored   sql.NullString
+	}
+	fn, err := BuildWhereClauseGenerator(query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := func(n int64) sql.NullInt64 { return sql.NullInt64{Int64: n, Valid: true} }
+	likeEscaped := `replace(replace(replace(:%s, '\', '\\'), '%%', '\%%'), '_', '\_')`
+	for _, c := range []struct {
+		q    query
+		want string
+	}{
+		{query{}, "id IN (:ids)"},
+		{query{Ignored: sql.NullString{Valid: true}, NotIDs: []int64{}}, "id IN (:ids)"},
+		{query{NotIDs: []int64{1}, WidthMin: valid(1)}, "id IN (:ids) AND id NOT IN (:not_ids) AND width >= :width_min"},
+		{query{HeightMin: valid(1), WidthMin: valid(1)}, "id IN (:ids) AND (width >= :width_min OR height >= :height_min)"},
+		{query{HeightMin: valid(1)}, "id IN (:ids) AND height >= :height_min"},
+		{query{Prefix: sql.NullString{Valid: true}, NotSub: sql.NullString{Valid: true}},
+			"id IN (:ids) AND path LIKE (" + fmt.Sprintf(likeEscaped, "prefix") + " || '%') ESCAPE '\\' AND " +
+				"path NOT LIKE ('%' || " + fmt.Sprintf(likeEscaped, "not_sub") + " || '%') ESCAPE '\\'"},
+	} {
+		// repeated, as the generator mustn't keep state between calls
+		for range 2 {
+			got, err := fn(c.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("%+v:\nexpected %s\n     got %s", c.q, c.want, got)
+			}
+		}
+	}
+
+	if _, err := BuildWhereClauseGenerator(struct {
+		ID int64 `ref:"id" db:"id" clause:"NOT IN"`
+	}{}); err == nil {
+		t.Error("expected an error for NOT IN on a number")
+	}
+	if _, err := BuildWhereClauseGenerator(struct {
+		ID int64 `ref:"id" db:"id" clause:"PREFIX"`
+	}{}); err == nil {
+		t.Error("expected an error for PREFIX on a number")
+	}
+}
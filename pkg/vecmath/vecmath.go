@@ -0,0 +1,100 @@
+// vecmath holds the small vector routines shared by search and quantization:
+// distances, normalisation and int8/binary quantization of unit vectors.
+package vecmath
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// L2Squared is the squared euclidean distance between a and b, which must be the same length.
+// It's the hot loop of searches, so is unrolled to give the CPU independent sums to work on.
+func L2Squared(a, b []float32) float32 {
+	b = b[:len(a)]
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		d0, d1, d2, d3 := a[i]-b[i], a[i+1]-b[i+1], a[i+2]-b[i+2], a[i+3]-b[i+3]
+		s0 += d0 * d0
+		s1 += d1 * d1
+		s2 += d2 * d2
+		s3 += d3 * d3
+	}
+	for ; i < len(a); i++ {
+		d := a[i] - b[i]
+		s0 += d * d
+	}
+	return s0 + s1 + s2 + s3
+}
+
+func Dot(a, b []float32) float32 {
+	b = b[:len(a)]
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		s0 += a[i] * b[i]
+		s1 += a[i+1] * b[i+1]
+		s2 += a[i+2] * b[i+2]
+		s3 += a[i+3] * b[i+3]
+	}
+	for ; i < len(a); i++ {
+		s0 += a[i] * b[i]
+	}
+	return s0 + s1 + s2 + s3
+}
+
+// Normalize scales vec to unit length in place.
+func Normalize(vec []float32) []float32 {
+	norm := math.Sqrt(float64(Dot(vec, vec)))
+	if norm == 0 {
+		return vec
+	}
+	inv := float32(1 / norm)
+	for i := range vec {
+		vec[i] *= inv
+	}
+	return vec
+}
+
+// QuantizeInt8 maps each component of a unit vector from [-1, 1] to [-127, 127].
+// The result is the layout sqlite-vec's vec_int8() expects.
+func QuantizeInt8(vec []float32) []byte {
+	out := make([]byte, len(vec))
+	for i, v := range vec {
+		q := math.Round(float64(v) * 127)
+		q = max(min(q, 127), -127)
+		out[i] = byte(int8(q))
+	}
+	return out
+}
+
+// QuantizeBinary keeps only the sign of each component, one bit each (set when positive),
+// least significant bit first. The result is the layout sqlite-vec's vec_bit() expects.
+func QuantizeBinary(vec []float32) []byte {
+	out := make([]byte, (len(vec)+7)/8)
+	for i, v := range vec {
+		if v > 0 {
+			out[i/8] |= 1 << (i % 8)
+		}
+	}
+	return out
+}
+
+// Hamming counts the bits differing between two binary quantized vectors of the same length.
+func Hamming(a, b []byte) int {
+	n := 0
+	for i := range a {
+		n += bits.OnesCount8(a[i] ^ b[i])
+	}
+	return n
+}
+
+// DecodeFloat32 reads a vector of little endian float32s, as sqlite-vec stores them.
+func DecodeFloat32(b []byte) []float32 {
+	vec := make([]float32, len(b)/4)
+	for i := range vec {
+		vec[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[i*4:]))
+	}
+	return vec
+}
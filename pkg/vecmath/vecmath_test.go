@@ -0,0 +1,44 @@
+package vecmath
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistances(t *testing.T) {
+	a := []float32{1, 0, 0}
+	b := []float32{0, 1, 0}
+	if L2Squared(a, b) != 2 || Dot(a, b) != 0 || Dot(a, a) != 1 {
+		t.Errorf("unexpected distances %v %v", L2Squared(a, b), Dot(a, b))
+	}
+	n := Normalize([]float32{3, 4})
+	if math.Abs(float64(n[0])-0.6) > 1e-6 || math.Abs(float64(n[1])-0.8) > 1e-6 {
+		t.Errorf("unexpected normalised vector %v", n)
+	}
+	if z := Normalize([]float32{0, 0}); z[0] != 0 || z[1] != 0 {
+		t.Errorf("zero vector should be left alone, got %v", z)
+	}
+}
+
+func TestQuantizeInt8(t *testing.T) {
+	q := QuantizeInt8([]float32{1, -1, 0.5, -2, 0})
+	want := []int8{127, -127, 64, -127, 0}
+	for i := range want {
+		if int8(q[i]) != want[i] {
+			t.Errorf("component %d: expected %d, got %d", i, want[i], int8(q[i]))
+		}
+	}
+}
+
+func TestQuantizeBinary(t *testing.T) {
+	vec := make([]float32, 10)
+	vec[0], vec[3], vec[9] = 1, 0.1, 2
+	vec[1] = -1
+	q := QuantizeBinary(vec)
+	if len(q) != 2 || q[0] != 0b00001001 || q[1] != 0b00000010 {
+		t.Errorf("unexpected bits %08b", q)
+	}
+	if Hamming(q, QuantizeBinary(make([]float32, 10))) != 3 {
+		t.Errorf("unexpected hamming distance")
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"image"
 	"image/jpeg"
@@ -9,11 +11,12 @@ import (
 	"io/fs"
 	"path/filepath"
 	"strings"
+	"sync"
 
-	"github.com/crimro-se/imagedb/embeddingserver"
+	"github.com/crimro-se/imagedb/embedder"
 	"github.com/crimro-se/imagedb/internal/imagedbutil"
+	"github.com/crimro-se/imagedb/pkg/archivewalk"
 	"github.com/crimro-se/imagedb/pkg/imageutil"
-	"github.com/crimro-se/imagedb/pkg/threadboundresourcepool"
 	"golang.org/x/image/webp"
 )
 
@@ -21,32 +24,107 @@ const MAXIMAGESIZE = 512
 
 // handles digesting images into the database &  embedding server
 type ImageProcessor struct {
-	dbConnections *threadboundresourcepool.ThreadResource[*Database] // per-thread db connection pool
-	basedir       Basedir                                            // foreign key to use for all images we add to the db
-	apiServer     *embeddingserver.Client
+	ctx          context.Context
+	db           *Database         // shared by all threads
+	basedir      Basedir           // foreign key to use for all images we add to the db
+	embedder     embedder.Embedder // shared by all threads
+	quantization string            // for the model's vectors, see QuantizationInt8 etc
+	writer       *batchWriter      // all images are written via it
+
+	modelMutex sync.Mutex
+	model      *Model // the embedder's model in the database, once known
 }
 
-func NewImageProcessor(dbfile string, basedir Basedir, serverAddress string) (*ImageProcessor, error) {
+// ctx should be the same context that controls the archive walk, so that cancelling it
+// also releases workers waiting on the embedding server.
+// serverStatus is optional, and is told when the embedding server goes down (indexing pauses) and comes back.
+// writeFailed is optional, and told of images that couldn't be written to the database,
+// which happens in the background after Handler has returned for them.
+// Call Close once finished with the processor.
+func NewImageProcessor(ctx context.Context, dbfile string, basedir Basedir, conf *Config, serverStatus func(available bool), writeFailed func(error)) (*ImageProcessor, error) {
 	if len(dbfile) < 1 {
 		return nil, fmt.Errorf("database filename can't be empty")
 	}
+	opts := conf.EmbedderOptions()
+	opts.WaitForServer = true
+	opts.ServerStatus = serverStatus
+	emb, err := embedder.New(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	db, err := NewDatabase(dbfile, false)
+	if err != nil {
+		emb.Close()
+		return nil, err
+	}
+
 	processor := ImageProcessor{
-		basedir: basedir,
-		dbConnections: threadboundresourcepool.New(
-			// a function that can create new db connections
-			func() *Database {
-				db, err := NewDatabase(dbfile, false)
-				// TODO: send a CRITICAL err to GUI
-				if err != nil {
-					panic(err)
-				}
-				return db
-			}),
-		apiServer: embeddingserver.NewClient(serverAddress),
+		ctx:          ctx,
+		basedir:      basedir,
+		db:           db,
+		embedder:     emb,
+		quantization: conf.EMBEDDING_QUANTIZATION,
+		writer:       newBatchWriter(db, writeFailed),
 	}
 	return &processor, nil
 }
 
+// commits any images still queued for writing, then releases the embedder and database
+func (p *ImageProcessor) Close() error {
+	p.embedder.Close()
+	p.writer.Close()
+	return p.db.Close()
+}
+
+// the database's entry for the embedder's model.
+// if dimension is 0 (not yet known) the model is only looked up, and ok is false if it's not registered;
+// otherwise it's registered if needed.
+// the model's vectors are (re-)quantized first if the configured quantization has changed.
+func (p *ImageProcessor) getModel(db *Database, dimension int) (model Model, ok bool, err error) {
+	p.modelMutex.Lock()
+	defer p.modelMutex.Unlock()
+	if p.model != nil {
+		return *p.model, true, nil
+	}
+	if dimension == 0 {
+		model, ok, err = db.GetModel(p.embedder.ModelID())
+	} else {
+		model, err = db.EnsureModel(p.embedder.ModelID(), dimension)
+		ok = err == nil
+	}
+	if ok {
+		model, err = db.SetModelQuantization(model, p.quantization)
+		if err != nil {
+			return model, false, err
+		}
+		p.model = &model
+	}
+	return model, ok, err
+}
+
+// once indexing has finished, switches searching to the embedder's model
+// if that means the collection has been completely re-embedded with it,
+// and saves the search indexes the new images were added to.
+// returns the model searches now use.
+func (p *ImageProcessor) PromoteModel() (string, error) {
+	p.writer.Flush()
+	db := p.db
+	model, ok, err := p.getModel(db, p.embedder.Dimension())
+	if err != nil || !ok {
+		return "", err
+	}
+	_, err = db.PromoteModelIfComplete(model)
+	if err != nil {
+		return "", err
+	}
+	err = db.SaveANNIndexes()
+	if err != nil {
+		return "", err
+	}
+	active, err := db.ActiveModel()
+	return active.ModelID, err
+}
+
 // Translate archive walker path division into one compatible with the database.
 // The archive walker form is a path to a file, and a virtual path for files within compressed archives.
 // The database form is parent directory OR archive, and a filename/path.
@@ -75,7 +153,8 @@ func (p *ImageProcessor) archiveWalkerPathToDatabasePath(path, vpath string) (st
 }
 
 // This is a callback function for archivewalk,
-// loads and resizes images, then waits for
+// loads and resizes images, then waits for their embeddings and queues them to be written.
+// files that aren't images, or are already indexed, are skipped with archivewalk.ErrSkipped.
 func (p *ImageProcessor) Handler(path, vpath string, file io.Reader, d fs.DirEntry, threadID int) error {
 	var ext string
 	vpath_exists := (len(vpath) > 0)
@@ -85,9 +164,14 @@ func (p *ImageProcessor) Handler(path, vpath string, file io.Reader, d fs.DirEnt
 		ext = imagedbutil.GetExt(path)
 	}
 
-	db := p.dbConnections.GetResource(threadID)
+	db := p.db
 
 	parentDir, fileName := p.archiveWalkerPathToDatabasePath(path, vpath)
+	// nb: for images in archives, d is the archive
+	var mtime sql.NullInt64
+	if info, err := d.Info(); err == nil {
+		mtime = sql.NullInt64{Int64: info.ModTime().Unix(), Valid: true}
+	}
 
 	// skip if already in DB
 	// todo: skip existing as a configuration option rather than presumption
@@ -97,8 +181,24 @@ func (p *ImageProcessor) Handler(path, vpath string, file io.Reader, d fs.DirEnt
 		return err
 	}
 	if len(matchedImage) > 0 {
-		if matchedImage[0].Aesthetic.Valid && (matchedImage[0].Aesthetic.Float64 > 0) {
-			return nil
+		model, ok, err := p.getModel(db, p.embedder.Dimension())
+		if err != nil {
+			return err
+		}
+		if ok {
+			embedded, err := db.HasEmbedding(model, matchedImage[0].ID)
+			if err != nil {
+				return err
+			}
+			if embedded {
+				// images indexed before modification times were recorded get them now
+				if !matchedImage[0].ModTime.Valid && mtime.Valid {
+					if err := db.UpdateModTime(matchedImage[0].ID, mtime.Int64); err != nil {
+						return err
+					}
+				}
+				return archivewalk.ErrSkipped
+			}
 		}
 	}
 
@@ -112,7 +212,7 @@ func (p *ImageProcessor) Handler(path, vpath string, file io.Reader, d fs.DirEnt
 	case "webp":
 		img, err = webp.Decode(file)
 	default:
-		return nil
+		return archivewalk.ErrSkipped
 	}
 	if err != nil {
 		return fmt.Errorf("error while loading image file: %s:%s: %w", path, vpath, err)
@@ -122,36 +222,43 @@ func (p *ImageProcessor) Handler(path, vpath string, file io.Reader, d fs.DirEnt
 		Width:     int64(img.Bounds().Dx()),
 		Height:    int64(img.Bounds().Dy()),
 		BasedirID: int64(p.basedir.ID),
+		ModTime:   mtime,
 	}
 	dbImg.Path = parentDir
 	dbImg.SubPath = fileName
 	// if it's already in the database then this is an update
 	if len(matchedImage) == 1 {
 		dbImg.ID = matchedImage[0].ID
+		// keep the existing score if this embedder can't provide one
+		dbImg.Aesthetic = matchedImage[0].Aesthetic
 	}
 
 	// get embeddings
-	if max(dbImg.Width, dbImg.Height) > MAXIMAGESIZE {
-		img = imageutil.ScaleImageRGBA(img, MAXIMAGESIZE)
-	}
-	imgBytes, err := imageutil.ImageToPNG(img)
+	imgBytes, err := encodeForEmbedding(img)
 	if err != nil {
 		return fmt.Errorf("error converting image to png: %s:%s: %w", path, vpath, err)
 	}
 
-	emb, err := p.apiServer.GetImageEmbedding(imgBytes)
+	emb, err := p.embedder.EmbedImage(p.ctx, imgBytes)
 	if err != nil {
 		return err
 	}
-	dbImg.Aesthetic.Float64 = float64(emb.Aesthetic)
-	dbImg.Aesthetic.Valid = true
-	id, err := db.CreateUpdateImage(&dbImg)
-	if err != nil {
-		return fmt.Errorf("error adding image to database: %s:%s: %w", path, vpath, err)
+	if emb.HasAesthetic {
+		dbImg.Aesthetic.Float64 = float64(emb.Aesthetic)
+		dbImg.Aesthetic.Valid = true
 	}
-	err = db.CreateUpdateEmbedding(id, emb.Embedding)
+	model, _, err := p.getModel(db, len(emb.Vector))
 	if err != nil {
-		return fmt.Errorf("error adding image's embedding to database: %s:%s: %w", path, vpath, err)
+		return fmt.Errorf("error registering embedding model: %w", err)
 	}
+	p.writer.Write(IndexedImage{Image: dbImg, Model: model, Embedding: emb.Vector})
 	return nil
 }
+
+// the image as sent to the embedder: a png, scaled down to MAXIMAGESIZE if larger
+func encodeForEmbedding(img image.Image) ([]byte, error) {
+	if max(img.Bounds().Dx(), img.Bounds().Dy()) > MAXIMAGESIZE {
+		img = imageutil.ScaleImageRGBA(img, MAXIMAGESIZE)
+	}
+	return imageutil.ImageToPNG(img)
+}
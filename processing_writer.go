@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// images written per transaction, and the longest an image waits to be written
+const (
+	WRITEBATCHSIZE     = 64
+	WRITEBATCHINTERVAL = 2 * time.Second
+)
+
+// a single goroutine that commits indexed images in batched transactions,
+// so workers don't contend for SQLite's write lock and an image is never half written.
+// nb: the database isn't closed with the writer.
+type batchWriter struct {
+	db       *Database
+	failed   func(error)
+	requests chan writeRequest
+	done     chan struct{}
+}
+
+// an image to write, or if flushed is set, a request to commit what's queued and report back
+type writeRequest struct {
+	image   IndexedImage
+	flushed chan struct{}
+}
+
+// failed is optional, and told of each image that couldn't be written, from the writer's goroutine
+func newBatchWriter(db *Database, failed func(error)) *batchWriter {
+	w := &batchWriter{
+		db:       db,
+		failed:   failed,
+		requests: make(chan writeRequest, WRITEBATCHSIZE),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *batchWriter) run() {
+	defer close(w.done)
+	batch := make([]IndexedImage, 0, WRITEBATCHSIZE)
+	ticker := time.NewTicker(WRITEBATCHINTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case req, ok := <-w.requests:
+			if !ok {
+				w.write(batch)
+				return
+			}
+			if req.flushed != nil {
+				w.write(batch)
+				batch = batch[:0]
+				close(req.flushed)
+				continue
+			}
+			batch = append(batch, req.image)
+			if len(batch) >= WRITEBATCHSIZE {
+				w.write(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			w.write(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// if the batch fails, each image is retried in its own transaction so one bad image doesn't lose the others.
+func (w *batchWriter) write(batch []IndexedImage) {
+	if len(batch) == 0 {
+		return
+	}
+	if w.db.WriteIndexedImages(batch) == nil {
+		return
+	}
+	for i := range batch {
+		err := w.db.WriteIndexedImages(batch[i : i+1])
+		if err != nil && w.failed != nil {
+			w.failed(fmt.Errorf("failed to write %s:%s: %w", batch[i].Image.Path, batch[i].Image.SubPath, err))
+		}
+	}
+}
+
+// queues the image to be written. if it can't be, that's reported to failed rather than here.
+func (w *batchWriter) Write(image IndexedImage) {
+	w.requests <- writeRequest{image: image}
+}
+
+// commits everything queued so far
+func (w *batchWriter) Flush() {
+	flushed := make(chan struct{})
+	w.requests <- writeRequest{flushed: flushed}
+	<-flushed
+}
+
+// commits everything queued and stops the writer. Write and Flush mustn't be called after.
+func (w *batchWriter) Close() {
+	close(w.requests)
+	<-w.done
+}
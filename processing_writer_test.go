@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBatchWriter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "writer.db")
+	db, err := NewDatabase(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CreateBasedir("/"); err != nil {
+		t.Fatal(err)
+	}
+	model, err := db.EnsureModel("tiny", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := func() (images, embeddings int) {
+		t.Helper()
+		err := db.con.Get(&images, `SELECT count(*) FROM images`)
+		if err == nil {
+			err = db.con.Get(&embeddings, `SELECT count(*) FROM image_embeddings`)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return images, embeddings
+	}
+	indexed := func(i int, dimension int) IndexedImage {
+		return IndexedImage{
+			Image:     Image{BasedirID: 1, Path: "dir", SubPath: fmt.Sprint(i), Width: 1, Height: 1, FileSize: 1},
+			Model:     model,
+			Embedding: make([]float32, dimension),
+		}
+	}
+
+	// a bad image fails the batch's transaction, leaving nothing half written
+	err = db.WriteIndexedImages([]IndexedImage{indexed(0, 2), indexed(1, 3)})
+	if err == nil {
+		t.Error("expected an error writing an embedding of the wrong dimension")
+	}
+	if images, embeddings := count(); images != 0 || embeddings != 0 {
+		t.Errorf("failed batch left %d images and %d embeddings", images, embeddings)
+	}
+
+	var reported []error
+	w := newBatchWriter(db, func(err error) { reported = append(reported, err) })
+	for i := 0; i < WRITEBATCHSIZE+10; i++ {
+		dimension := 2
+		if i == 5 {
+			dimension = 3
+		}
+		w.Write(indexed(i, dimension))
+	}
+	w.Flush()
+	if len(reported) != 1 {
+		t.Fatalf("expected the bad image to be reported once, was %d times", len(reported))
+	}
+	if !strings.Contains(reported[0].Error(), "dir:5:") {
+		t.Errorf("expected the error to name the bad image, got %v", reported[0])
+	}
+	// the rest of the bad image's batch is still written
+	if images, embeddings := count(); images != WRITEBATCHSIZE+9 || embeddings != images {
+		t.Errorf("expected %d images with embeddings, have %d images and %d embeddings", WRITEBATCHSIZE+9, images, embeddings)
+	}
+	w.Write(indexed(100, 2))
+	w.Close()
+	if len(reported) != 1 {
+		t.Errorf("unexpected errors %v", reported[1:])
+	}
+	if images, _ := count(); images != WRITEBATCHSIZE+10 {
+		t.Errorf("closing didn't write the queued image, have %d images", images)
+	}
+}
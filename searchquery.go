@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	sqlite_vec "github.com/asg017/sqlite-vec-go-bindings/cgo"
+	"github.com/crimro-se/imagedb/embedder"
+	"github.com/crimro-se/imagedb/pkg/vecmath"
+)
+
+// the search box's query language. free text describes the images wanted and ranks them semantically,
+// while terms filter and sort them, eg:
+//
+//	sunset beach w>=1920 aesthetic>6 tag:favourite -path:thumbs similar:12345 sort:aesthetic
+//
+// values with spaces can be double quoted, eg tag:"black and white"
+//
+// similar: with a description ranks images by both, by adding the image's embedding to the description's
+//
+// prefer: and weight: terms adjust sort:hybrid, which they imply, see database_ranking.go
+//
+// distance<X returns every image closer than X to the description or similar: image, rather than a page of the nearest
+
+// a parsed search
+type SearchQuery struct {
+	Text      string      // the free text, to rank images by
+	SimilarTo int64       // if set, images are ranked by similarity to this image, and to Text too if there's both
+	Filter    QueryFilter // the filter given to ParseSearchQuery, narrowed by the query's terms
+	Order     SortOrder   // see Sorted. defaults to OrderByAestheticDesc
+	Sorted    bool        // whether the query has a sort: term. otherwise, images are ranked by similarity if they can be
+}
+
+// a mistake in a search, pointing at the token it's in
+type SearchQueryError struct {
+	Token  string
+	Column int // of the token's start, counting characters from 1
+	Msg    string
+}
+
+func (e *SearchQueryError) Error() string {
+	return fmt.Sprintf("%s: %s (column %d)", e.Token, e.Msg, e.Column)
+}
+
+// a term is key:value, or key followed by a comparison for numbers. a - in front negates it
+var searchTermPattern = regexp.MustCompile(`^(-?)([a-zA-Z]+)(:|>=|<=|>|<|=)(.*)$`)
+
+// sort: values
+var searchSortOrders = map[string]SortOrder{
+	"aesthetic":     OrderByAestheticDesc,
+	"aesthetic-asc": OrderByAestheticAsc,
+	"path":          OrderByPathAsc,
+	"path-desc":     OrderByPathDesc,
+	"hybrid":        OrderByHybrid,
+}
+
+type searchToken struct {
+	raw    string // as typed, for errors
+	value  string // without quotes
+	column int
+}
+
+// parses a search typed by the user, adding its filters to qf
+func ParseSearchQuery(text string, qf QueryFilter) (SearchQuery, error) {
+	return parseSearchQuery(text, qf, false)
+}
+
+// withTarget is set when the images are matched against an embedding given separately, eg an image file's,
+// so distance< needs neither a description nor similar:
+func parseSearchQuery(text string, qf QueryFilter, withTarget bool) (SearchQuery, error) {
+	q := SearchQuery{Filter: qf, Order: OrderByAestheticDesc}
+	tokens, err := tokenizeSearch(text)
+	if err != nil {
+		return q, err
+	}
+	words := make([]string, 0, len(tokens))
+	var distance searchToken
+	ranked := false // whether the query has terms only OrderByHybrid uses
+	for _, tok := range tokens {
+		m := searchTermPattern.FindStringSubmatch(tok.raw)
+		if m == nil {
+			words = append(words, tok.value)
+			continue
+		}
+		negated, key, op := m[1] == "-", strings.ToLower(m[2]), m[3]
+		value := unquoteSearchValue(m[4])
+		fail := func(format string, args ...any) error {
+			return &SearchQueryError{Token: tok.raw, Column: tok.column, Msg: fmt.Sprintf(format, args...)}
+		}
+		if len(value) == 0 {
+			return q, fail("missing a value")
+		}
+		if negated && key != "tag" && key != "path" {
+			return q, fail("only tag: and path: can be negated")
+		}
+
+		switch key {
+		case "tag", "path", "similar", "sort", "prefer", "weight":
+			if op != ":" {
+				return q, fail("expected %s:", key)
+			}
+		}
+		switch key {
+		case "tag":
+			if negated {
+				q.Filter.TagsNone = append(q.Filter.TagsNone, value)
+			} else {
+				q.Filter.TagsAll = append(q.Filter.TagsAll, value)
+			}
+		case "path":
+			if negated {
+				q.Filter.PathKeywordsNone = append(q.Filter.PathKeywordsNone, value)
+			} else {
+				q.Filter.PathKeywords = append(q.Filter.PathKeywords, value)
+			}
+		case "similar":
+			if q.SimilarTo != 0 {
+				return q, fail("only one image can be searched for")
+			}
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || id <= 0 {
+				return q, fail("expected an image id")
+			}
+			q.SimilarTo = id
+		case "sort":
+			order, ok := searchSortOrders[strings.ToLower(value)]
+			if !ok {
+				return q, fail("unknown order, expected aesthetic, aesthetic-asc, path, path-desc or hybrid")
+			}
+			q.Order, q.Sorted = order, true
+		case "prefer":
+			q.Filter.BoostTags = append(q.Filter.BoostTags, value)
+			ranked = true
+		case "weight":
+			name, number, ok := strings.Cut(value, "=")
+			weight, err := strconv.ParseFloat(number, 64)
+			if !ok || err != nil || weight < 0 || math.IsInf(weight, 0) {
+				return q, fail("expected a score and its weight, eg weight:recency=2")
+			}
+			weights := q.Filter.rankWeights()
+			switch strings.ToLower(name) {
+			case "similarity":
+				weights.Similarity = weight
+			case "aesthetic":
+				weights.Aesthetic = weight
+			case "recency":
+				weights.Recency = weight
+			case "tags":
+				weights.Tags = weight
+			default:
+				return q, fail("unknown score, expected similarity, aesthetic, recency or tags")
+			}
+			q.Filter.Weights = weights
+			ranked = true
+		case "w", "width":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return q, fail("expected a whole number of pixels")
+			}
+			intRange(&q.Filter.WidthMin, &q.Filter.WidthMax, op, n)
+		case "h", "height":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return q, fail("expected a whole number of pixels")
+			}
+			intRange(&q.Filter.HeightMin, &q.Filter.HeightMax, op, n)
+		case "size":
+			n, err := parseFileSize(value)
+			if err != nil {
+				return q, fail("expected a file size, eg 500kb or 2mb")
+			}
+			intRange(&q.Filter.FileSizeMin, &q.Filter.FileSizeMax, op, n)
+		case "aesthetic":
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil || math.IsNaN(f) {
+				return q, fail("expected a number")
+			}
+			floatRange(&q.Filter.AestheticMin, &q.Filter.AestheticMax, op, f)
+		case "distance":
+			if op != "<" && op != "<=" {
+				return q, fail("expected distance< or distance<=")
+			}
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil || f < 0 || math.IsNaN(f) {
+				return q, fail("expected a distance, eg 0.8")
+			}
+			if op == "<" {
+				f = math.Nextafter(f, math.Inf(-1))
+			}
+			q.Filter.MaxDistance = sql.NullFloat64{Float64: f, Valid: true}
+			distance = tok
+		default:
+			return q, fail("unknown term, expected one of tag, path, similar, sort, prefer, weight, w, h, size, aesthetic or distance")
+		}
+	}
+	q.Text = strings.Join(words, " ")
+	if ranked && !q.Sorted {
+		q.Order, q.Sorted = OrderByHybrid, true
+	}
+	if q.Filter.MaxDistance.Valid && !withTarget && q.SimilarTo == 0 && len(q.Text) == 0 {
+		return q, &SearchQueryError{Token: distance.raw, Column: distance.column,
+			Msg: "needs a description or similar: to measure distance from"}
+	}
+	return q, nil
+}
+
+// runs the search. embedText is only called if the query has a description, for its embedding.
+func (q SearchQuery) Run(db *Database, embedText func(text string) ([]byte, error)) ([]Image, error) {
+	if q.SimilarTo == 0 && len(q.Text) == 0 {
+		return db.ReadImages(q.Filter, q.Order)
+	}
+	var embedding []byte
+	var err error
+	if q.SimilarTo != 0 {
+		embedding, err = db.ReadEmbedding(q.SimilarTo)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(q.Text) > 0 {
+		text, err := embedText(q.Text)
+		if err != nil {
+			return nil, err
+		}
+		embedding, err = addEmbeddings(embedding, text)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return q.Match(db, embedding)
+}
+
+// the normalised sum of the embeddings, which is as near each as it is the other. a may be nil.
+func addEmbeddings(a, b []byte) ([]byte, error) {
+	if a == nil {
+		return b, nil
+	}
+	if len(a) != len(b) {
+		return nil, errors.New("the image's and the description's embeddings are from different models")
+	}
+	sum := vecmath.DecodeFloat32(a)
+	for i, v := range vecmath.DecodeFloat32(b) {
+		sum[i] += v
+	}
+	return sqlite_vec.SerializeFloat32(vecmath.Normalize(sum))
+}
+
+// the images nearest the embedding (rather than the query's description or similar: image), filtered and sorted as the query asks
+func (q SearchQuery) Match(db *Database, embedding []byte) ([]Image, error) {
+	// distance< asks for everything close enough, however many there are past the offset
+	if q.Filter.MaxDistance.Valid {
+		count, err := db.CountEmbeddingsWithin(embedding, q.Filter)
+		if err != nil {
+			return nil, err
+		}
+		if count <= q.Filter.Offset {
+			return make([]Image, 0), nil
+		}
+		q.Filter.Limit = count - q.Filter.Offset
+	}
+	if q.Order == OrderByHybrid {
+		return db.MatchEmbeddingsHybrid(embedding, q.Filter)
+	}
+	imgs, err := db.MatchEmbeddingsWithFilter(embedding, q.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if q.Sorted {
+		sortImages(imgs, q.Order)
+	}
+	return imgs, nil
+}
+
+// embeds the text for searching the database's active model's embeddings
+func embedSearchText(ctx context.Context, db *Database, emb embedder.Embedder, text string) ([]byte, error) {
+	if err := checkSearchModel(db, emb); err != nil {
+		return nil, err
+	}
+	embedding, err := emb.EmbedText(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+	return sqlite_vec.SerializeFloat32(embedding)
+}
+
+// likewise for an image, eg to find those like one that isn't in the database
+func embedSearchImage(ctx context.Context, db *Database, emb embedder.Embedder, img image.Image) ([]byte, error) {
+	if err := checkSearchModel(db, emb); err != nil {
+		return nil, err
+	}
+	data, err := encodeForEmbedding(img)
+	if err != nil {
+		return nil, err
+	}
+	embedding, err := emb.EmbedImage(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	return sqlite_vec.SerializeFloat32(embedding.Vector)
+}
+
+// vectors are only comparable when they come from the same model
+func checkSearchModel(db *Database, emb embedder.Embedder) error {
+	active, err := db.ActiveModel()
+	if err != nil {
+		return err
+	}
+	if active.ModelID != emb.ModelID() {
+		return fmt.Errorf("searches use model %s until every image has been re-indexed with %s; "+
+			"until then only similar image searches work", active.ModelID, emb.ModelID())
+	}
+	return nil
+}
+
+// splits text on spaces outside of double quotes
+func tokenizeSearch(text string) ([]searchToken, error) {
+	tokens := make([]searchToken, 0)
+	var tok strings.Builder
+	start, quoteColumn, inQuotes := 0, 0, false
+	end := func() {
+		if tok.Len() > 0 {
+			raw := tok.String()
+			tokens = append(tokens, searchToken{raw: raw, value: unquoteSearchValue(raw), column: start})
+			tok.Reset()
+		}
+	}
+	column := 0
+	for _, r := range text {
+		column++
+		if unicode.IsSpace(r) && !inQuotes {
+			end()
+			continue
+		}
+		if tok.Len() == 0 {
+			start = column
+		}
+		if r == '"' {
+			inQuotes = !inQuotes
+			quoteColumn = column
+		}
+		tok.WriteRune(r)
+	}
+	if inQuotes {
+		return nil, &SearchQueryError{Token: tok.String(), Column: quoteColumn, Msg: "unterminated quote"}
+	}
+	end()
+	return tokens, nil
+}
+
+func unquoteSearchValue(s string) string {
+	return strings.ReplaceAll(s, `"`, "")
+}
+
+// sets the bounds of a range filter from a comparison. : and = set both.
+func intRange(min, max *sql.NullInt64, op string, n int64) {
+	switch op {
+	case ">=":
+		*min = sql.NullInt64{Int64: n, Valid: true}
+	case ">":
+		*min = sql.NullInt64{Int64: n + 1, Valid: true}
+	case "<=":
+		*max = sql.NullInt64{Int64: n, Valid: true}
+	case "<":
+		*max = sql.NullInt64{Int64: n - 1, Valid: true}
+	default:
+		*min = sql.NullInt64{Int64: n, Valid: true}
+		*max = *min
+	}
+}
+
+func floatRange(min, max *sql.NullFloat64, op string, f float64) {
+	switch op {
+	case ">=":
+		*min = sql.NullFloat64{Float64: f, Valid: true}
+	case ">":
+		*min = sql.NullFloat64{Float64: math.Nextafter(f, math.Inf(1)), Valid: true}
+	case "<=":
+		*max = sql.NullFloat64{Float64: f, Valid: true}
+	case "<":
+		*max = sql.NullFloat64{Float64: math.Nextafter(f, math.Inf(-1)), Valid: true}
+	default:
+		*min = sql.NullFloat64{Float64: f, Valid: true}
+		*max = *min
+	}
+}
+
+// bytes, with an optional kb, mb or gb suffix (powers of 1024)
+func parseFileSize(s string) (int64, error) {
+	s = strings.ToLower(s)
+	multiplier := int64(1)
+	for i, suffix := range []string{"kb", "mb", "gb"} {
+		if number, ok := strings.CutSuffix(s, suffix); ok {
+			s, multiplier = number, 1<<(10*(i+1))
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid file size %q", s)
+	}
+	return int64(f * float64(multiplier)), nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	sqlite_vec "github.com/asg017/sqlite-vec-go-bindings/cgo"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	base := QueryFilter{BaseDirs: []int64{1}, Limit: 10}
+	q, err := ParseSearchQuery(`sunset  beach w>=1920 aesthetic>6 tag:favourite -path:thumbs similar:12345 sort:aesthetic`, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Text != "sunset beach" || q.SimilarTo != 12345 || !q.Sorted || q.Order != OrderByAestheticDesc {
+		t.Errorf("unexpected query %+v", q)
+	}
+	want := base
+	want.WidthMin = sql.NullInt64{Int64: 1920, Valid: true}
+	want.AestheticMin = sql.NullFloat64{Float64: q.Filter.AestheticMin.Float64, Valid: true}
+	want.TagsAll = []string{"favourite"}
+	want.PathKeywordsNone = []string{"thumbs"}
+	if !reflect.DeepEqual(q.Filter, want) {
+		t.Errorf("expected filter %+v, got %+v", want, q.Filter)
+	}
+	if f := q.Filter.AestheticMin.Float64; f <= 6 || f > 6.0001 {
+		t.Errorf("aesthetic>6 gave a minimum of %v", f)
+	}
+
+	q, err = ParseSearchQuery(`H<1000 h>100 size:2mb -tag:"black and white" path:2019 similar:42`, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Text != "" || q.SimilarTo != 42 || q.Sorted || q.Order != OrderByAestheticDesc {
+		t.Errorf("unexpected query %+v", q)
+	}
+	f := q.Filter
+	if f.HeightMin.Int64 != 101 || f.HeightMax.Int64 != 999 || f.FileSizeMin.Int64 != 2<<20 || f.FileSizeMax != f.FileSizeMin ||
+		!reflect.DeepEqual(f.TagsNone, []string{"black and white"}) || !reflect.DeepEqual(f.PathKeywords, []string{"2019"}) {
+		t.Errorf("unexpected filter %+v", f)
+	}
+
+	// prefer: and weight: imply hybrid ranking, adjusting the filter's weights
+	q, err = ParseSearchQuery(`beach prefer:favourite weight:recency=2`, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weights := DefaultRankWeights
+	weights.Recency = 2
+	if q.Order != OrderByHybrid || !q.Sorted || q.Filter.Weights != weights || !reflect.DeepEqual(q.Filter.BoostTags, []string{"favourite"}) {
+		t.Errorf("unexpected hybrid query %+v", q)
+	}
+	if q, _ = ParseSearchQuery(`sort:aesthetic-asc`, base); q.Order != OrderByAestheticAsc {
+		t.Errorf("unexpected order %v", q.Order)
+	}
+	if q, _ = ParseSearchQuery(`prefer:favourite sort:path`, base); q.Order != OrderByPathAsc {
+		t.Errorf("sort: should override the implied order, got %v", q.Order)
+	}
+
+	q, err = ParseSearchQuery(`beach distance<=0.8`, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !q.Filter.MaxDistance.Valid || q.Filter.MaxDistance.Float64 != 0.8 {
+		t.Errorf("unexpected distance filter %+v", q.Filter)
+	}
+
+	// quoted text and words that merely look like terms stay part of the description
+	q, err = ParseSearchQuery(`"a dog: running" well-known 3:2`, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Text != "a dog: running well-known 3:2" {
+		t.Errorf("unexpected text %q", q.Text)
+	}
+
+	for _, c := range []struct {
+		query  string
+		token  string
+		column int
+	}{
+		{`cat w>=wide`, "w>=wide", 5},
+		{`cat sort:colour`, "sort:colour", 5},
+		{`cät colour:red`, "colour:red", 5},
+		{`-w>5`, "-w>5", 1},
+		{`tag>5`, "tag>5", 1},
+		{`tag: cat`, "tag:", 1},
+		{`similar:1 similar:2`, "similar:2", 11},
+		{`tag:"black and white`, `tag:"black and white`, 5},
+		{`cat weight:colour=1`, "weight:colour=1", 5},
+		{`cat weight:recency`, "weight:recency", 5},
+		{`cat distance>0.5`, "distance>0.5", 5},
+		{`w>10 distance<0.5`, "distance<0.5", 6},
+	} {
+		_, err := ParseSearchQuery(c.query, base)
+		var qe *SearchQueryError
+		if !errors.As(err, &qe) {
+			t.Errorf("%s: expected a SearchQueryError, got %v", c.query, err)
+			continue
+		}
+		if qe.Token != c.token || qe.Column != c.column {
+			t.Errorf("%s: error at %q column %d, expected %q column %d (%v)", c.query, qe.Token, qe.Column, c.token, c.column, err)
+		}
+	}
+}
+
+func TestSortImages(t *testing.T) {
+	imgs := []Image{
+		{Path: "b", SubPath: "1", Aesthetic: sql.NullFloat64{Float64: 5, Valid: true}},
+		{Path: "a", SubPath: "2"},
+		{Path: "a", SubPath: "1", Aesthetic: sql.NullFloat64{Float64: 7, Valid: true}},
+	}
+	order := func() string {
+		s := ""
+		for _, img := range imgs {
+			s += img.Path + img.SubPath + " "
+		}
+		return s
+	}
+	for so, want := range map[SortOrder]string{
+		OrderByAestheticDesc: "a1 b1 a2 ",
+		OrderByAestheticAsc:  "a2 b1 a1 ",
+		OrderByPathAsc:       "a1 a2 b1 ",
+		OrderByPathDesc:      "b1 a2 a1 ",
+	} {
+		sortImages(imgs, so)
+		if got := order(); got != want {
+			t.Errorf("order %d: expected %s, got %s", so, want, got)
+		}
+	}
+}
+
+// a description and similar: together rank images by their combined embedding
+func TestSearchQueryRun(t *testing.T) {
+	db, err := NewDatabase(":memory:", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CreateBasedir("/"); err != nil {
+		t.Fatal(err)
+	}
+	model, err := db.EnsureModel("tiny", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetActiveModel("tiny"); err != nil {
+		t.Fatal(err)
+	}
+	for i, vec := range [][]float32{{1, 0}, {0, 1}, {0.7071, 0.7071}} {
+		id, err := db.CreateUpdateImage(&Image{BasedirID: 1, Path: "dir", SubPath: fmt.Sprint(i), Width: 1, Height: 1, FileSize: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CreateUpdateEmbedding(model, id, vec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	embedText := func(text string) ([]byte, error) {
+		return sqlite_vec.SerializeFloat32([]float32{0, 1})
+	}
+	nearest := func(query string) int64 {
+		t.Helper()
+		q, err := ParseSearchQuery(query, QueryFilter{BaseDirs: []int64{1}, Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		imgs, err := q.Run(db, embedText)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(imgs) != 1 {
+			t.Fatalf("%s: expected an image, got %v", query, imgs)
+		}
+		return imgs[0].ID
+	}
+	if got := nearest("similar:1"); got != 1 {
+		t.Errorf("similar: expected image 1, got %d", got)
+	}
+	if got := nearest("sunset"); got != 2 {
+		t.Errorf("description: expected image 2, got %d", got)
+	}
+	if got := nearest("sunset similar:1"); got != 3 {
+		t.Errorf("both: expected image 3, between them, got %d", got)
+	}
+}
+
+// distance< returns every image close enough, not just a page of them
+func TestSearchQueryDistance(t *testing.T) {
+	db, err := NewDatabase(":memory:", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CreateBasedir("/"); err != nil {
+		t.Fatal(err)
+	}
+	model, err := db.EnsureModel("tiny", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetActiveModel("tiny"); err != nil {
+		t.Fatal(err)
+	}
+	// image i is i/20 degrees round from the target, 2sin(i/40 degrees) away, so the first 1100 are closer than 0.9232.
+	// that's more than a server request's maximum limit too.
+	for i := 0; i < 1200; i++ {
+		angle := float64(i) / 20 * math.Pi / 180
+		id, err := db.CreateUpdateImage(&Image{BasedirID: 1, Path: "dir", SubPath: fmt.Sprint(i), Width: 1, Height: 1, FileSize: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CreateUpdateEmbedding(model, id, []float32{float32(math.Cos(angle)), float32(math.Sin(angle))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	target, _ := sqlite_vec.SerializeFloat32([]float32{1, 0})
+	for _, c := range []struct {
+		query  string
+		offset int
+		want   int
+	}{
+		{"distance<0.9232", 0, 1100},
+		{"distance<0.9232", 100, 1000},
+		{"distance<0.9232", 1150, 0},
+		{"distance<0.9232 sort:path", 0, 1100},
+		{"distance<0.9232 sort:hybrid", 0, 1100},
+	} {
+		q, err := parseSearchQuery(c.query, QueryFilter{BaseDirs: []int64{1}, Limit: 10, Offset: c.offset}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		imgs, err := q.Match(db, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(imgs) != c.want {
+			t.Errorf("%s from %d: expected %d images, got %d", c.query, c.offset, c.want, len(imgs))
+		}
+		for _, img := range imgs {
+			if img.Distance.Float64 >= 0.9232 {
+				t.Errorf("%s: image %d is too far, %f", c.query, img.ID, img.Distance.Float64)
+			}
+		}
+	}
+}
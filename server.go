@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/crimro-se/imagedb/embedder"
+	"github.com/crimro-se/imagedb/pkg/imageutil"
+)
+
+// imagedb serve: a JSON API over the database, and a web page using it, for searching from a browser.
+//
+//	GET /api/basedirs                the basedirs, with how many images each has
+//	GET /api/search?q=               a search in the search box's query language
+//	GET /api/images?width_min=1920   browse, filtering by QueryFilter fields named by their db tags
+//	GET /api/images/{id}             an image, with its tags
+//	GET /api/images/{id}/similar?q=  images like it, filtered by the query's terms
+//	GET /api/images/{id}/thumbnail   a jpeg, IMAGE_SIZE_THUMBNAIL or ?size= pixels across at most
+//	GET /api/images/{id}/file        the original, read from its archive if it's in one
+//	PUT /api/images/{id}/tags        replaces its tags with those in a JSON array of strings, unless read only
+//
+// searching and browsing take limit, offset and basedir (repeated for several, every basedir by default),
+// browsing sort (as sort: in the query language) and searching diversity. errors are {"error": "message"}.
+
+//go:embed web
+var webFiles embed.FS
+
+// the most images a request can ask for. a distance< search returns every match past the offset regardless.
+const maxServerResults = 1000
+
+// the largest thumbnail a request can ask for
+const maxThumbnailSize = 1024
+
+type Server struct {
+	db       *Database
+	conf     *Config
+	readOnly bool
+	handler  http.Handler
+
+	// optional, told of images that couldn't be sent, once it's too late to respond with an error
+	OnLog func(string)
+
+	thumbnails chan struct{} // a slot per thumbnail being made, limiting how many images are decoded at once
+
+	embMu sync.Mutex
+	emb   embedder.Embedder // for text searches, created on first use
+}
+
+// the server's API is protected by basic auth if conf.SERVE_PASSWORD is set.
+// Call Close once finished with the server.
+func NewServer(db *Database, conf *Config, readOnly bool) *Server {
+	s := &Server{db: db, conf: conf, readOnly: readOnly, thumbnails: make(chan struct{}, max(conf.THREADS_FOR_THUMBNAILS, 1))}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/basedirs", s.api(s.basedirs))
+	mux.HandleFunc("GET /api/search", s.api(s.search))
+	mux.HandleFunc("GET /api/images", s.api(s.browse))
+	mux.HandleFunc("GET /api/images/{id}", s.api(s.image))
+	mux.HandleFunc("GET /api/images/{id}/similar", s.api(s.similar))
+	mux.HandleFunc("GET /api/images/{id}/thumbnail", s.thumbnail)
+	mux.HandleFunc("GET /api/images/{id}/file", s.file)
+	mux.HandleFunc("PUT /api/images/{id}/tags", s.api(s.replaceTags))
+	mux.HandleFunc("/api/", s.api(func(*http.Request) (any, error) {
+		return nil, httpErrorf(http.StatusNotFound, "no such endpoint")
+	}))
+	web, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err) // embedded, so can't happen
+	}
+	mux.Handle("/", http.FileServerFS(web))
+	s.handler = mux
+	if len(conf.SERVE_PASSWORD) > 0 {
+		s.handler = basicAuth(mux, conf.SERVE_USER, conf.SERVE_PASSWORD)
+	}
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+func (s *Server) Close() error {
+	s.embMu.Lock()
+	defer s.embMu.Unlock()
+	if s.emb != nil {
+		return s.emb.Close()
+	}
+	return nil
+}
+
+// an error to respond with, and its status
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func httpErrorf(status int, format string, args ...any) error {
+	return &httpError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+func writeJSONResponse(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// responds with an error's message, with its status if it's an httpError.
+// mistakes in searches are the client's.
+func writeJSONError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var he *httpError
+	var qe *SearchQueryError
+	switch {
+	case errors.As(err, &he):
+		status = he.status
+	case errors.As(err, &qe):
+		status = http.StatusBadRequest
+	}
+	writeJSONResponse(w, status, map[string]string{"error": err.Error()})
+}
+
+// adapts an endpoint returning a value to respond with as JSON
+func (s *Server) api(endpoint func(r *http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, err := endpoint(r)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, v)
+	}
+}
+
+func basicAuth(next http.Handler, user, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="imagedb", charset="UTF-8"`)
+			writeJSONError(w, httpErrorf(http.StatusUnauthorized, "unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// the embedder used for text searches, created on first use
+func (s *Server) embedder() (embedder.Embedder, error) {
+	s.embMu.Lock()
+	defer s.embMu.Unlock()
+	if s.emb == nil {
+		emb, err := embedder.New(context.Background(), s.conf.EmbedderOptions())
+		if err != nil {
+			return nil, err
+		}
+		s.emb = emb
+	}
+	return s.emb, nil
+}
+
+func (s *Server) embedText(ctx context.Context) func(string) ([]byte, error) {
+	return func(text string) ([]byte, error) {
+		emb, err := s.embedder()
+		if err != nil {
+			return nil, err
+		}
+		return embedSearchText(ctx, s.db, emb, text)
+	}
+}
+
+// the filter for a request's limit, offset, basedir and diversity parameters
+func (s *Server) queryFilter(r *http.Request) (QueryFilter, error) {
+	params := r.URL.Query()
+	qf := QueryFilter{Limit: s.conf.QUERY_RESULTS, Weights: s.conf.RankWeights()}
+	var err error
+	if v := params.Get("limit"); len(v) > 0 {
+		if qf.Limit, err = strconv.Atoi(v); err != nil || qf.Limit <= 0 || qf.Limit > maxServerResults {
+			return qf, httpErrorf(http.StatusBadRequest, "limit must be 1-%d", maxServerResults)
+		}
+	}
+	if v := params.Get("offset"); len(v) > 0 {
+		if qf.Offset, err = strconv.Atoi(v); err != nil || qf.Offset < 0 {
+			return qf, httpErrorf(http.StatusBadRequest, "offset can't be negative")
+		}
+	}
+	if v := params.Get("diversity"); len(v) > 0 {
+		if qf.Diversity, err = strconv.ParseFloat(v, 64); err != nil || qf.Diversity < 0 || qf.Diversity > 1 {
+			return qf, httpErrorf(http.StatusBadRequest, "diversity must be 0-1")
+		}
+	}
+	for _, v := range params["basedir"] {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return qf, httpErrorf(http.StatusBadRequest, "basedir must be an id")
+		}
+		qf.BaseDirs = append(qf.BaseDirs, id)
+	}
+	if len(qf.BaseDirs) == 0 {
+		basedirs, err := s.db.GetAllBasedir()
+		if err != nil {
+			return qf, err
+		}
+		for _, bd := range basedirs {
+			qf.BaseDirs = append(qf.BaseDirs, bd.ID)
+		}
+	}
+	if len(qf.BaseDirs) == 0 {
+		return qf, httpErrorf(http.StatusNotFound, "there are no basedirs to search")
+	}
+	return qf, nil
+}
+
+// sets qf's filters from parameters named by their db tags, eg width_min=1920 or tags_all=cat&tags_all=dog.
+// only fields of the types a client can give are set, so not eg path_match.
+func bindQueryFilter(params url.Values, qf *QueryFilter) error {
+	rv := reflect.ValueOf(qf).Elem()
+	for i := range rv.NumField() {
+		name := rv.Type().Field(i).Tag.Get("db")
+		values, ok := params[name]
+		if !ok || len(values) == 0 {
+			continue
+		}
+		var err error
+		switch field := rv.Field(i).Addr().Interface().(type) {
+		case *sql.NullInt64:
+			field.Int64, err = strconv.ParseInt(values[0], 10, 64)
+			field.Valid = true
+		case *sql.NullFloat64:
+			field.Float64, err = strconv.ParseFloat(values[0], 64)
+			field.Valid = true
+		case *sql.NullString:
+			*field = sql.NullString{String: values[0], Valid: true}
+		case *[]string:
+			*field = values
+		}
+		if err != nil {
+			return httpErrorf(http.StatusBadRequest, "%s must be a number", name)
+		}
+	}
+	return nil
+}
+
+// reads the image with the id in the request's path
+func (s *Server) requestedImage(r *http.Request) (Image, error) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return Image{}, httpErrorf(http.StatusBadRequest, "the image id must be a number")
+	}
+	imgs, err := s.db.ReadImagesByID([]int64{id})
+	if err != nil {
+		return Image{}, err
+	}
+	if len(imgs) == 0 {
+		return Image{}, httpErrorf(http.StatusNotFound, "no image %d", id)
+	}
+	imgs, err = s.db.AugmentImages(imgs)
+	if err != nil {
+		return Image{}, err
+	}
+	return imgs[0], nil
+}
+
+func (s *Server) basedirs(*http.Request) (any, error) {
+	stats, err := s.db.Stats()
+	return stats.Basedirs, err
+}
+
+func (s *Server) search(r *http.Request) (any, error) {
+	qf, err := s.queryFilter(r)
+	if err != nil {
+		return nil, err
+	}
+	q, err := ParseSearchQuery(r.URL.Query().Get("q"), qf)
+	if err != nil {
+		return nil, err
+	}
+	imgs, err := q.Run(s.db, s.embedText(r.Context()))
+	if err != nil {
+		return nil, err
+	}
+	return imagesJSON(s.db, imgs)
+}
+
+func (s *Server) browse(r *http.Request) (any, error) {
+	qf, err := s.queryFilter(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := bindQueryFilter(r.URL.Query(), &qf); err != nil {
+		return nil, err
+	}
+	order := OrderByAestheticDesc
+	if v := r.URL.Query().Get("sort"); len(v) > 0 {
+		var ok bool
+		if order, ok = searchSortOrders[v]; !ok {
+			return nil, httpErrorf(http.StatusBadRequest, "unknown sort, expected aesthetic, aesthetic-asc, path, path-desc or hybrid")
+		}
+	}
+	imgs, err := s.db.ReadImages(qf, order)
+	if err != nil {
+		return nil, err
+	}
+	return imagesJSON(s.db, imgs)
+}
+
+func (s *Server) image(r *http.Request) (any, error) {
+	img, err := s.requestedImage(r)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := s.db.ReadTags(img.ID)
+	if err != nil {
+		return nil, err
+	}
+	out := newImageJSON(img)
+	out.Tags = tagNames(tags)
+	return out, nil
+}
+
+func (s *Server) similar(r *http.Request) (any, error) {
+	img, err := s.requestedImage(r)
+	if err != nil {
+		return nil, err
+	}
+	qf, err := s.queryFilter(r)
+	if err != nil {
+		return nil, err
+	}
+	q, err := parseSearchQuery(r.URL.Query().Get("q"), qf, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(q.Text) > 0 || q.SimilarTo != 0 {
+		return nil, httpErrorf(http.StatusBadRequest, "only terms can narrow a search for similar images")
+	}
+	embedding, err := s.db.ReadEmbedding(img.ID)
+	if err != nil {
+		return nil, httpErrorf(http.StatusNotFound, "%v", err)
+	}
+	imgs, err := q.Match(s.db, embedding)
+	if err != nil {
+		return nil, err
+	}
+	return imagesJSON(s.db, imgs)
+}
+
+func (s *Server) thumbnail(w http.ResponseWriter, r *http.Request) {
+	size := s.conf.IMAGE_SIZE_THUMBNAIL
+	if v := r.URL.Query().Get("size"); len(v) > 0 {
+		var err error
+		if size, err = strconv.Atoi(v); err != nil || size <= 0 || size > maxThumbnailSize {
+			writeJSONError(w, httpErrorf(http.StatusBadRequest, "size must be 1-%d", maxThumbnailSize))
+			return
+		}
+	}
+	img, err := s.requestedImage(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	select {
+	case s.thumbnails <- struct{}{}:
+		defer func() { <-s.thumbnails }()
+	case <-r.Context().Done():
+		return
+	}
+	loaded, err := img.Load()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if err := jpeg.Encode(w, imageutil.ScaleImageRGBA(loaded, size), &jpeg.Options{Quality: 85}); err != nil {
+		s.log(fmt.Sprintf("failed to send image %d's thumbnail: %v", img.ID, err))
+	}
+}
+
+func (s *Server) file(w http.ResponseWriter, r *http.Request) {
+	img, err := s.requestedImage(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	file, err := img.Open()
+	if errors.Is(err, fs.ErrNotExist) {
+		err = httpErrorf(http.StatusNotFound, "image %d's file is missing", img.ID)
+	}
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	defer file.Close()
+	// files on disk support range requests, those read from archives are streamed
+	if f, ok := file.(*os.File); ok {
+		if info, err := f.Stat(); err == nil {
+			http.ServeContent(w, r, img.SubPath, info.ModTime(), f)
+			return
+		}
+	}
+	if contentType := mime.TypeByExtension(path.Ext(img.SubPath)); len(contentType) > 0 {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if _, err := io.Copy(w, file); err != nil {
+		s.log(fmt.Sprintf("failed to send image %d: %v", img.ID, err))
+	}
+}
+
+func (s *Server) log(msg string) {
+	if s.OnLog != nil {
+		s.OnLog(msg)
+	}
+}
+
+func (s *Server) replaceTags(r *http.Request) (any, error) {
+	if s.readOnly {
+		return nil, httpErrorf(http.StatusForbidden, "the server is read only")
+	}
+	img, err := s.requestedImage(r)
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	if err := json.NewDecoder(r.Body).Decode(&tags); err != nil {
+		return nil, httpErrorf(http.StatusBadRequest, "expected a JSON array of tags")
+	}
+	if err := s.db.ReplaceTags(img.ID, tags); err != nil {
+		return nil, err
+	}
+	saved, err := s.db.ReadTags(img.ID)
+	if err != nil {
+		return nil, err
+	}
+	return tagNames(saved), nil
+}
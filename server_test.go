@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	db, err := NewDatabase(":memory:", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testData, err := filepath.Abs("test_data/valid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateBasedir(testData); err != nil {
+		t.Fatal(err)
+	}
+	model, err := db.EnsureModel("tiny", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a file, an image in an archive, and one whose file is missing. each is further from the first than the last
+	images := []Image{
+		{Path: "/", SubPath: "000000525286.jpg", Width: 640},
+		{Path: "/test_archive.zip", SubPath: "000000034873.jpg", Width: 480},
+		{Path: "/", SubPath: "missing.jpg", Width: 1920},
+	}
+	for i, img := range images {
+		img.BasedirID = 1
+		id, err := db.CreateUpdateImage(&img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CreateUpdateEmbedding(model, id, [][]float32{{1, 0}, {0.8, 0.6}, {0, 1}}[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SetActiveModel("tiny"); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, _ := LoadConfig(filepath.Join(t.TempDir(), "missing.ini"))
+	request := func(server *Server, method, url, body string, wantStatus int) *httptest.ResponseRecorder {
+		t.Helper()
+		var reader io.Reader
+		if len(body) > 0 {
+			reader = strings.NewReader(body)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(method, url, reader))
+		if w.Code != wantStatus {
+			t.Fatalf("%s %s: status %d, expected %d: %s", method, url, w.Code, wantStatus, w.Body.String())
+		}
+		return w
+	}
+	ids := func(w *httptest.ResponseRecorder) []int64 {
+		t.Helper()
+		var imgs []ImageJSON
+		if err := json.Unmarshal(w.Body.Bytes(), &imgs); err != nil {
+			t.Fatal(err)
+		}
+		out := make([]int64, len(imgs))
+		for i, img := range imgs {
+			out[i] = img.ID
+		}
+		return out
+	}
+
+	server := NewServer(db, conf, false)
+	defer server.Close()
+	if !strings.Contains(request(server, "GET", "/api/basedirs", "", http.StatusOK).Body.String(), testData) {
+		t.Error("expected the basedir to be listed")
+	}
+	if got := ids(request(server, "GET", "/api/images?width_min=600&sort=path", "", http.StatusOK)); !slices.Equal(got, []int64{1, 3}) {
+		t.Errorf("expected the images at least 600 wide, got %v", got)
+	}
+	if got := ids(request(server, "GET", "/api/search?q=similar:1+w<1000", "", http.StatusOK)); !slices.Equal(got, []int64{1, 2}) {
+		t.Errorf("expected the images like image 1 narrower than 1000, got %v", got)
+	}
+	if got := ids(request(server, "GET", "/api/images/1/similar?q=distance<0.7", "", http.StatusOK)); !slices.Equal(got, []int64{1, 2}) {
+		t.Errorf("expected the images close to image 1, got %v", got)
+	}
+	request(server, "GET", "/api/search?q=w>wide", "", http.StatusBadRequest)
+	request(server, "GET", "/api/images?width_min=wide", "", http.StatusBadRequest)
+	request(server, "GET", "/api/images/9", "", http.StatusNotFound)
+	request(server, "GET", "/api/colours", "", http.StatusNotFound)
+
+	// originals are read from disk or archives
+	for id, file := range map[string]string{"1": "000000525286.jpg", "2": "test_archive.zip"} {
+		w := request(server, "GET", "/api/images/"+id+"/file", "", http.StatusOK)
+		onDisk, err := os.ReadFile(filepath.Join(testData, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == "1" && w.Body.Len() != len(onDisk) || id == "2" && w.Body.Len() != 94292 {
+			t.Errorf("image %s: unexpected file of %d bytes", id, w.Body.Len())
+		}
+	}
+	request(server, "GET", "/api/images/3/file", "", http.StatusNotFound)
+	thumb, err := jpeg.Decode(request(server, "GET", "/api/images/2/thumbnail?size=64", "", http.StatusOK).Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if max(thumb.Bounds().Dx(), thumb.Bounds().Dy()) != 64 {
+		t.Errorf("expected a 64 pixel thumbnail, got %v", thumb.Bounds())
+	}
+	// thumbnails wait for a free slot, giving up if the client does
+	for range cap(server.thumbnails) {
+		server.thumbnails <- struct{}{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	busy := httptest.NewRecorder()
+	server.ServeHTTP(busy, httptest.NewRequest("GET", "/api/images/2/thumbnail", nil).WithContext(ctx))
+	if busy.Body.Len() != 0 {
+		t.Error("expected no thumbnail to be made while every slot is taken")
+	}
+	for range cap(server.thumbnails) {
+		<-server.thumbnails
+	}
+
+	w := request(server, "PUT", "/api/images/1/tags", `["Favourite", " cat "]`, http.StatusOK)
+	if got := strings.TrimSpace(w.Body.String()); got != `["cat","favourite"]` && got != `["favourite","cat"]` {
+		t.Errorf("unexpected tags %s", got)
+	}
+	var img ImageJSON
+	if err := json.Unmarshal(request(server, "GET", "/api/images/1", "", http.StatusOK).Body.Bytes(), &img); err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Tags) != 2 || img.Path != filepath.Join(testData, "000000525286.jpg") {
+		t.Errorf("unexpected image %+v", img)
+	}
+	if !strings.Contains(request(server, "GET", "/", "", http.StatusOK).Body.String(), "<title>imagedb</title>") {
+		t.Error("expected the web page")
+	}
+
+	readOnly := NewServer(db, conf, true)
+	request(readOnly, "PUT", "/api/images/1/tags", `[]`, http.StatusForbidden)
+
+	conf.SERVE_PASSWORD = "secret"
+	private := NewServer(db, conf, false)
+	request(private, "GET", "/api/basedirs", "", http.StatusUnauthorized)
+	r := httptest.NewRequest("GET", "/api/basedirs", nil)
+	r.SetBasicAuth(conf.SERVE_USER, "secret")
+	w = httptest.NewRecorder()
+	private.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the password to be accepted, got status %d", w.Code)
+	}
+}